@@ -8,15 +8,16 @@ import (
 )
 
 type APIKeyInfo struct {
-	Name string `json:"name"`
-	Key  string `json:"key"`
-	ID   string `json:"id"`
+	Name     string       `json:"name"`
+	Key      string       `json:"key"`
+	ID       string       `json:"id"`
+	Services ServiceScope `json:"services"` // Empty for every service
 }
 
 func APISet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Ensure user is logged in
-		newKeys, err := formatUserRequest[[]APIKeyInfo](r, jwt)
+		newKeys, claims, err := formatUserRequest[[]APIKeyInfo](r, jwt, UserRoleAdmin)
 		if err != nil {
 			Printing.PrintErrStr("Could not create API: " + err.Error())
 			requestRespondCode(w, http.StatusForbidden)
@@ -42,33 +43,50 @@ func APISet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
 					requestRespondCode(w, http.StatusInternalServerError)
 					return
 				}
+				existingKey.Key = "" // Never log the key itself
+				audit(r, db, claims.Username, AuditAPIKeyRemove, existingKey.Name, existingKey, nil)
 			}
 		}
 
 		// Add all new keys to cache
 		for i, newKey := range *newKeys {
-			if !slices.ContainsFunc(existingKeys, func(existingKey APIKeyInfo) bool {
+			existingIndex := slices.IndexFunc(existingKeys, func(existingKey APIKeyInfo) bool {
 				return existingKey.ID == newKey.ID // Check if the key already exists in existingKeys
-			}) {
+			})
+			if existingIndex == -1 {
 				APIKey := generateRandomString(32)
 				keyID := generateRandomString(32)
 				(*newKeys)[i].Key = APIKey
 				(*newKeys)[i].ID = keyID
-				err = db.addAPIKey(r.Context(), APIKey, keyID, newKey.Name)
+				err = db.addAPIKey(r.Context(), APIKey, keyID, newKey.Name, newKey.Services)
 				if err != nil {
 					Printing.PrintErrStr("Could not add API key to cache: " + err.Error())
 					requestRespondCode(w, http.StatusInternalServerError)
 					return
 				}
+				audit(r, db, claims.Username, AuditAPIKeyCreate, newKey.Name, nil, APIKeyInfo{Name: newKey.Name, ID: keyID, Services: newKey.Services})
+				continue
+			}
+			err = db.setAPIKeyServices(r.Context(), newKey.ID, newKey.Services)
+			if err != nil {
+				Printing.PrintErrStr("Could not update API key services: " + err.Error())
+				requestRespondCode(w, http.StatusInternalServerError)
+				return
+			}
+			existingKey := existingKeys[existingIndex]
+			if !slices.Equal(existingKey.Services, newKey.Services) {
+				existingKey.Key = ""
+				audit(r, db, claims.Username, AuditAPIKeyUpdate, existingKey.Name, existingKey, APIKeyInfo{Name: existingKey.Name, ID: existingKey.ID, Services: newKey.Services})
 			}
 		}
 		requestRespond(w, newKeys)
 	}
 }
 
+// Only users that can see every service can list keys, like changing them, since keys may reach services they can't
 func APIGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := jwt.ReadAndValidateJWT(r)
+		_, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleViewer)
 		if err != nil {
 			Printing.PrintErrStr("Could not get API: " + err.Error())
 			requestRespondCode(w, http.StatusForbidden)
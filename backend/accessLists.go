@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Analytics reason for requests refused by a service's access list
+const blockedAccessList = "access_list"
+
+// IPs and CIDRs allowed or denied from reaching a service. Denies win, and a non-empty allow list denies everyone else.
+type AccessList struct {
+	Allow  []string       `json:"allow"`
+	Deny   []string       `json:"deny"`
+	Denial DenialResponse `json:"denial"`
+}
+
+// What CheckBag answers with instead of forwarding a request
+type DenialResponse struct {
+	StatusCode int    `json:"status_code"` // Defaults to 403
+	Body       string `json:"body"`        // Plain text, defaults to the status text
+}
+
+func (accessList AccessList) validate() error {
+	for _, entry := range slices.Concat(accessList.Allow, accessList.Deny) {
+		if _, err := parseAccessListEntry(entry); err != nil {
+			return errors.New("invalid IP or CIDR \"" + entry + "\"")
+		}
+	}
+	return accessList.Denial.validate()
+}
+
+// Checks if the IP may reach the service, unparsable IPs are only allowed when there's no allow list
+func (accessList AccessList) Allows(ip string) bool {
+	address, err := netip.ParseAddr(ip)
+	if err != nil {
+		return len(accessList.Allow) == 0
+	}
+	address = address.Unmap()
+	if accessListContains(accessList.Deny, address) {
+		return false
+	}
+	return len(accessList.Allow) == 0 || accessListContains(accessList.Allow, address)
+}
+
+func accessListContains(entries []string, address netip.Addr) bool {
+	for _, entry := range entries {
+		prefix, err := parseAccessListEntry(entry)
+		if err == nil && prefix.Contains(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads an IP or CIDR as a prefix, a bare IP is a prefix of its full length
+func parseAccessListEntry(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+	address, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	address = address.Unmap()
+	return netip.PrefixFrom(address, address.BitLen()), nil
+}
+
+func (denial DenialResponse) validate() error {
+	if denial.StatusCode != 0 && (denial.StatusCode < 400 || denial.StatusCode > 599) {
+		return errors.New("denial status code " + strconv.Itoa(denial.StatusCode) + " isn't an error status")
+	}
+	return nil
+}
+
+// Writes the denial, returning the status code and the number of body bytes written
+func (denial DenialResponse) write(w http.ResponseWriter) (int, int) {
+	statusCode := denial.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusForbidden
+	}
+	body := denial.Body
+	if body == "" {
+		body = http.StatusText(statusCode)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(statusCode)
+	w.Write([]byte(body))
+	return statusCode, len(body)
+}
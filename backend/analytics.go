@@ -2,37 +2,237 @@ package main
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
 )
 
+// Everything recorded about a single proxied request
+type AnalyticRecord struct {
+	Resource          string
+	Country           string
+	IP                string
+	ResponseCode      int
+	ReceivedBytes     int
+	SentBytes         int
+	UserAgent         UserAgent
+	Referrer          string
+	Host              string // Only recorded for requests that didn't match a service
+	RawUserAgent      string // Only recorded for requests that didn't match a service
+	ScannerRules      []string
+	Blocked           string
+	Challenge         string
+	WAFRules          []string
+	BlockLists        []string
+	BlockedCrawler    string
+	CrawlerBytesSaved int
+}
+
+// Decisions made about a request before it's forwarded, recorded alongside its analytics
+type RequestAnnotations struct {
+	ScannerRules []ScannerRule
+	Blocked      string   // Why CheckBag refused to forward the request, empty if it was forwarded
+	Challenge    string   // Browser challenge outcome, ex. "issued", "passed", or "failed"
+	WAFRules     []string // IDs of matched WAF rules, in detect or block mode
+	BlockLists   []string // Names of block lists containing the client's IP
+	// Crawler refused by the service's crawler policy, and the estimated response bytes that weren't sent to it
+	BlockedCrawler    string
+	CrawlerBytesSaved int
+}
+
+type requestAnnotationsKey struct{}
+
+// Pseudo-service collecting requests for hosts that don't belong to any service, typically scanners
+const unmatchedServiceID = "Unmatched"
+
+// Hash-backed dimensions of a record, keyed by their analytics field name. Empty values are not recorded.
+func (record AnalyticRecord) dimensions() map[string][]string {
+	dimensions := map[string][]string{
+		"browser":  {record.UserAgent.Browser},
+		"os":       {record.UserAgent.OS},
+		"device":   {record.UserAgent.Device},
+		"referrer": {record.Referrer},
+	}
+	if record.UserAgent.Bot != nil {
+		dimensions["bot"] = []string{record.UserAgent.Bot.Name}
+	}
+	if record.Blocked != "" {
+		blockedCountry := record.Country
+		if !knownCountry(blockedCountry) {
+			blockedCountry = "Unknown"
+		}
+		dimensions["blocked"] = []string{record.Blocked}
+		dimensions["blocked_country"] = []string{blockedCountry}
+	}
+	if record.Challenge != "" {
+		dimensions["challenge"] = []string{record.Challenge}
+	}
+	if len(record.WAFRules) > 0 {
+		dimensions["waf_rule"] = record.WAFRules
+	}
+	if record.BlockedCrawler != "" {
+		dimensions["blocked_crawler"] = []string{record.BlockedCrawler}
+	}
+	if len(record.BlockLists) > 0 {
+		dimensions["block_list"] = record.BlockLists
+	}
+	if len(record.ScannerRules) > 0 {
+		dimensions["scanner_rule"] = record.ScannerRules
+	}
+	if record.Host != "" {
+		dimensions["host"] = []string{record.Host}
+		dimensions["user_agent"] = []string{record.RawUserAgent}
+	}
+	return dimensions
+}
+
 func analytics(r *http.Request, responseCode int, serviceLinks ServiceLinks, db AdvancedDB, receivedBytes int, responseBytes int) {
 	service, err := serviceLinks.GetServiceFromIncomingURL(r.Host)
 	var serviceID string
+	var selfHosts []string
 	if err != nil {
-		serviceID = "Unknown"
+		serviceID = unmatchedServiceID
 	} else {
 		serviceID = service.ID
+		selfHosts = service.IncomingAddresses
 	}
 	resource := r.PathValue("path")
 
-	// Search for country and ip in headers
-	var country string
-	var ip string
-	for name, values := range r.Header {
-		name = strings.ToLower(name)
-		// Cloudflare headers have both "country" and "ip" in the header name for country
-		if strings.Contains(name, "country") {
-			country = values[0]
-		} else if ip != "" && strings.HasSuffix(name, "ip") { // Get the client's IP address
-			ip = values[0]
-		} else if name == "x-forwarded-for" { // Get the client's IP address
-			ip = values[0]
+	ip := requestClientIP(r)
+	record := AnalyticRecord{
+		Resource:      resource,
+		Country:       requestCountry(r),
+		IP:            ip,
+		ResponseCode:  responseCode,
+		ReceivedBytes: receivedBytes,
+		SentBytes:     responseBytes,
+		UserAgent:     parseUserAgent(r.UserAgent()),
+		Referrer:      normalizeReferrer(r.Referer(), slices.Concat(selfHosts, []string{r.Host})),
+	}
+	annotations := getRequestAnnotations(r)
+	record.Blocked = annotations.Blocked
+	record.Challenge = annotations.Challenge
+	record.WAFRules = annotations.WAFRules
+	record.BlockLists = annotations.BlockLists
+	record.BlockedCrawler = annotations.BlockedCrawler
+	record.CrawlerBytesSaved = annotations.CrawlerBytesSaved
+	for _, rule := range annotations.ScannerRules {
+		record.ScannerRules = append(record.ScannerRules, rule.ID)
+	}
+	if service == nil {
+		record.Host = strings.ToLower(r.Host)
+		record.RawUserAgent = r.UserAgent()
+		if record.Host == "" {
+			record.Host = "(none)"
 		}
 	}
 	// Use background context with timeout to avoid cancellation when request completes
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	db.incrementAnalytics(ctx, serviceID, resource, country, ip, responseCode, receivedBytes, responseBytes)
+	db.incrementAnalytics(ctx, serviceID, record)
+	if service != nil && record.UserAgent.Bot == nil && isPageRequest(r, responseCode) {
+		err = db.recordVisit(ctx, serviceID, visitorID(ip, r.UserAgent()), resource, visitTimeout)
+		if err != nil {
+			Printing.PrintErrStr("Could not record visit: " + err.Error())
+		}
+	}
+}
+
+// Prefers the country an edge provider put in countryHeader, then the local GeoIP database. The header is only
+// believed from trusted proxies, since anyone else could send it to get past a geo-fence.
+func requestCountry(r *http.Request) string {
+	if country := strings.TrimSpace(r.Header.Get(countryHeader)); countryHeader != "" && country != "" && requestFromTrustedProxy(r) {
+		return country
+	}
+	return geoIPCountry(requestClientIP(r))
+}
+
+// Resolves the client's IP, believing forwarding headers only from trusted proxies. X-Forwarded-For is read from the
+// right, since every proxy appends the address it saw and only the entries added by trusted proxies can be believed.
+func requestClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !requestFromTrustedProxy(r) {
+		return canonicalIP(host)
+	}
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) != 0 {
+		client := host
+		hops := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			address, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break // Anything further left can't be believed
+			}
+			client = address.Unmap().String()
+			if !accessListContains(trustedProxies, address.Unmap()) {
+				break
+			}
+		}
+		return canonicalIP(client)
+	}
+	for _, name := range []string{"X-Real-IP", "CF-Connecting-IP", "True-Client-IP"} {
+		if value := strings.TrimSpace(r.Header.Get(name)); net.ParseIP(value) != nil {
+			return canonicalIP(value)
+		}
+	}
+	return canonicalIP(host)
+}
+
+// Formats an IP consistently so it can be used as a key, leaving unparsable addresses as-is
+func canonicalIP(ip string) string {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return ip
+	}
+	return parsedIP.String()
+}
+
+// Attaches empty annotations to a request, to be filled in before it's forwarded
+func annotateRequest(r *http.Request) (*http.Request, *RequestAnnotations) {
+	annotations := &RequestAnnotations{}
+	return r.WithContext(context.WithValue(r.Context(), requestAnnotationsKey{}, annotations)), annotations
+}
+
+// Annotations attached by annotateRequest, or empty annotations if there are none
+func getRequestAnnotations(r *http.Request) *RequestAnnotations {
+	annotations, ok := r.Context().Value(requestAnnotationsKey{}).(*RequestAnnotations)
+	if !ok {
+		return &RequestAnnotations{}
+	}
+	return annotations
+}
+
+// Reduces a Referer header to the referring host. Self-referrals and unparsable referrers become an empty string.
+func normalizeReferrer(referer string, selfHosts []string) string {
+	if referer == "" {
+		return ""
+	}
+	referrerURL, err := url.Parse(referer)
+	if err != nil || referrerURL.Hostname() == "" {
+		return ""
+	}
+	host := normalizeHost(referrerURL.Hostname())
+	if slices.ContainsFunc(selfHosts, func(selfHost string) bool {
+		return normalizeHost(selfHost) == host
+	}) {
+		return ""
+	}
+	return host
+}
+
+// Lowercases a host and strips any port and leading "www."
+func normalizeHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return strings.TrimPrefix(host, "www.")
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+type AuditAction string
+
+const (
+	AuditSignIn           AuditAction = "sign_in"
+	AuditSignOut          AuditAction = "sign_out"
+	AuditSessionRevoke    AuditAction = "session.revoke"
+	AuditServiceCreate    AuditAction = "service.create"
+	AuditServiceUpdate    AuditAction = "service.update"
+	AuditServiceDelete    AuditAction = "service.delete"
+	AuditAPIKeyCreate     AuditAction = "api_key.create"
+	AuditAPIKeyUpdate     AuditAction = "api_key.update"
+	AuditAPIKeyRemove     AuditAction = "api_key.remove"
+	AuditUserSet          AuditAction = "user.set"
+	AuditUserRemove       AuditAction = "user.remove"
+	AuditTwoFactorEnable  AuditAction = "two_factor.enable"
+	AuditTwoFactorDisable AuditAction = "two_factor.disable"
+	AuditPasskeyAdd       AuditAction = "passkey.add"
+	AuditPasskeyRename    AuditAction = "passkey.rename"
+	AuditPasskeyRemove    AuditAction = "passkey.remove"
+	AuditScannerRulesSet  AuditAction = "scanner_rules.set"
+	AuditBanRulesSet      AuditAction = "ban_rules.set"
+	AuditBanAdd           AuditAction = "ban.add"
+	AuditBanRemove        AuditAction = "ban.remove"
+	AuditWAFRulesSet      AuditAction = "waf_rules.set"
+	AuditJWTKeyRotate     AuditAction = "jwt_key.rotate"
+)
+
+const (
+	defaultAuditLogLimit = 100
+	maximumAuditLogLimit = 1000
+)
+
+// How long audit events are kept, set by AUDIT_LOG_RETENTION in days
+var auditLogRetention = 90 * 24 * time.Hour
+
+// Who changed what, from where, and when. Events are only ever added, and are dropped once they're older than the retention.
+type AuditEvent struct {
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Actor   string          `json:"actor"` // Username, empty if nobody was signed in
+	IP      string          `json:"ip"`
+	Action  AuditAction     `json:"action"`
+	Target  string          `json:"target"` // What was changed, ex. a service's title or a username
+	Before  json.RawMessage `json:"before,omitempty"`
+	After   json.RawMessage `json:"after,omitempty"`
+	Changes []string        `json:"changes,omitempty"` // Fields that differ between before and after
+}
+
+// Reads AUDIT_LOG_RETENTION in days, keeping the default if it's missing or invalid
+func loadAuditLogRetention() {
+	rawRetention := os.Getenv("AUDIT_LOG_RETENTION")
+	if rawRetention == "" {
+		return
+	}
+	days, err := strconv.Atoi(rawRetention)
+	if err != nil || days <= 0 {
+		Printing.PrintErrStr("Invalid AUDIT_LOG_RETENTION \"" + rawRetention + "\", keeping audit events for " + strconv.Itoa(int(auditLogRetention.Hours()/24)) + " days")
+		return
+	}
+	auditLogRetention = time.Duration(days) * 24 * time.Hour
+}
+
+// Records the action, with the state before and after it if there is one. Failing to record doesn't fail the request.
+func audit(r *http.Request, db AdvancedDB, actor string, action AuditAction, target string, before any, after any) {
+	event := AuditEvent{
+		ID:     generateRandomString(16),
+		Time:   time.Now(),
+		Actor:  actor,
+		IP:     requestClientIP(r),
+		Action: action,
+		Target: target,
+		Before: auditState(before),
+		After:  auditState(after),
+	}
+	event.Changes = auditChanges(event.Before, event.After)
+	err := db.addAuditEvent(r.Context(), event, auditLogRetention)
+	if err != nil {
+		Printing.PrintErrStr("Could not record audit event " + string(action) + ": " + err.Error())
+	}
+}
+
+func auditState(state any) json.RawMessage {
+	if state == nil {
+		return nil
+	}
+	rawState, err := json.Marshal(state)
+	if err != nil {
+		Printing.PrintErrStr("Could not encode audit state: " + err.Error())
+		return nil
+	}
+	return rawState
+}
+
+// The top level fields that differ, when both states are JSON objects
+func auditChanges(before json.RawMessage, after json.RawMessage) []string {
+	var beforeFields, afterFields map[string]json.RawMessage
+	if json.Unmarshal(before, &beforeFields) != nil || json.Unmarshal(after, &afterFields) != nil {
+		return nil
+	}
+	var changes []string
+	for field, value := range afterFields {
+		if !bytes.Equal(beforeFields[field], value) {
+			changes = append(changes, field)
+		}
+	}
+	for field := range beforeFields {
+		if _, ok := afterFields[field]; !ok {
+			changes = append(changes, field)
+		}
+	}
+	slices.Sort(changes)
+	return changes
+}
+
+// Records every service that was created, changed, or deleted
+func auditServiceChanges(r *http.Request, db AdvancedDB, actor string, before ServiceLinks, after ServiceLinks) {
+	for _, oldService := range before {
+		if !slices.ContainsFunc(after, func(service ServiceLink) bool { return service.ID == oldService.ID }) {
+			audit(r, db, actor, AuditServiceDelete, oldService.Title, oldService, nil)
+		}
+	}
+	for _, newService := range after {
+		index := slices.IndexFunc(before, func(service ServiceLink) bool { return service.ID == newService.ID })
+		if index == -1 {
+			audit(r, db, actor, AuditServiceCreate, newService.Title, nil, newService)
+			continue
+		}
+		if !bytes.Equal(auditState(before[index]), auditState(newService)) {
+			audit(r, db, actor, AuditServiceUpdate, newService.Title, before[index], newService)
+		}
+	}
+}
+
+// Queries audit events, newest first. Filters are the actor, an action or its prefix (ex. "service"), the target, and
+// RFC 3339 since and until times.
+func auditLogGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not get audit log: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		query := r.URL.Query()
+		since, until := time.Time{}, time.Now()
+		if rawSince := query.Get("since"); rawSince != "" {
+			since, err = time.Parse(time.RFC3339, rawSince)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, "since must be an RFC 3339 time")
+				return
+			}
+		}
+		if rawUntil := query.Get("until"); rawUntil != "" {
+			until, err = time.Parse(time.RFC3339, rawUntil)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, "until must be an RFC 3339 time")
+				return
+			}
+		}
+		limit := defaultAuditLogLimit
+		if rawLimit := query.Get("limit"); rawLimit != "" {
+			limit, err = strconv.Atoi(rawLimit)
+			if err != nil || limit <= 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, "limit must be a positive number")
+				return
+			}
+			limit = min(limit, maximumAuditLogLimit)
+		}
+
+		events, err := db.getAuditEvents(r.Context(), since, until)
+		if err != nil {
+			Printing.PrintErrStr("Could not get audit log: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		actor, action, target := query.Get("actor"), query.Get("action"), query.Get("target")
+		events = slices.DeleteFunc(events, func(event AuditEvent) bool {
+			return (actor != "" && event.Actor != actor) ||
+				(action != "" && string(event.Action) != action && !strings.HasPrefix(string(event.Action), action+".")) ||
+				(target != "" && event.Target != target)
+		})
+		slices.Reverse(events)
+		requestRespond(w, events[:min(limit, len(events))])
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+type BanTrigger string
+
+// Analytics reason for requests refused because their IP is banned
+const blockedBan = "ban"
+
+const (
+	BanTriggerResponseCodes BanTrigger = "response_codes" // Too many matching response codes from one IP within a window
+	BanTriggerScannerRule   BanTrigger = "scanner_rule"   // Any request matching one of the scanner rules
+)
+
+// Automatically bans an IP when it's triggered
+type BanRule struct {
+	ID            string     `json:"id"`
+	Name          string     `json:"name"`
+	Trigger       BanTrigger `json:"trigger"`
+	ResponseCodes []int      `json:"response_codes"` // For response code triggers
+	Threshold     int        `json:"threshold"`      // For response code triggers
+	Window        int        `json:"window"`         // Minutes, for response code triggers
+	ScannerRules  []string   `json:"scanner_rules"`  // Scanner rule IDs for scanner rule triggers, empty matches any rule
+	Duration      int        `json:"duration"`       // Minutes, 0 bans permanently
+}
+
+type Ban struct {
+	IP       string     `json:"ip"`
+	Reason   string     `json:"reason"`
+	RuleID   string     `json:"rule_id"` // Empty for manual bans
+	Created  time.Time  `json:"created"`
+	Expires  *time.Time `json:"expires"` // nil for permanent bans
+	Attempts int        `json:"attempts"`
+}
+
+type BanRequest struct {
+	IP       string `json:"ip"`
+	Reason   string `json:"reason"`
+	Duration int    `json:"duration"` // Minutes, 0 bans permanently
+}
+
+type BanEngine struct {
+	mutex sync.RWMutex
+	rules []BanRule
+}
+
+func (engine *BanEngine) Setup(db AdvancedDB) {
+	rules, err := db.getBanRules(context.Background())
+	if err != nil {
+		Printing.PrintErrStr("Could not get ban rules from database: " + err.Error())
+	}
+	engine.SetRules(rules)
+	Printing.Println("Loaded " + strconv.Itoa(len(rules)) + " ban rules")
+}
+
+func (engine *BanEngine) SetRules(rules []BanRule) {
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.rules = rules
+}
+
+func (engine *BanEngine) Rules() []BanRule {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	return slices.Clone(engine.rules)
+}
+
+func (rule BanRule) validate() error {
+	if rule.Duration < 0 {
+		return errors.New("ban rule \"" + rule.Name + "\" has a negative duration")
+	}
+	switch rule.Trigger {
+	case BanTriggerResponseCodes:
+		if len(rule.ResponseCodes) == 0 || rule.Threshold <= 0 || rule.Window <= 0 {
+			return errors.New("ban rule \"" + rule.Name + "\" needs response codes, a threshold, and a window")
+		}
+	case BanTriggerScannerRule:
+	default:
+		return errors.New("ban rule \"" + rule.Name + "\" has an unknown trigger \"" + string(rule.Trigger) + "\"")
+	}
+	return nil
+}
+
+// Checks a finished request against the ban rules, banning its client if any rule triggers
+func (engine *BanEngine) Observe(r *http.Request, responseCode int, annotations *RequestAnnotations, db AdvancedDB) {
+	ip := requestClientIP(r)
+	if annotations.Blocked == blockedBan || !automaticallyBannable(ip) {
+		return
+	}
+	// Use background context with timeout to avoid cancellation when request completes
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, rule := range engine.Rules() {
+		triggered := false
+		switch rule.Trigger {
+		case BanTriggerResponseCodes:
+			if !slices.Contains(rule.ResponseCodes, responseCode) {
+				continue
+			}
+			count, err := db.incrementBanCounter(ctx, rule.ID, ip, time.Duration(rule.Window)*time.Minute)
+			if err != nil {
+				Printing.PrintErrStr("Could not count response for ban rule \"" + rule.Name + "\": " + err.Error())
+				continue
+			}
+			triggered = count >= rule.Threshold
+		case BanTriggerScannerRule:
+			triggered = slices.ContainsFunc(annotations.ScannerRules, func(scannerRule ScannerRule) bool {
+				return len(rule.ScannerRules) == 0 || slices.Contains(rule.ScannerRules, scannerRule.ID)
+			})
+		}
+		if !triggered {
+			continue
+		}
+		err := db.addBan(ctx, Ban{IP: ip, Reason: rule.Name, RuleID: rule.ID}, time.Duration(rule.Duration)*time.Minute)
+		if err != nil {
+			Printing.PrintErrStr("Could not ban " + ip + ": " + err.Error())
+			continue
+		}
+		Printing.Println("Banned " + ip + " by rule \"" + rule.Name + "\"")
+		return
+	}
+}
+
+// Never automatically ban loopback, private, or trusted proxy addresses. requestClientIP only believes forwarding
+// headers from trusted proxies, so a client can't frame another IP, but a request the proxy didn't label resolves to
+// the proxy itself, and banning it would block everyone.
+func automaticallyBannable(ip string) bool {
+	address, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	address = address.Unmap()
+	return !address.IsLoopback() && !address.IsPrivate() && !address.IsUnspecified() && !accessListContains(trustedProxies, address)
+}
+
+func banRulesGet(engine *BanEngine, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get ban rules: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		requestRespond(w, engine.Rules())
+	}
+}
+
+// Replaces all ban rules
+func banRulesSet(engine *BanEngine, db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		newRules, claims, err := formatUserRequest[[]BanRule](r, jwt, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not set ban rules: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		for i, rule := range *newRules {
+			if err := rule.validate(); err != nil {
+				Printing.PrintErrStr(err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, err.Error())
+				return
+			}
+			if rule.ID == "" {
+				(*newRules)[i].ID = generateRandomString(15)
+			}
+		}
+		err = db.setBanRules(r.Context(), *newRules)
+		if err != nil {
+			Printing.PrintErrStr("Could not save ban rules: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditBanRulesSet, "", engine.Rules(), *newRules)
+		engine.SetRules(*newRules)
+		Printing.Println("Updated ban rules")
+		requestRespond(w, newRules)
+	}
+}
+
+func bansGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get bans: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		bans, err := db.getBans(r.Context())
+		if err != nil {
+			Printing.PrintErrStr("Could not get bans: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		requestRespond(w, bans)
+	}
+}
+
+// Manually bans an IP
+func banAdd(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		banRequest, claims, err := formatUserRequest[BanRequest](r, jwt, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not add ban: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		ip := net.ParseIP(banRequest.IP)
+		if ip == nil || banRequest.Duration < 0 {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		if banRequest.Reason == "" {
+			banRequest.Reason = "Manual ban"
+		}
+		err = db.addBan(r.Context(), Ban{IP: ip.String(), Reason: banRequest.Reason}, time.Duration(banRequest.Duration)*time.Minute)
+		if err != nil {
+			Printing.PrintErrStr("Could not add ban: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditBanAdd, ip.String(), nil, banRequest)
+		Printing.Println("Manually banned " + ip.String())
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// Lifts the ban on the IP in the path
+func banRemove(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not remove ban: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		ip := net.ParseIP(r.PathValue("ip"))
+		if ip == nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		err = db.removeBan(r.Context(), ip.String())
+		if err != nil {
+			Printing.PrintErrStr("Could not remove ban: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditBanRemove, ip.String(), nil, nil)
+		Printing.Println("Lifted ban on " + ip.String())
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// Checks if the request's client is banned, answering and recording the request if it is
+func rejectBannedClient(w http.ResponseWriter, r *http.Request, annotations *RequestAnnotations, serviceLinks ServiceLinks, db AdvancedDB) bool {
+	ban, err := db.getBan(r.Context(), requestClientIP(r))
+	if err != nil {
+		Printing.PrintErrStr("Could not check for ban: " + err.Error()) // Fail open, CheckBag shouldn't take every service down with it
+		return false
+	}
+	if ban == nil {
+		return false
+	}
+	blockRequest(w, r, annotations, blockedBan, DenialResponse{}, serviceLinks, db)
+	go func() {
+		// Use background context with timeout to avoid cancellation when request completes
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err := db.recordBanAttempt(ctx, *ban)
+		if err != nil {
+			Printing.PrintErrStr("Could not record banned attempt: " + err.Error())
+		}
+	}()
+	return true
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math/bits"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Analytics reason for requests refused by a block list
+const blockedBlockList = "block_list"
+
+// Each trie node tracks list membership in a bitmask
+const maximumBlockLists = 64
+
+type BlockListAction string
+
+const (
+	BlockListActionBlock BlockListAction = "block"
+	BlockListActionTag   BlockListAction = "tag" // Only record that the request matched
+)
+
+// Which block lists apply to a service, by list name
+type BlockListSettings struct {
+	Lists  map[string]BlockListAction `json:"lists"`
+	Denial DenialResponse             `json:"denial"`
+}
+
+type BlockList struct {
+	Name    string    `json:"name"` // File name without its extension
+	Entries int       `json:"entries"`
+	Loaded  time.Time `json:"loaded"`
+}
+
+// Reloads IP and CIDR lists from BLOCK_LIST_DIRECTORY every BLOCK_LIST_RELOAD minutes
+type BlockListEngine struct {
+	mutex   sync.RWMutex
+	lists   []BlockList
+	trie    prefixTrie
+	entries map[string][]netip.Prefix // Last loaded entries by list name, kept for lists that fail to reload
+}
+
+// A binary trie over address bits, one root per address family. Nodes live in one slice to keep them compact.
+type prefixTrie struct {
+	nodes []prefixTrieNode
+	roots [2]int32 // IPv4, IPv6
+}
+
+type prefixTrieNode struct {
+	children [2]int32 // 0 means no child, the first node is never a child
+	lists    uint64   // Lists containing the prefix ending at this node
+}
+
+func (engine *BlockListEngine) Setup() {
+	directory := os.Getenv("BLOCK_LIST_DIRECTORY")
+	if directory == "" {
+		return
+	}
+	reloadInterval := time.Hour
+	if rawInterval := os.Getenv("BLOCK_LIST_RELOAD"); rawInterval != "" {
+		interval, err := time.ParseDuration(rawInterval + "m")
+		if err != nil || interval <= 0 {
+			Printing.PrintErrStr("Invalid BLOCK_LIST_RELOAD \"" + rawInterval + "\", using " + reloadInterval.String())
+		} else {
+			reloadInterval = interval
+		}
+	}
+	engine.Reload(directory)
+	go func() {
+		for range time.Tick(reloadInterval) {
+			engine.Reload(directory)
+		}
+	}()
+}
+
+// Rebuilds the trie from every file in the directory, keeping the previous one if the directory can't be read, and
+// the previous entries of any list that can't be
+func (engine *BlockListEngine) Reload(directory string) {
+	files, err := os.ReadDir(directory)
+	if err != nil {
+		Printing.PrintErrStr("Could not read block list directory: " + err.Error())
+		return
+	}
+	trie := newPrefixTrie()
+	var lists []BlockList
+	loadedEntries := map[string][]netip.Prefix{}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		if len(lists) == maximumBlockLists {
+			Printing.PrintErrStr("Only " + strconv.Itoa(maximumBlockLists) + " block lists are supported, skipping " + file.Name())
+			continue
+		}
+		list := BlockList{Name: strings.TrimSuffix(file.Name(), filepath.Ext(file.Name())), Loaded: time.Now()}
+		entries, err := readBlockListFile(filepath.Join(directory, file.Name()))
+		if err != nil {
+			previousIndex := slices.IndexFunc(engine.lists, func(previousList BlockList) bool { return previousList.Name == list.Name })
+			if previousIndex == -1 {
+				Printing.PrintErrStr("Could not read block list " + file.Name() + ": " + err.Error())
+				continue
+			}
+			Printing.PrintErrStr("Could not read block list " + file.Name() + ", keeping the previous entries: " + err.Error())
+			entries = engine.entries[list.Name]
+			list.Loaded = engine.lists[previousIndex].Loaded
+		}
+		for _, prefix := range entries {
+			trie.insert(prefix, len(lists))
+		}
+		list.Entries = len(entries)
+		lists = append(lists, list)
+		loadedEntries[list.Name] = entries
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.lists = lists
+	engine.trie = trie
+	engine.entries = loadedEntries
+	Printing.Println("Loaded " + strconv.Itoa(len(lists)) + " block lists")
+}
+
+// Reads one IP or CIDR per line. Anything after the address is ignored, so FireHOL netsets, Spamhaus DROP
+// ("1.2.3.0/24 ; SBL123"), and plain Tor exit lists all work.
+func readBlockListFile(path string) ([]netip.Prefix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []netip.Prefix
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.FieldsFunc(scanner.Text(), func(character rune) bool {
+			return character == ' ' || character == '\t' || character == ';' || character == ','
+		})
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		prefix, err := parseAccessListEntry(fields[0])
+		if err != nil {
+			continue // Ex. headers, or "ExitAddress" lines in the Tor exit list format
+		}
+		entries = append(entries, prefix)
+	}
+	return entries, scanner.Err()
+}
+
+// Names of every list containing the IP
+func (engine *BlockListEngine) Match(ip string) []string {
+	address, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	if len(engine.lists) == 0 {
+		return nil
+	}
+	membership := engine.trie.lookup(address.Unmap())
+	var names []string
+	for membership != 0 {
+		i := bits.TrailingZeros64(membership)
+		names = append(names, engine.lists[i].Name)
+		membership &^= 1 << i
+	}
+	return names
+}
+
+func (engine *BlockListEngine) Lists() []BlockList {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	return slices.Clone(engine.lists)
+}
+
+func newPrefixTrie() prefixTrie {
+	// The unused first node lets 0 mean "no child"
+	return prefixTrie{nodes: make([]prefixTrieNode, 3), roots: [2]int32{1, 2}}
+}
+
+func (trie *prefixTrie) insert(prefix netip.Prefix, list int) {
+	address := prefix.Addr().AsSlice()
+	node := trie.roots[familyIndex(prefix.Addr())]
+	for bit := 0; bit < prefix.Bits(); bit++ {
+		direction := address[bit/8] >> (7 - bit%8) & 1
+		if trie.nodes[node].children[direction] == 0 {
+			trie.nodes = append(trie.nodes, prefixTrieNode{})
+			trie.nodes[node].children[direction] = int32(len(trie.nodes) - 1)
+		}
+		node = trie.nodes[node].children[direction]
+	}
+	trie.nodes[node].lists |= 1 << list
+}
+
+// Lists containing any prefix of the address
+func (trie *prefixTrie) lookup(address netip.Addr) uint64 {
+	if len(trie.nodes) == 0 {
+		return 0
+	}
+	bytes := address.AsSlice()
+	node := trie.roots[familyIndex(address)]
+	membership := trie.nodes[node].lists
+	for bit := 0; bit < len(bytes)*8; bit++ {
+		node = trie.nodes[node].children[bytes[bit/8]>>(7-bit%8)&1]
+		if node == 0 {
+			break
+		}
+		membership |= trie.nodes[node].lists
+	}
+	return membership
+}
+
+func familyIndex(address netip.Addr) int {
+	if address.Is4() {
+		return 0
+	}
+	return 1
+}
+
+func (settings BlockListSettings) validate() error {
+	for name, action := range settings.Lists {
+		if action != BlockListActionBlock && action != BlockListActionTag {
+			return errors.New("unknown action \"" + string(action) + "\" for block list \"" + name + "\"")
+		}
+	}
+	return settings.Denial.validate()
+}
+
+// Checks if any of the matched lists block requests to the service
+func (settings BlockListSettings) Blocks(matchedLists []string) bool {
+	return slices.ContainsFunc(matchedLists, func(name string) bool {
+		return settings.Lists[name] == BlockListActionBlock
+	})
+}
+
+func blockListsGet(engine *BlockListEngine, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get block lists: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		requestRespond(w, engine.Lists())
+	}
+}
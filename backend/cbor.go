@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// The subset of CBOR (RFC 8949) WebAuthn uses. Authenticators send definite lengths only, so indefinite lengths are refused.
+// Integers decode to int64, byte strings to []byte, text to string, arrays to []any, and maps to map[any]any.
+
+const maximumCBORDepth = 16
+
+var errCBORTruncated = errors.New("CBOR data is truncated")
+
+// Decodes one item, returning it and the bytes after it
+func decodeCBOR(data []byte) (any, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORItem(data []byte, depth int) (any, []byte, error) {
+	if depth > maximumCBORDepth {
+		return nil, nil, errors.New("CBOR data is nested too deeply")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+	majorType := data[0] >> 5
+	additional := data[0] & 0x1f
+	if majorType == 7 {
+		return decodeCBORSimple(data)
+	}
+	argument, data, err := decodeCBORArgument(additional, data[1:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch majorType {
+	case 0: // Unsigned integer
+		if argument > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer is too large")
+		}
+		return int64(argument), data, nil
+	case 1: // Negative integer
+		if argument > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer is too large")
+		}
+		return -1 - int64(argument), data, nil
+	case 2, 3: // Byte and text strings
+		if argument > uint64(len(data)) {
+			return nil, nil, errCBORTruncated
+		}
+		value := data[:argument]
+		if majorType == 3 {
+			return string(value), data[argument:], nil
+		}
+		return append([]byte(nil), value...), data[argument:], nil
+	case 4: // Array
+		if argument > uint64(len(data)) { // Every item takes at least a byte
+			return nil, nil, errCBORTruncated
+		}
+		array := make([]any, 0, argument)
+		for range argument {
+			var item any
+			item, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, item)
+		}
+		return array, data, nil
+	case 5: // Map
+		if argument > uint64(len(data))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		cborMap := make(map[any]any, argument)
+		for range argument {
+			var key, value any
+			key, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("CBOR map keys must be integers or text")
+			}
+			value, data, err = decodeCBORItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			cborMap[key] = value
+		}
+		return cborMap, data, nil
+	default: // Tags, the tagged item is all WebAuthn cares about
+		return decodeCBORItem(data, depth+1)
+	}
+}
+
+// The length or value that follows an item's first byte
+func decodeCBORArgument(additional byte, data []byte) (uint64, []byte, error) {
+	switch {
+	case additional < 24:
+		return uint64(additional), data, nil
+	case additional <= 27:
+		size := 1 << (additional - 24)
+		if len(data) < size {
+			return 0, nil, errCBORTruncated
+		}
+		var argument uint64
+		for _, argumentByte := range data[:size] {
+			argument = argument<<8 | uint64(argumentByte)
+		}
+		return argument, data[size:], nil
+	default:
+		return 0, nil, errors.New("CBOR indefinite lengths aren't supported")
+	}
+}
+
+func decodeCBORSimple(data []byte) (any, []byte, error) {
+	switch additional := data[0] & 0x1f; additional {
+	case 20:
+		return false, data[1:], nil
+	case 21:
+		return true, data[1:], nil
+	case 22, 23: // Null and undefined
+		return nil, data[1:], nil
+	case 26:
+		if len(data) < 5 {
+			return nil, nil, errCBORTruncated
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data[1:5]))), data[5:], nil
+	case 27:
+		if len(data) < 9 {
+			return nil, nil, errCBORTruncated
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data[1:9])), data[9:], nil
+	default:
+		return nil, nil, errors.New("unsupported CBOR simple value")
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"html/template"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Analytics reason for requests answered with the browser challenge instead of being forwarded
+const blockedChallenge = "challenge"
+
+// Where the challenge page sends its solution
+const challengePath = pageTrackingPrefix + "challenge"
+
+const challengeCookieName = "checkbag-challenge"
+
+// How long a browser has to solve a challenge after it's issued
+const challengeLifetime = 10 * time.Minute
+
+const (
+	defaultChallengeDifficulty = 16
+	maximumChallengeDifficulty = 32
+	defaultChallengeDuration   = 7 * 24 // Hours
+)
+
+// Requires browsers to solve a proof-of-work puzzle before their first proxied request
+type ChallengeSettings struct {
+	Enabled     bool     `json:"enabled"`
+	Difficulty  int      `json:"difficulty"`   // Leading zero bits of the solution's hash, each bit doubles the work
+	Duration    int      `json:"duration"`     // Hours a solved challenge lasts
+	ExemptPaths []string `json:"exempt_paths"` // Path prefixes that never need the challenge, ex. "/api/"
+}
+
+type ChallengeSolution struct {
+	Challenge string `json:"challenge"`
+	Nonce     string `json:"nonce"`
+}
+
+var challengePage = template.Must(template.New("challenge").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Checking your browser</title>
+<style>body{font-family:system-ui,sans-serif;display:grid;place-items:center;min-height:90vh;text-align:center;color:#333}</style>
+</head>
+<body>
+<main>
+<h1>Checking your browser</h1>
+<p id="status">This only takes a moment.</p>
+<noscript><p>JavaScript is needed to continue.</p></noscript>
+</main>
+<script>
+(async () => {
+	const challenge = {{.Challenge}};
+	const difficulty = {{.Difficulty}};
+	const status = document.getElementById("status");
+	if (!window.crypto || !crypto.subtle) {
+		status.textContent = "Your browser can't complete the check over an insecure connection.";
+		return;
+	}
+	const encoder = new TextEncoder();
+	const leadingZeroBits = (hash) => {
+		let count = 0;
+		for (const byte of hash) {
+			if (byte === 0) {
+				count += 8;
+				continue;
+			}
+			return count + Math.clz32(byte) - 24;
+		}
+		return count;
+	};
+	for (let nonce = 0; ; nonce++) {
+		const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", encoder.encode(challenge + nonce)));
+		if (leadingZeroBits(hash) < difficulty) continue;
+		const response = await fetch({{.Path}}, {
+			method: "POST",
+			headers: { "Content-Type": "application/json" },
+			body: JSON.stringify({ challenge, nonce: String(nonce) }),
+		});
+		if (response.ok) {
+			location.reload();
+		} else {
+			status.textContent = "The check failed, reload the page to try again.";
+		}
+		return;
+	}
+})();
+</script>
+</body>
+</html>
+`))
+
+func (settings ChallengeSettings) validate() error {
+	if settings.Difficulty < 0 || settings.Difficulty > maximumChallengeDifficulty {
+		return errors.New("challenge difficulty must be between 0 and " + strconv.Itoa(maximumChallengeDifficulty))
+	}
+	if settings.Duration < 0 {
+		return errors.New("challenge duration can't be negative")
+	}
+	return nil
+}
+
+func (settings ChallengeSettings) difficulty() int {
+	if settings.Difficulty == 0 {
+		return defaultChallengeDifficulty
+	}
+	return settings.Difficulty
+}
+
+func (settings ChallengeSettings) duration() time.Duration {
+	if settings.Duration == 0 {
+		return defaultChallengeDuration * time.Hour
+	}
+	return time.Duration(settings.Duration) * time.Hour
+}
+
+// Handles the challenge for the request, returning true if the request was answered and shouldn't be forwarded
+func browserChallenge(w http.ResponseWriter, r *http.Request, annotations *RequestAnnotations, service *ServiceLink, path string, jwt JWTService, serviceLinks ServiceLinks, db AdvancedDB) bool {
+	if !service.Challenge.Enabled {
+		return false
+	}
+	if path == challengePath {
+		verifyChallenge(w, r, annotations, service, jwt, serviceLinks, db)
+		return true
+	}
+	if challengeExempt(r, service, path, db) {
+		return false
+	}
+	if cookie, err := r.Cookie(challengeCookieName); err == nil && jwt.ValidateChallengeJWT(cookie.Value, service.ID, requestClientIP(r)) {
+		return false
+	}
+
+	if r.Method != http.MethodGet || !isDocumentRequest(r) { // Only pages can run the challenge
+		blockRequest(w, r, annotations, blockedChallenge, DenialResponse{}, serviceLinks, db)
+		return true
+	}
+	annotations.Blocked = blockedChallenge
+	annotations.Challenge = "issued"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	var page strings.Builder
+	err := challengePage.Execute(&page, map[string]any{
+		"Challenge":  newChallenge(service.ID, jwt),
+		"Difficulty": service.Challenge.difficulty(),
+		"Path":       challengePath,
+	})
+	if err != nil {
+		Printing.PrintErrStr("Could not render browser challenge: " + err.Error())
+		requestRespondCode(w, http.StatusInternalServerError)
+		return true
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(page.String()))
+	go analytics(r, http.StatusOK, serviceLinks, db, unforwardedRequestBytes(r), unforwardedResponseBytes(r, w, http.StatusOK, page.Len()))
+	return true
+}
+
+// Checks a solution sent by the challenge page, setting the challenge cookie if it's correct
+func verifyChallenge(w http.ResponseWriter, r *http.Request, annotations *RequestAnnotations, service *ServiceLink, jwt JWTService, serviceLinks ServiceLinks, db AdvancedDB) {
+	statusCode := http.StatusForbidden
+	annotations.Challenge = "failed"
+	defer func() {
+		go analytics(r, statusCode, serviceLinks, db, unforwardedRequestBytes(r), unforwardedResponseBytes(r, w, statusCode, 4))
+	}()
+	if r.Method != http.MethodPost {
+		statusCode = http.StatusMethodNotAllowed
+		requestRespondCode(w, statusCode)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 4096)
+	solution, err := requestReceived[ChallengeSolution](r)
+	if err != nil || !validChallenge(solution.Challenge, service.ID, jwt) || !solvesChallenge(*solution, service.Challenge.difficulty()) {
+		requestRespondCode(w, statusCode)
+		return
+	}
+	fresh, err := db.spendBrowserChallenge(r.Context(), solution.Challenge, challengeLifetime)
+	if err != nil {
+		Printing.PrintErrStr("Could not check if challenge was already used: " + err.Error())
+		statusCode = http.StatusInternalServerError
+		requestRespondCode(w, statusCode)
+		return
+	}
+	if !fresh { // Each solution is only good for one cookie
+		requestRespondCode(w, statusCode)
+		return
+	}
+	token, err := jwt.GenerateChallengeJWT(service.ID, requestClientIP(r), service.Challenge.duration())
+	if err != nil {
+		Printing.PrintErrStr("Could not create challenge token: " + err.Error())
+		statusCode = http.StatusInternalServerError
+		requestRespondCode(w, statusCode)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     challengeCookieName,
+		Value:    token,
+		HttpOnly: true,
+		Secure:   requestSecure(r),
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(service.Challenge.duration()),
+		Path:     "/",
+	})
+	annotations.Challenge = "passed"
+	statusCode = http.StatusOK
+	requestRespondCode(w, statusCode)
+}
+
+// Exempt paths, verified search engines, and API keys for the service never see the challenge. User agents are never
+// trusted on their own, since any client can claim to be anything. Monitors and other non-browsers need an exempt path
+// or an API key.
+func challengeExempt(r *http.Request, service *ServiceLink, path string, db AdvancedDB) bool {
+	for _, exemptPath := range service.Challenge.ExemptPaths {
+		if strings.HasPrefix(path, exemptPath) {
+			return true
+		}
+	}
+	if bot := parseUserAgent(r.UserAgent()).Bot; bot != nil && bot.Category == BotCategorySearch && verifySearchEngine(r.Context(), bot, requestClientIP(r)) {
+		return true
+	}
+	rawAPIKey := requestAPIKey(r)
+	if rawAPIKey == "" {
+		return false
+	}
+	apiKey, err := db.getAPIKey(r.Context(), rawAPIKey)
+	return err == nil && apiKey != nil && apiKey.Services.Includes(service.ID)
+}
+
+// A signed, timestamped challenge for the service. Signing means no state has to be kept until it's solved.
+func newChallenge(serviceID string, jwt JWTService) string {
+	challenge := strconv.FormatInt(time.Now().Unix(), 10) + "." + generateRandomString(16)
+	return challenge + "." + jwt.sign(serviceID+"|"+challenge)
+}
+
+func validChallenge(challenge string, serviceID string, jwt JWTService) bool {
+	issuedRaw, random, found := strings.Cut(challenge, ".")
+	random, signature, signatureFound := strings.Cut(random, ".")
+	if !found || !signatureFound || !jwt.verifySignature(serviceID+"|"+issuedRaw+"."+random, signature) {
+		return false
+	}
+	issued, err := strconv.ParseInt(issuedRaw, 10, 64)
+	return err == nil && time.Since(time.Unix(issued, 0)) < challengeLifetime
+}
+
+func solvesChallenge(solution ChallengeSolution, difficulty int) bool {
+	if len(solution.Nonce) == 0 || len(solution.Nonce) > 20 {
+		return false
+	}
+	hash := sha256.Sum256([]byte(solution.Challenge + solution.Nonce))
+	zeroBits := 0
+	for _, hashByte := range hash {
+		zeroBits += bits.LeadingZeros8(hashByte)
+		if hashByte != 0 {
+			break
+		}
+	}
+	return zeroBits >= difficulty
+}
@@ -6,17 +6,19 @@ import (
 	"reflect"
 )
 
-func formatUserRequest[ReturnType any](r *http.Request, jwt JWTService) (*ReturnType, error) {
-	err := jwt.ReadAndValidateJWT(r)
+// Reads the request body for a user that can see every service, since the settings it changes are shared. The claims
+// say who made the change.
+func formatUserRequest[ReturnType any](r *http.Request, jwt JWTService, role UserRole) (*ReturnType, *Claims, error) {
+	claims, err := jwt.ReadAndValidateUnscopedJWT(r, role)
 	if err != nil {
-		return nil, errors.New("Could not parse JWT: " + err.Error())
+		return nil, nil, errors.New("Could not parse JWT: " + err.Error())
 	}
 	// Check if ReturnType is any/interface{}
 	var zero ReturnType
 	if reflect.TypeOf((*ReturnType)(nil)).Elem() == reflect.TypeOf((*any)(nil)).Elem() {
-		return &zero, nil
+		return &zero, claims, nil
 	}
 
 	requestGroup, err := requestReceived[ReturnType](r)
-	return requestGroup, err
+	return requestGroup, claims, err
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+const (
+	csrfCookieName = "checkbag-csrf-token" // Readable by the frontend, which sends it back in csrfHeaderName
+	csrfHeaderName = "X-CSRF-Token"
+)
+
+type CookieSecurity string
+
+const (
+	CookieSecurityAuto   CookieSecurity = "auto" // Secure when the request came over HTTPS, directly or through a trusted proxy
+	CookieSecurityAlways CookieSecurity = "true"
+	CookieSecurityNever  CookieSecurity = "false"
+)
+
+// Attributes for CheckBag's own cookies, set by COOKIE_SECURE, COOKIE_SAMESITE, and COOKIE_DOMAIN
+var cookieSecurity = CookieSecurityAuto
+var cookieSameSite = http.SameSiteStrictMode
+var cookieDomain = ""
+
+// Proxies whose forwarding headers are believed, set by TRUSTED_PROXIES. Defaults to loopback only, since anyone else on
+// a private network could otherwise claim any IP or country.
+var trustedProxies = []string{"127.0.0.0/8", "::1"}
+
+// Reads the cookie and trusted proxy settings, keeping the defaults for missing or invalid values
+func loadCookieSettings() {
+	if rawSecurity := os.Getenv("COOKIE_SECURE"); rawSecurity != "" {
+		switch security := CookieSecurity(strings.ToLower(rawSecurity)); security {
+		case CookieSecurityAuto, CookieSecurityAlways, CookieSecurityNever:
+			cookieSecurity = security
+		default:
+			Printing.PrintErrStr("Invalid COOKIE_SECURE \"" + rawSecurity + "\", using " + string(cookieSecurity))
+		}
+	}
+	if rawSameSite := os.Getenv("COOKIE_SAMESITE"); rawSameSite != "" {
+		switch strings.ToLower(rawSameSite) {
+		case "strict":
+			cookieSameSite = http.SameSiteStrictMode
+		case "lax":
+			cookieSameSite = http.SameSiteLaxMode
+		default:
+			Printing.PrintErrStr("Invalid COOKIE_SAMESITE \"" + rawSameSite + "\", using strict")
+		}
+	}
+	cookieDomain = os.Getenv("COOKIE_DOMAIN")
+
+	rawProxies := os.Getenv("TRUSTED_PROXIES")
+	if rawProxies == "" {
+		return
+	}
+	if rawProxies == "*" {
+		trustedProxies = []string{"0.0.0.0/0", "::/0"}
+		return
+	}
+	proxies := splitList(rawProxies)
+	for _, proxy := range proxies {
+		if _, err := parseAccessListEntry(proxy); err != nil {
+			Printing.PrintErrStr("Invalid TRUSTED_PROXIES entry \"" + proxy + "\", only trusting loopback")
+			return
+		}
+	}
+	trustedProxies = proxies
+}
+
+// Checks if the request came straight from a proxy allowed to set forwarding headers
+func requestFromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	address, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	return accessListContains(trustedProxies, address.Unmap())
+}
+
+// Checks if the browser used HTTPS, which a trusted proxy reports with X-Forwarded-Proto or Forwarded
+func requestSecure(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	if !requestFromTrustedProxy(r) {
+		return false
+	}
+	if forwardedProto := r.Header.Get("X-Forwarded-Proto"); forwardedProto != "" {
+		proto, _, _ := strings.Cut(forwardedProto, ",") // The first proxy saw the browser's scheme
+		return strings.EqualFold(strings.TrimSpace(proto), "https")
+	}
+	forwarded, _, _ := strings.Cut(r.Header.Get("Forwarded"), ",")
+	for pair := range strings.SplitSeq(forwarded, ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		if strings.EqualFold(name, "proto") {
+			return strings.EqualFold(strings.Trim(value, `"`), "https")
+		}
+	}
+	return false
+}
+
+// The host the browser asked for, which a trusted proxy may have passed along in X-Forwarded-Host
+func requestHost(r *http.Request) string {
+	if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" && requestFromTrustedProxy(r) {
+		host, _, _ := strings.Cut(forwardedHost, ",")
+		return strings.TrimSpace(host)
+	}
+	return r.Host
+}
+
+// One of CheckBag's own cookies, with the configured attributes. Cookies that need to be sent on the redirect back
+// from another site, like the OIDC state, set their own.
+func newCookie(r *http.Request, name string, value string, expires time.Time, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		HttpOnly: httpOnly,
+		Secure:   cookieSecure(r),
+		SameSite: cookieSameSite,
+		Domain:   cookieDomain,
+		Expires:  expires,
+		Path:     "/",
+	}
+}
+
+func cookieSecure(r *http.Request) bool {
+	switch cookieSecurity {
+	case CookieSecurityAlways:
+		return true
+	case CookieSecurityNever:
+		return false
+	}
+	return requestSecure(r)
+}
+
+// Removes a cookie made by newCookie
+func expiredCookie(name string) *http.Cookie {
+	return &http.Cookie{Name: name, Value: "", Domain: cookieDomain, Path: "/", MaxAge: -1}
+}
+
+// Checks if a request that changes something came from another site. Browsers send Sec-Fetch-Site, and older ones
+// at least send Origin, while requests without either didn't come from a browser and can't carry its cookies unasked.
+func crossOriginRequest(r *http.Request) error {
+	if safeMethod(r.Method) {
+		return nil
+	}
+	switch r.Header.Get("Sec-Fetch-Site") {
+	case "":
+	case "same-origin", "none": // "none" is the user's own navigation, ex. a bookmark
+		return nil
+	default:
+		return errors.New("request came from another site")
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	originURL, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(originURL.Host, requestHost(r)) {
+		return errors.New("request came from origin \"" + origin + "\"")
+	}
+	return nil
+}
+
+// Checks if requests with the method only read, so they don't need CSRF protection
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// Refuses dashboard requests from other sites. Proxied services and API key requests are left alone, since they're
+// meant to be reached from anywhere.
+func crossOriginProtection(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/service/") && r.URL.Path != "/api/events" {
+			if err := crossOriginRequest(r); err != nil {
+				Printing.PrintErrStr("Refused " + r.Method + " " + r.URL.Path + " from " + requestClientIP(r) + ": " + err.Error())
+				requestRespondCode(w, http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
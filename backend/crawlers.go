@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Analytics reasons for requests refused by a service's crawler policy
+const (
+	blockedAICrawler        = "ai_crawler"
+	blockedFakeSearchEngine = "fake_search_engine"
+)
+
+// How long a tarpitted crawler waits before being refused
+const crawlerTarpitDelay = 30 * time.Second
+
+// Each tarpitted request holds a connection, so past this many at once crawlers are refused right away instead
+const maximumCrawlerTarpits = 100
+
+var crawlerTarpits = make(chan struct{}, maximumCrawlerTarpits)
+
+type CrawlerAction string
+
+const (
+	CrawlerActionAllow  CrawlerAction = ""
+	CrawlerActionBlock  CrawlerAction = "block"
+	CrawlerActionTarpit CrawlerAction = "tarpit" // Hold the request before refusing it, slowing the crawler down
+)
+
+type CrawlerPolicy struct {
+	RobotsTxt           bool           `json:"robots_txt"`            // Serve a generated robots.txt when the service doesn't have one
+	AICrawlers          CrawlerAction  `json:"ai_crawlers"`           // What to do with known AI crawlers
+	VerifySearchEngines bool           `json:"verify_search_engines"` // Refuse search engine user agents that don't come from the search engine
+	Denial              DenialResponse `json:"denial"`
+}
+
+// Reverse DNS domains of each search engine's crawlers, bots without an entry can't be verified this way
+var searchEngineDomains = map[string][]string{
+	"Googlebot":             {".googlebot.com", ".google.com", ".googleusercontent.com"},
+	"Google-InspectionTool": {".googlebot.com", ".google.com", ".googleusercontent.com"},
+	"Bingbot":               {".search.msn.com"},
+	"YandexBot":             {".yandex.ru", ".yandex.net", ".yandex.com"},
+	"Baiduspider":           {".baidu.com", ".baidu.jp"},
+	"Applebot":              {".applebot.apple.com"},
+	"SeznamBot":             {".seznam.cz"},
+	"Slurp":                 {".crawl.yahoo.net"},
+}
+
+type searchEngineVerification struct {
+	verified bool
+	expires  time.Time
+}
+
+// Verification results by bot name and IP, reverse DNS is too slow to look up on every request
+var (
+	searchEngineVerificationsMutex sync.Mutex
+	searchEngineVerifications      = map[string]searchEngineVerification{}
+)
+
+const (
+	searchEngineVerificationLifetime = 24 * time.Hour
+	searchEngineTimeoutLifetime      = 5 * time.Minute // Timeouts are retried sooner, in case DNS was only slow
+	maximumSearchEngineVerifications = 10000
+)
+
+func (policy CrawlerPolicy) validate() error {
+	switch policy.AICrawlers {
+	case CrawlerActionAllow, CrawlerActionBlock, CrawlerActionTarpit:
+	default:
+		return errors.New("unknown AI crawler action \"" + string(policy.AICrawlers) + "\"")
+	}
+	return policy.Denial.validate()
+}
+
+// Applies the service's crawler policy, returning true if the request was refused and answered
+func enforceCrawlerPolicy(w http.ResponseWriter, r *http.Request, annotations *RequestAnnotations, service *ServiceLink, path string, serviceLinks ServiceLinks, db AdvancedDB) bool {
+	bot := parseUserAgent(r.UserAgent()).Bot
+	if bot == nil || path == "/robots.txt" { // Crawlers should always be able to read the rules
+		return false
+	}
+	policy := service.CrawlerPolicy
+	switch {
+	case bot.Category == BotCategoryAI && policy.AICrawlers != CrawlerActionAllow:
+		if policy.AICrawlers == CrawlerActionTarpit {
+			tarpit(r)
+		}
+		annotations.BlockedCrawler = bot.Name
+		annotations.CrawlerBytesSaved = responseSizes.estimate(service.ID, path)
+		blockRequest(w, r, annotations, blockedAICrawler, policy.Denial, serviceLinks, db)
+		return true
+	case bot.Category == BotCategorySearch && policy.VerifySearchEngines && !verifySearchEngine(r.Context(), bot, requestClientIP(r)):
+		annotations.BlockedCrawler = bot.Name
+		annotations.CrawlerBytesSaved = responseSizes.estimate(service.ID, path)
+		blockRequest(w, r, annotations, blockedFakeSearchEngine, policy.Denial, serviceLinks, db)
+		return true
+	}
+	return false
+}
+
+// Holds the request for crawlerTarpitDelay, unless too many requests are already being held
+func tarpit(r *http.Request) {
+	select {
+	case crawlerTarpits <- struct{}{}:
+		defer func() { <-crawlerTarpits }()
+	default:
+		return
+	}
+	select {
+	case <-time.After(crawlerTarpitDelay):
+	case <-r.Context().Done():
+	}
+}
+
+// Checks that a search engine's user agent comes from the search engine with forward-confirmed reverse DNS.
+// Bots that can't be verified this way never are, since anyone can claim to be them.
+func verifySearchEngine(ctx context.Context, bot *KnownBot, ip string) bool {
+	domains, ok := searchEngineDomains[bot.Name]
+	if !ok {
+		return false
+	}
+	cacheKey := bot.Name + "|" + ip
+	searchEngineVerificationsMutex.Lock()
+	cached, ok := searchEngineVerifications[cacheKey]
+	searchEngineVerificationsMutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.verified
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	verified := false
+	names, _ := net.DefaultResolver.LookupAddr(ctx, ip)
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(name), ".")
+		if !slices.ContainsFunc(domains, func(domain string) bool { return strings.HasSuffix(name, domain) }) {
+			continue
+		}
+		addresses, _ := net.DefaultResolver.LookupHost(ctx, name)
+		if slices.ContainsFunc(addresses, func(address string) bool { return canonicalIP(address) == ip }) {
+			verified = true
+			break
+		}
+	}
+	lifetime := searchEngineVerificationLifetime
+	if ctx.Err() != nil && !verified { // Whoever runs the IP's reverse DNS can make it hang, so a timeout isn't a pass
+		Printing.PrintErrStr("Timed out verifying " + bot.Name + " at " + ip)
+		lifetime = searchEngineTimeoutLifetime
+	}
+
+	searchEngineVerificationsMutex.Lock()
+	defer searchEngineVerificationsMutex.Unlock()
+	if len(searchEngineVerifications) >= maximumSearchEngineVerifications {
+		clear(searchEngineVerifications)
+	}
+	searchEngineVerifications[cacheKey] = searchEngineVerification{verified: verified, expires: time.Now().Add(lifetime)}
+	return verified
+}
+
+// Disallows every known AI crawler when the service refuses them, and allows everyone else
+func generateRobotsTxt(policy CrawlerPolicy) string {
+	var robots strings.Builder
+	robots.WriteString("# Generated by CheckBag\n")
+	if policy.AICrawlers != CrawlerActionAllow {
+		for _, bot := range knownBots {
+			if bot.Category == BotCategoryAI {
+				robots.WriteString("User-agent: " + bot.Name + "\n")
+			}
+		}
+		robots.WriteString("Disallow: /\n\n")
+	}
+	robots.WriteString("User-agent: *\nAllow: /\n")
+	return robots.String()
+}
+
+// Recent response sizes per service, for estimating the bytes saved by refusing crawlers
+type responseSizeTracker struct {
+	mutex    sync.Mutex
+	services map[string]*serviceResponseSizes
+}
+
+type serviceResponseSizes struct {
+	totalBytes int
+	responses  int
+	resources  map[string]int // Latest size of each resource
+}
+
+const maximumTrackedResourceSizes = 1000
+
+var responseSizes = responseSizeTracker{services: map[string]*serviceResponseSizes{}}
+
+func (tracker *responseSizeTracker) record(serviceID string, path string, size int) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	sizes, ok := tracker.services[serviceID]
+	if !ok {
+		sizes = &serviceResponseSizes{resources: map[string]int{}}
+		tracker.services[serviceID] = sizes
+	}
+	sizes.totalBytes += size
+	sizes.responses++
+	if _, ok := sizes.resources[path]; ok || len(sizes.resources) < maximumTrackedResourceSizes {
+		sizes.resources[path] = size
+	}
+}
+
+// The resource's latest size, or the service's average response size if it hasn't been seen
+func (tracker *responseSizeTracker) estimate(serviceID string, path string) int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	sizes, ok := tracker.services[serviceID]
+	if !ok || sizes.responses == 0 {
+		return 0
+	}
+	if size, ok := sizes.resources[path]; ok {
+		return size
+	}
+	return sizes.totalBytes / sizes.responses
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"os"
 	"slices"
 	"strconv"
@@ -18,39 +20,99 @@ type BasicDB interface {
 	// Basic cache functions
 	Set(ctx context.Context, key string, value string, duration time.Duration) error
 	Get(ctx context.Context, key string) (string, error)
+	SetIfMissing(ctx context.Context, key string, value string, duration time.Duration) (bool, error)
+	GetAndDelete(ctx context.Context, key string) (string, error)
 	Delete(ctx context.Context, key string) error
 
 	SetHash(ctx context.Context, key string, values map[string]string) error
 	GetHash(ctx context.Context, key string) (map[string]string, error)
+	HashFieldExists(ctx context.Context, key string, field string) (bool, error)
+	HashLength(ctx context.Context, key string) (int, error)
 	DeleteHash(ctx context.Context, key string) error
 
 	RenameKey(ctx context.Context, oldKey string, newKey string) error
+	SetExpiration(ctx context.Context, key string, duration time.Duration) error
 
 	IncrementHashField(ctx context.Context, key string, field string, amount int, expiration time.Time) error
+	IncrementHashFieldFloat(ctx context.Context, key string, field string, amount float64, expiration time.Time) error
 	IncrementKey(ctx context.Context, key string, amount int, expiration time.Time) error
 
 	AddToList(ctx context.Context, key string, value string) error
 	RemoveFromList(ctx context.Context, key string, value string) error
 	GetList(ctx context.Context, key string) ([]string, error)
 	SetList(ctx context.Context, key string, values []string) error
+
+	AddToSortedSet(ctx context.Context, key string, member string, score float64) error
+	GetSortedSetByScore(ctx context.Context, key string, min string, max string) ([]string, error)
+	RemoveFromSortedSetByScore(ctx context.Context, key string, min string, max string) error
+	RemoveFromSortedSet(ctx context.Context, key string, member string) error
+	RunScript(ctx context.Context, script *valkey.Lua, keys []string, args []string) ([]int64, error)
 }
 
 type AdvancedDB interface {
-	incrementAnalytics(ctx context.Context, serviceID string, resource string, country string, ip string, responseCode int, receivedBytes int, sentBytes int) error
+	incrementAnalytics(ctx context.Context, serviceID string, record AnalyticRecord) error
+	recordVisit(ctx context.Context, serviceID string, visitorID string, resource string, timeout time.Duration) error
+	recordPageBeacon(ctx context.Context, serviceID string, beacon PageBeacon) error
+	recordCustomEvent(ctx context.Context, serviceID string, event CustomEvent) error
 	getAnalyticsService(ctx context.Context, service ServiceData, timeStep AnalyticsTimeStep) map[time.Time]Analytic
 	deleteService(ctx context.Context, service ServiceLink) error
-	addAPIKey(ctx context.Context, APIKey string, keyID string, name string) error
+	addAPIKey(ctx context.Context, APIKey string, keyID string, name string, services ServiceScope) error
 	removeAPIKey(ctx context.Context, APIKeyID string) error
+	setAPIKeyServices(ctx context.Context, APIKeyID string, services ServiceScope) error
 	getAPIKeyInfo(ctx context.Context) ([]APIKeyInfo, error)
-	apiKeyExists(ctx context.Context, APIKey string) bool
+	getAPIKey(ctx context.Context, APIKey string) (*APIKeyInfo, error)
 	getVersion(ctx context.Context) (string, error)
 	setVersion(ctx context.Context, version string) error
-	GetJWTSecret(ctx context.Context) (string, error)
-	SetJWTSecret(ctx context.Context, jwtSecret string) error
-	GetUserPasswordHash(ctx context.Context) (string, error)
-	SetUserPasswordHash(ctx context.Context, hash string) // Panics
+	getJWTKeys(ctx context.Context) ([]JWTKey, error)
+	setJWTKeys(ctx context.Context, keys []JWTKey) error
+	getUser(ctx context.Context, username string) (*User, error)
+	getUsers(ctx context.Context) ([]User, error)
+	setUser(ctx context.Context, user User) error
+	removeUser(ctx context.Context, username string) error
+	getOIDCUsername(ctx context.Context, subject string) (string, error)
+	useTOTPStep(ctx context.Context, username string, step int64) (bool, error)
+	useRecoveryCode(ctx context.Context, username string, hash string) (bool, error)
+	setTOTPEnrollment(ctx context.Context, username string, secret string, lifetime time.Duration) error
+	getTOTPEnrollment(ctx context.Context, username string) (string, error)
+	removeTOTPEnrollment(ctx context.Context, username string) error
+	getPasskey(ctx context.Context, id string) (*Passkey, error)
+	getPasskeys(ctx context.Context, username string) ([]Passkey, error)
+	setPasskey(ctx context.Context, passkey Passkey) error
+	removePasskey(ctx context.Context, passkey Passkey) error
+	setWebAuthnChallenge(ctx context.Context, challenge string, purpose string, lifetime time.Duration) error
+	takeWebAuthnChallenge(ctx context.Context, challenge string) (string, error)
+	spendBrowserChallenge(ctx context.Context, challenge string, lifetime time.Duration) (bool, error)
+	addSignInFailure(ctx context.Context, failure SignInFailure, threshold int, globalThreshold int, window time.Duration, baseLockout time.Duration, maximumLockout time.Duration) (time.Duration, error)
+	getSignInLockout(ctx context.Context, ip string) (time.Duration, error)
+	removeSignInFailures(ctx context.Context, ip string) error
+	getSignInFailures(ctx context.Context) ([]SignInFailure, error)
+	addAuditEvent(ctx context.Context, event AuditEvent, retention time.Duration) error
+	getAuditEvents(ctx context.Context, since time.Time, until time.Time) ([]AuditEvent, error)
+	getSession(ctx context.Context, id string) (*Session, error)
+	getSessions(ctx context.Context, username string) ([]Session, error)
+	setSession(ctx context.Context, session Session, lifetime time.Duration) error
+	touchSession(ctx context.Context, id string, lastSeen time.Time) error
+	removeSession(ctx context.Context, session Session) error
+	removeSessions(ctx context.Context, username string) error
+	setOIDCState(ctx context.Context, state string, pending oidcState, lifetime time.Duration) error
+	takeOIDCState(ctx context.Context, state string) (*oidcState, error)
 	getServiceLinks(ctx context.Context) (ServiceLinks, error)
 	setServiceLinks(ctx context.Context, serviceLinks ServiceLinks) error
+	getScannerRules(ctx context.Context) ([]ScannerRule, error)
+	setScannerRules(ctx context.Context, rules []ScannerRule) error
+	recordSuspiciousActivity(ctx context.Context, ip string, serviceID string, rules []ScannerRule) error
+	getSuspiciousClients(ctx context.Context) ([]SuspiciousClient, error)
+	getBanRules(ctx context.Context) ([]BanRule, error)
+	setBanRules(ctx context.Context, rules []BanRule) error
+	incrementBanCounter(ctx context.Context, ruleID string, ip string, window time.Duration) (int, error)
+	addBan(ctx context.Context, ban Ban, duration time.Duration) error
+	removeBan(ctx context.Context, ip string) error
+	getBan(ctx context.Context, ip string) (*Ban, error)
+	getBans(ctx context.Context) ([]Ban, error)
+	recordBanAttempt(ctx context.Context, ban Ban) error
+	takeRateLimitToken(ctx context.Context, key string, capacity int, refillPerSecond float64) (RateLimitResult, error)
+	getWAFRules(ctx context.Context) (string, error)
+	setWAFRules(ctx context.Context, rules string) error
 }
 
 type ValkeyDB struct {
@@ -63,32 +125,45 @@ type DB struct {
 }
 
 type AnalyticsTimeStep struct {
-	time         func(step int) time.Time
+	at           func(origin time.Time, step int) time.Time // Start of the bucket step units away from the one containing origin
 	maximumUnits int
 }
 
+func (analytics AnalyticsTimeStep) time(step int) time.Time {
+	return analytics.at(time.Now(), step)
+}
+
 func (analytics AnalyticsTimeStep) timeStr(step int) string {
 	return analytics.time(step).Format(time.RFC3339)
 }
 
+// Base key for the analytics bucket containing t
+func (analytics AnalyticsTimeStep) baseKey(serviceID string, t time.Time) string {
+	return "Analytics:" + serviceID + ":" + strconv.Itoa(analytics.maximumUnits) + ":" + analytics.at(t, 0).Format(time.RFC3339) + ":"
+}
+
 var (
-	cacheAnalyticsMinute = AnalyticsTimeStep{maximumUnits: 60, time: func(step int) time.Time {
-		return time.Now().Truncate(time.Minute).Add(time.Duration(step) * time.Minute)
+	cacheAnalyticsMinute = AnalyticsTimeStep{maximumUnits: 60, at: func(origin time.Time, step int) time.Time {
+		return origin.Truncate(time.Minute).Add(time.Duration(step) * time.Minute)
 	}}
-	cacheAnalyticsHour = AnalyticsTimeStep{maximumUnits: 24, time: func(step int) time.Time {
-		return time.Now().Truncate(time.Hour).Add(time.Duration(step) * time.Hour)
+	cacheAnalyticsHour = AnalyticsTimeStep{maximumUnits: 24, at: func(origin time.Time, step int) time.Time {
+		return origin.Truncate(time.Hour).Add(time.Duration(step) * time.Hour)
 	}}
-	cacheAnalyticsDay = AnalyticsTimeStep{maximumUnits: 30, time: func(step int) time.Time {
-		now := time.Now()
-		year, month, day := now.Date()
-		return time.Date(year, month, day, 0, 0, 0, 0, now.Location()).AddDate(0, 0, step)
+	cacheAnalyticsDay = AnalyticsTimeStep{maximumUnits: 30, at: func(origin time.Time, step int) time.Time {
+		year, month, day := origin.Date()
+		return time.Date(year, month, day, 0, 0, 0, 0, origin.Location()).AddDate(0, 0, step)
 	}}
-	cacheAnalyticsMonth = AnalyticsTimeStep{maximumUnits: 12, time: func(step int) time.Time {
-		now := time.Now()
-		year, month, _ := now.Date()
-		return time.Date(year, month, 1, 0, 0, 0, 0, now.Location()).AddDate(0, step, 0)
+	cacheAnalyticsMonth = AnalyticsTimeStep{maximumUnits: 12, at: func(origin time.Time, step int) time.Time {
+		year, month, _ := origin.Date()
+		return time.Date(year, month, 1, 0, 0, 0, 0, origin.Location()).AddDate(0, step, 0)
 	}}
 	cacheAnalyticsTime = []AnalyticsTimeStep{cacheAnalyticsMinute, cacheAnalyticsHour, cacheAnalyticsDay, cacheAnalyticsMonth}
+	// Hash-backed analytics fields beyond country, ip, resource, and response code
+	analyticsDimensions = []string{"browser", "os", "device", "bot", "referrer", "entry_resource", "exit_resource", "page_view", "screen", "event", "event_property", "host", "user_agent", "scanner_rule", "blocked", "blocked_country", "challenge", "waf_rule", "block_list", "blocked_crawler", "crawler_bytes_saved"}
+	// Plain counters beyond quantity, sent bytes, and received bytes
+	analyticsCounters = []string{"visits", "visit_pages", "visit_duration", "bounces", "page_views", "page_time", "page_time_samples"}
+	// Caps the number of distinct values a dimension may hold per bucket, extra values are grouped under "Other"
+	analyticsDimensionLimits = map[string]int{"referrer": 100, "screen": 100, "page_view": 500, "event": 200, "event_property": maximumEventPropertyValues, "host": 500, "user_agent": 200}
 )
 
 // Basic cache functions
@@ -130,17 +205,27 @@ func SetupDB() AdvancedDB {
 }
 
 func (db DB) versioning() {
-	expectedDBVersion := "3"
+	expectedDBVersion := "5"
 	ctx := context.Background()
 	actualDBVersion, err := db.basicDB.Get(ctx, "version")
 	if err != nil {
 		Printing.PrintErrStr("Could not get version from DB, setting to "+expectedDBVersion+". Error: ", err.Error())
 		db.setVersion(ctx, expectedDBVersion)
-	} else if actualDBVersion == "2" {
-		Printing.Println("Migrating database from version 2 to 3...")
-		migrateFSToDB(db)
+	} else if actualDBVersion == "2" || actualDBVersion == "3" || actualDBVersion == "4" {
+		if actualDBVersion == "2" {
+			Printing.Println("Migrating database from version 2 to 3...")
+			migrateFSToDB(db)
+			Printing.Println("Database migrated to version 3")
+		}
+		if actualDBVersion == "2" || actualDBVersion == "3" {
+			Printing.Println("Migrating database from version 3 to 4...")
+			migrateToUsers(db)
+			Printing.Println("Database migrated to version 4")
+		}
+		Printing.Println("Migrating database from version 4 to 5...")
+		migrateJWTSecret(db)
 		db.setVersion(ctx, expectedDBVersion)
-		Printing.Println("Database migrated to version 3")
+		Printing.Println("Database migrated to version 5")
 	} else if actualDBVersion != expectedDBVersion {
 		panic("Expected database version " + expectedDBVersion + " but got " + actualDBVersion)
 	}
@@ -154,6 +239,15 @@ func (db *ValkeyDB) GetHash(ctx context.Context, key string) (map[string]string,
 	return db.db.Do(ctx, db.db.B().Hgetall().Key(db.prefix+key).Build()).AsStrMap()
 }
 
+func (db *ValkeyDB) HashFieldExists(ctx context.Context, key string, field string) (bool, error) {
+	return db.db.Do(ctx, db.db.B().Hexists().Key(db.prefix+key).Field(field).Build()).AsBool()
+}
+
+func (db *ValkeyDB) HashLength(ctx context.Context, key string) (int, error) {
+	length, err := db.db.Do(ctx, db.db.B().Hlen().Key(db.prefix+key).Build()).AsInt64()
+	return int(length), err
+}
+
 func (db *ValkeyDB) Delete(ctx context.Context, key string) error {
 	return db.db.Do(ctx, db.db.B().Del().Key(db.prefix+key).Build()).Error()
 }
@@ -170,6 +264,20 @@ func (db *ValkeyDB) Set(ctx context.Context, key string, value string, duration
 	return db.db.Do(ctx, db.db.B().Set().Key(db.prefix+key).Value(value).Ex(duration).Build()).Error()
 }
 
+// Returns false if the key already existed, in which case it's left alone
+func (db *ValkeyDB) SetIfMissing(ctx context.Context, key string, value string, duration time.Duration) (bool, error) {
+	err := db.db.Do(ctx, db.db.B().Set().Key(db.prefix+key).Value(value).Nx().Ex(duration).Build()).Error()
+	if valkey.IsValkeyNil(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Reads and deletes the key in one step, so only one caller can ever get its value
+func (db *ValkeyDB) GetAndDelete(ctx context.Context, key string) (string, error) {
+	return db.db.Do(ctx, db.db.B().Getdel().Key(db.prefix+key).Build()).ToString()
+}
+
 func (db *ValkeyDB) SetHash(ctx context.Context, key string, values map[string]string) error {
 	hash := db.db.B().Hset().Key(db.prefix + key).FieldValue()
 	for field, value := range values {
@@ -182,8 +290,22 @@ func (db *ValkeyDB) RenameKey(ctx context.Context, oldKey string, newKey string)
 	return db.db.Do(ctx, db.db.B().Rename().Key(db.prefix+oldKey).Newkey(db.prefix+newKey).Build()).Error()
 }
 
+func (db *ValkeyDB) SetExpiration(ctx context.Context, key string, duration time.Duration) error {
+	return db.db.Do(ctx, db.db.B().Expire().Key(db.prefix+key).Seconds(int64(duration.Seconds())).Build()).Error()
+}
+
+// If expiration is the zero time, the key keeps its current expiration
 func (db *ValkeyDB) IncrementHashField(ctx context.Context, key string, field string, amount int, expiration time.Time) error {
 	err := db.db.Do(ctx, db.db.B().Hincrby().Key(db.prefix+key).Field(field).Increment(int64(amount)).Build()).Error()
+	if err != nil || expiration.IsZero() {
+		return err
+	}
+	remainingTime := time.Until(expiration)
+	return db.db.Do(ctx, db.db.B().Expire().Key(db.prefix+key).Seconds(int64(remainingTime.Seconds())).Build()).Error()
+}
+
+func (db *ValkeyDB) IncrementHashFieldFloat(ctx context.Context, key string, field string, amount float64, expiration time.Time) error {
+	err := db.db.Do(ctx, db.db.B().Hincrbyfloat().Key(db.prefix+key).Field(field).Increment(amount).Build()).Error()
 	if err != nil {
 		return err
 	}
@@ -234,9 +356,35 @@ func (db *ValkeyDB) GetList(ctx context.Context, key string) ([]string, error) {
 	return db.db.Do(ctx, db.db.B().Lrange().Key(db.prefix+key).Start(0).Stop(-1).Build()).AsStrSlice()
 }
 
+// Scores are inclusive bounds, "-inf" and "+inf" are allowed
+func (db *ValkeyDB) AddToSortedSet(ctx context.Context, key string, member string, score float64) error {
+	return db.db.Do(ctx, db.db.B().Zadd().Key(db.prefix+key).ScoreMember().ScoreMember(score, member).Build()).Error()
+}
+
+func (db *ValkeyDB) GetSortedSetByScore(ctx context.Context, key string, min string, max string) ([]string, error) {
+	return db.db.Do(ctx, db.db.B().Zrangebyscore().Key(db.prefix+key).Min(min).Max(max).Build()).AsStrSlice()
+}
+
+func (db *ValkeyDB) RemoveFromSortedSetByScore(ctx context.Context, key string, min string, max string) error {
+	return db.db.Do(ctx, db.db.B().Zremrangebyscore().Key(db.prefix+key).Min(min).Max(max).Build()).Error()
+}
+
+func (db *ValkeyDB) RemoveFromSortedSet(ctx context.Context, key string, member string) error {
+	return db.db.Do(ctx, db.db.B().Zrem().Key(db.prefix+key).Member(member).Build()).Error()
+}
+
+// Keys are given without the prefix, it's added here
+func (db *ValkeyDB) RunScript(ctx context.Context, script *valkey.Lua, keys []string, args []string) ([]int64, error) {
+	prefixedKeys := make([]string, len(keys))
+	for i, key := range keys {
+		prefixedKeys[i] = db.prefix + key
+	}
+	return script.Exec(ctx, db.db, prefixedKeys, args).AsIntSlice()
+}
+
 // Higher-level DB functions
 
-func (db DB) incrementAnalytics(ctx context.Context, serviceID string, resource string, country string, ip string, responseCode int, receivedBytes int, sentBytes int) error {
+func (db DB) incrementAnalytics(ctx context.Context, serviceID string, record AnalyticRecord) error {
 	for _, timeStep := range cacheAnalyticsTime {
 		recordTime := timeStep.timeStr(0)
 		expiration := timeStep.time(timeStep.maximumUnits)
@@ -247,40 +395,197 @@ func (db DB) incrementAnalytics(ctx context.Context, serviceID string, resource
 			Printing.PrintErrStr("Could not increment quantity analytics key: " + err.Error())
 			return err
 		}
-		err = db.basicDB.IncrementKey(ctx, baseKey+"received_bytes", receivedBytes, expiration)
+		err = db.basicDB.IncrementKey(ctx, baseKey+"received_bytes", record.ReceivedBytes, expiration)
 		if err != nil {
 			Printing.PrintErrStr("Could not increment received bytes analytics:" + err.Error())
 			return err
 		}
-		err = db.basicDB.IncrementKey(ctx, baseKey+"sent_bytes", sentBytes, expiration)
+		err = db.basicDB.IncrementKey(ctx, baseKey+"sent_bytes", record.SentBytes, expiration)
 		if err != nil {
 			Printing.PrintErrStr("Could not increment sent bytes analytics: " + err.Error())
 			return err
 		}
-		err = db.basicDB.IncrementHashField(ctx, baseKey+"country", country, 1, expiration)
+		err = db.basicDB.IncrementHashField(ctx, baseKey+"country", record.Country, 1, expiration)
 		if err != nil {
 			Printing.PrintErrStr("Could not increment analytics country: " + err.Error())
 			return err
 		}
-		err = db.basicDB.IncrementHashField(ctx, baseKey+"ip", ip, 1, expiration)
+		err = db.basicDB.IncrementHashField(ctx, baseKey+"ip", record.IP, 1, expiration)
 		if err != nil {
 			Printing.PrintErrStr("Could not increment analytics ip: " + err.Error())
 			return err
 		}
-		err = db.basicDB.IncrementHashField(ctx, baseKey+"resource", resource, 1, expiration)
+		err = db.basicDB.IncrementHashField(ctx, baseKey+"resource", record.Resource, 1, expiration)
 		if err != nil {
 			Printing.PrintErrStr("Could not increment analytics resource: " + err.Error())
 			return err
 		}
-		err = db.basicDB.IncrementHashField(ctx, baseKey+"response_code", strconv.Itoa(responseCode), 1, expiration)
+		err = db.basicDB.IncrementHashField(ctx, baseKey+"response_code", strconv.Itoa(record.ResponseCode), 1, expiration)
 		if err != nil {
 			Printing.PrintErrStr("Could not increment analytics response code: " + err.Error())
 			return err
 		}
+		for dimension, values := range record.dimensions() {
+			for _, value := range values {
+				if value == "" {
+					continue
+				}
+				value = db.boundAnalyticsValue(ctx, baseKey+dimension, dimension, value)
+				err = db.basicDB.IncrementHashField(ctx, baseKey+dimension, value, 1, expiration)
+				if err != nil {
+					Printing.PrintErrStr("Could not increment analytics " + dimension + ": " + err.Error())
+					return err
+				}
+			}
+		}
+		if record.BlockedCrawler != "" && record.CrawlerBytesSaved > 0 {
+			err = db.basicDB.IncrementHashField(ctx, baseKey+"crawler_bytes_saved", record.BlockedCrawler, record.CrawlerBytesSaved, expiration)
+			if err != nil {
+				Printing.PrintErrStr("Could not increment analytics crawler bytes saved: " + err.Error())
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// Moves the visit on to the next page and counts it. A visit's analytics buckets are fixed when it starts, and are kept
+// with it so later pages count toward the same ones. Every visit is a bounce until a second page is seen.
+var recordVisitScript = valkey.NewLuaScript(`
+local now = tonumber(ARGV[1])
+local resource = ARGV[2]
+local visit = redis.call("HMGET", KEYS[1], "last_seen", "pages", "last_resource", "buckets")
+local lastSeen, pages, lastResource = tonumber(visit[1]), tonumber(visit[2]), visit[3]
+
+local buckets
+if not lastSeen or not pages or not lastResource or not visit[4] then
+	pages = 0
+	buckets = {}
+	for i = 2, #KEYS do
+		local bucket = {key = KEYS[i], expiration = tonumber(ARGV[i + 2])}
+		table.insert(buckets, bucket)
+		for _, counter in ipairs({"visits", "visit_pages", "bounces"}) do
+			redis.call("INCRBY", bucket.key .. counter, 1)
+			redis.call("EXPIREAT", bucket.key .. counter, bucket.expiration)
+		end
+		for _, dimension in ipairs({"entry_resource", "exit_resource"}) do
+			redis.call("HINCRBY", bucket.key .. dimension, resource, 1)
+			redis.call("EXPIREAT", bucket.key .. dimension, bucket.expiration)
+		end
+	end
+else
+	buckets = cjson.decode(visit[4])
+	for _, bucket in ipairs(buckets) do
+		redis.call("INCRBY", bucket.key .. "visit_pages", 1)
+		redis.call("INCRBY", bucket.key .. "visit_duration", now - lastSeen)
+		redis.call("HINCRBY", bucket.key .. "exit_resource", lastResource, -1)
+		redis.call("HINCRBY", bucket.key .. "exit_resource", resource, 1)
+		if pages == 1 then
+			redis.call("INCRBY", bucket.key .. "bounces", -1)
+		end
+		for _, name in ipairs({"visit_pages", "visit_duration", "exit_resource", "bounces"}) do
+			redis.call("EXPIREAT", bucket.key .. name, bucket.expiration)
+		end
+	end
+end
+
+redis.call("HSET", KEYS[1], "last_seen", now, "pages", pages + 1, "last_resource", resource, "buckets", cjson.encode(buckets))
+redis.call("EXPIRE", KEYS[1], tonumber(ARGV[3]))
+return {pages + 1}
+`)
+
+// Adds a page to the visitor's current visit, or starts a new visit if the last one timed out
+func (db DB) recordVisit(ctx context.Context, serviceID string, visitorID string, resource string, timeout time.Duration) error {
+	now := time.Now()
+	keys := []string{"Visit:" + serviceID + ":" + visitorID}
+	args := []string{strconv.FormatInt(now.Unix(), 10), resource, strconv.FormatInt(int64(timeout.Seconds()), 10)}
+	for _, timeStep := range cacheAnalyticsTime { // Only used if this page starts a new visit
+		keys = append(keys, timeStep.baseKey(serviceID, now))
+		args = append(args, strconv.FormatInt(timeStep.at(now, timeStep.maximumUnits).Unix(), 10))
+	}
+	_, err := db.basicDB.RunScript(ctx, recordVisitScript, keys, args)
+	if err != nil {
+		return errors.New("Unable to record visit: " + err.Error())
+	}
+	return nil
+}
+
+func (db DB) recordPageBeacon(ctx context.Context, serviceID string, beacon PageBeacon) error {
+	for _, timeStep := range cacheAnalyticsTime {
+		baseKey := timeStep.baseKey(serviceID, time.Now())
+		expiration := timeStep.time(timeStep.maximumUnits)
+		err := db.touchAnalyticsBucket(ctx, baseKey, expiration)
+		if err != nil {
+			return errors.New("Unable to record page beacon: " + err.Error())
+		}
+		switch beacon.Type {
+		case "view":
+			pagePath := db.boundAnalyticsValue(ctx, baseKey+"page_view", "page_view", beacon.Path)
+			err = errors.Join(
+				db.basicDB.IncrementKey(ctx, baseKey+"page_views", 1, expiration),
+				db.basicDB.IncrementHashField(ctx, baseKey+"page_view", pagePath, 1, expiration),
+			)
+			if screen := normalizeScreenSize(beacon.Screen); err == nil && screen != "" {
+				screen = db.boundAnalyticsValue(ctx, baseKey+"screen", "screen", screen)
+				err = db.basicDB.IncrementHashField(ctx, baseKey+"screen", screen, 1, expiration)
+			}
+		case "leave":
+			err = errors.Join(
+				db.basicDB.IncrementKey(ctx, baseKey+"page_time", beacon.Duration/1000, expiration),
+				db.basicDB.IncrementKey(ctx, baseKey+"page_time_samples", 1, expiration),
+			)
+		default:
+			return errors.New("Unknown page beacon type \"" + beacon.Type + "\"")
+		}
+		if err != nil {
+			return errors.New("Unable to record page beacon: " + err.Error())
+		}
+	}
+	return nil
+}
+
+func (db DB) recordCustomEvent(ctx context.Context, serviceID string, event CustomEvent) error {
+	for _, timeStep := range cacheAnalyticsTime {
+		baseKey := timeStep.baseKey(serviceID, time.Now())
+		expiration := timeStep.time(timeStep.maximumUnits)
+		err := db.touchAnalyticsBucket(ctx, baseKey, expiration)
+		if err != nil {
+			return errors.New("Unable to record custom event: " + err.Error())
+		}
+		name := db.boundAnalyticsValue(ctx, baseKey+"event", "event", event.Name)
+		if name != event.Name { // Don't mix values and properties of different events under "Other"
+			err = db.basicDB.IncrementHashField(ctx, baseKey+"event", name, 1, expiration)
+			if err != nil {
+				return errors.New("Unable to record custom event: " + err.Error())
+			}
+			continue
+		}
+		err = db.basicDB.IncrementHashField(ctx, baseKey+"event", name, 1, expiration)
+		if err == nil && event.Value != nil {
+			err = db.basicDB.IncrementHashFieldFloat(ctx, baseKey+"event_value", name, *event.Value, expiration)
+		}
+		for key, value := range event.Properties {
+			if err != nil {
+				break
+			}
+			field := db.boundAnalyticsValue(ctx, baseKey+"event_property", "event_property", eventPropertyField(name, key, value))
+			if field == "Other" {
+				continue
+			}
+			err = db.basicDB.IncrementHashField(ctx, baseKey+"event_property", field, 1, expiration)
+		}
+		if err != nil {
+			return errors.New("Unable to record custom event: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Ensures a bucket exists even if no proxied requests landed in it
+func (db DB) touchAnalyticsBucket(ctx context.Context, baseKey string, expiration time.Time) error {
+	return db.basicDB.IncrementKey(ctx, baseKey+"quantity", 0, expiration)
+}
+
 func (db DB) getAnalyticsService(ctx context.Context, service ServiceData, timeStep AnalyticsTimeStep) map[time.Time]Analytic {
 	analytics := map[time.Time]Analytic{}
 	quantity := strconv.Itoa(timeStep.maximumUnits)
@@ -354,20 +659,93 @@ func (db DB) getAnalyticsService(ctx context.Context, service ServiceData, timeS
 			}
 		}
 
+		dimensions := make(map[string]map[string]int, len(analyticsDimensions))
+		for _, dimension := range analyticsDimensions {
+			dimensions[dimension] = db.getCountHash(ctx, baseKey+dimension)
+		}
+		counters := make(map[string]int, len(analyticsCounters))
+		for _, counter := range analyticsCounters {
+			counterRaw, _ := db.basicDB.Get(ctx, baseKey+counter)
+			counters[counter], _ = strconv.Atoi(counterRaw)
+		}
+		visits := newVisitSummary(counters["visits"], counters["visit_pages"], counters["visit_duration"], counters["bounces"])
+		visits.EntryResource = dimensions["entry_resource"]
+		visits.ExitResource = dimensions["exit_resource"]
+		pageViews := newPageViewSummary(counters["page_views"], counters["page_time"], counters["page_time_samples"])
+		pageViews.PageView = dimensions["page_view"]
+		pageViews.Screen = dimensions["screen"]
+		eventValues := map[string]float64{}
+		eventValuesRaw, _ := db.basicDB.GetHash(ctx, baseKey+"event_value")
+		for name, valueRaw := range eventValuesRaw {
+			eventValues[name], _ = strconv.ParseFloat(valueRaw, 64)
+		}
+
 		analytics[timeStep.time(-timePeriod)] = Analytic{
-			Quantity:      quantity,
-			Country:       country,
-			IP:            ip,
-			Resource:      resource,
-			ResponseCode:  responseCodes,
-			SentBytes:     sentBytes,
-			ReceivedBytes: receivedBytes,
+			Quantity:          quantity,
+			Country:           country,
+			IP:                ip,
+			Resource:          resource,
+			ResponseCode:      responseCodes,
+			SentBytes:         sentBytes,
+			ReceivedBytes:     receivedBytes,
+			Browser:           dimensions["browser"],
+			OS:                dimensions["os"],
+			Device:            dimensions["device"],
+			Bot:               dimensions["bot"],
+			Referrer:          topCounts(dimensions["referrer"], 20),
+			Host:              dimensions["host"],
+			UserAgent:         dimensions["user_agent"],
+			ScannerRule:       dimensions["scanner_rule"],
+			Blocked:           dimensions["blocked"],
+			BlockedCountry:    dimensions["blocked_country"],
+			Challenge:         dimensions["challenge"],
+			WAFRule:           dimensions["waf_rule"],
+			BlockList:         dimensions["block_list"],
+			BlockedCrawler:    dimensions["blocked_crawler"],
+			CrawlerBytesSaved: dimensions["crawler_bytes_saved"],
+			VisitSummary:      visits,
+			PageViewSummary:   pageViews,
+			Events:            newEventSummaries(dimensions["event"], eventValues, dimensions["event_property"]),
 		}
 	}
 
 	return analytics
 }
 
+// Replaces value with "Other" once a capped dimension has filled up for the bucket
+func (db DB) boundAnalyticsValue(ctx context.Context, key string, dimension string, value string) string {
+	limit, ok := analyticsDimensionLimits[dimension]
+	if !ok {
+		return value
+	}
+	exists, err := db.basicDB.HashFieldExists(ctx, key, value)
+	if err != nil || exists {
+		return value
+	}
+	length, err := db.basicDB.HashLength(ctx, key)
+	if err != nil || length < limit {
+		return value
+	}
+	return "Other"
+}
+
+// Reads a hash of counts, missing or malformed hashes are treated as empty
+func (db DB) getCountHash(ctx context.Context, key string) map[string]int {
+	counts := make(map[string]int)
+	raw, err := db.basicDB.GetHash(ctx, key)
+	if err != nil {
+		return counts
+	}
+	for name, countRaw := range raw {
+		count, err := strconv.Atoi(countRaw)
+		if err != nil || count <= 0 { // Visit exits are decremented and may sit at zero
+			continue
+		}
+		counts[name] = count
+	}
+	return counts
+}
+
 func (db DB) getVersion(ctx context.Context) (string, error) {
 	version, err := db.basicDB.Get(ctx, "version")
 	if err != nil {
@@ -398,7 +776,7 @@ func (db DB) deleteService(ctx context.Context, service ServiceLink) error {
 			baseKey := "Analytics:" + service.ID + ":" + quantity + ":" + recordTime + ":"
 
 			// Delete all analytics keys (both regular and hash keys)
-			allFields := []string{"quantity", "sent_bytes", "received_bytes", "country", "ip", "resource", "response_code"}
+			allFields := slices.Concat([]string{"quantity", "sent_bytes", "received_bytes", "country", "ip", "resource", "response_code"}, analyticsDimensions, analyticsCounters, []string{"event_value"})
 			for _, field := range allFields {
 				if err := db.basicDB.Delete(ctx, baseKey+field); err == nil {
 					deletedCount++
@@ -414,13 +792,14 @@ func (db DB) deleteService(ctx context.Context, service ServiceLink) error {
 	return nil
 }
 
-func (db DB) addAPIKey(ctx context.Context, APIKey string, keyID string, name string) error {
+func (db DB) addAPIKey(ctx context.Context, APIKey string, keyID string, name string, services ServiceScope) error {
 	if name == "" {
 		name = "Unnamed API"
 	}
 	hash := map[string]string{
-		"name": name,
-		"id":   keyID,
+		"name":     name,
+		"id":       keyID,
+		"services": services.encode(),
 	}
 
 	err := db.basicDB.SetHash(ctx, "APIKey:"+APIKey, hash)
@@ -477,48 +856,663 @@ func (db DB) getAPIKeyInfo(ctx context.Context) ([]APIKeyInfo, error) {
 		}
 		keysInfo[i].Name = keyInfo["name"]
 		keysInfo[i].ID = keyInfo["id"]
+		keysInfo[i].Services = decodeServiceScope(keyInfo["services"], "API key "+keyInfo["id"])
 	}
 
 	return keysInfo, nil
 }
 
-func (db DB) apiKeyExists(ctx context.Context, APIKey string) bool {
+// Nil if the API key doesn't exist
+func (db DB) getAPIKey(ctx context.Context, APIKey string) (*APIKeyInfo, error) {
 	keys, err := db.basicDB.GetList(ctx, "APIKeys")
 	if err != nil {
-		return false
+		return nil, errors.New("Unable to get API keys: " + err.Error())
+	}
+	if APIKey == "" || !slices.Contains(keys, APIKey) {
+		return nil, nil
+	}
+	keyInfo, err := db.basicDB.GetHash(ctx, "APIKey:"+APIKey)
+	if err != nil {
+		return nil, errors.New("Unable to get API key: " + err.Error())
 	}
-	return slices.Contains(keys, APIKey)
+	return &APIKeyInfo{
+		Name:     keyInfo["name"],
+		ID:       keyInfo["id"],
+		Services: decodeServiceScope(keyInfo["services"], "API key "+keyInfo["id"]),
+	}, nil
 }
 
-func (db DB) SetJWTSecret(ctx context.Context, jwtSecret string) error {
-	err := db.basicDB.Set(ctx, "JWTSecret", jwtSecret, 0)
+func (db DB) setAPIKeyServices(ctx context.Context, APIKeyID string, services ServiceScope) error {
+	keys, err := db.basicDB.GetList(ctx, "APIKeys")
 	if err != nil {
-		return errors.New("Failed to set JWT Secret: " + err.Error())
+		return err
+	}
+	for _, key := range keys {
+		keyInfo, err := db.basicDB.GetHash(ctx, "APIKey:"+key)
+		if err != nil {
+			return err
+		}
+		if keyInfo["id"] == APIKeyID {
+			return db.basicDB.SetHash(ctx, "APIKey:"+key, map[string]string{"services": services.encode()})
+		}
+	}
+	return errors.New("API key not found")
+}
+
+func (db DB) setJWTKeys(ctx context.Context, keys []JWTKey) error {
+	rawKeys, err := json.Marshal(keys)
+	if err != nil {
+		return errors.New("Unable to encode JWT signing keys: " + err.Error())
+	}
+	err = db.basicDB.Set(ctx, "JWTKeys", string(rawKeys), 0)
+	if err != nil {
+		return errors.New("Unable to set JWT signing keys: " + err.Error())
+	}
+	return nil
+}
+
+// Empty if no keys were saved yet
+func (db DB) getJWTKeys(ctx context.Context) ([]JWTKey, error) {
+	rawKeys, err := db.basicDB.Get(ctx, "JWTKeys")
+	if valkey.IsValkeyNil(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.New("Unable to get JWT signing keys: " + err.Error())
+	}
+	var keys []JWTKey
+	err = json.Unmarshal([]byte(rawKeys), &keys)
+	if err != nil {
+		return nil, errors.New("Unable to decode JWT signing keys: " + err.Error())
+	}
+	return keys, nil
+}
+
+// Nil if the user doesn't exist
+func (db DB) getUser(ctx context.Context, username string) (*User, error) {
+	userHash, err := db.basicDB.GetHash(ctx, "User:"+username)
+	if err != nil {
+		return nil, errors.New("Unable to get user: " + err.Error())
+	}
+	if len(userHash) == 0 {
+		return nil, nil
+	}
+	var recoveryCodes []string
+	if userHash["recovery_codes"] != "" {
+		err = json.Unmarshal([]byte(userHash["recovery_codes"]), &recoveryCodes)
+		if err != nil { // Fail closed, leaving only the authenticator
+			Printing.PrintErrStr("Invalid recovery codes for user " + username + ": " + err.Error())
+		}
+	}
+	totpLastStep, _ := strconv.ParseInt(userHash["totp_last_step"], 10, 64)
+	return &User{
+		Username:      username,
+		Role:          UserRole(userHash["role"]),
+		Services:      decodeServiceScope(userHash["services"], "user "+username),
+		Provider:      userHash["provider"],
+		Subject:       userHash["subject"],
+		TwoFactor:     userHash["totp_secret"] != "",
+		PasswordHash:  userHash["password_hash"],
+		TOTPSecret:    userHash["totp_secret"],
+		TOTPLastStep:  totpLastStep,
+		RecoveryCodes: recoveryCodes,
+	}, nil
+}
+
+// The username of the OIDC user with the issuer and sub claim, empty if they haven't signed in yet
+func (db DB) getOIDCUsername(ctx context.Context, subject string) (string, error) {
+	username, err := db.basicDB.Get(ctx, "OIDCSubject:"+subject)
+	if valkey.IsValkeyNil(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.New("Unable to get OIDC user: " + err.Error())
+	}
+	return username, nil
+}
+
+// Moves the user's last used TOTP step forward, returning false if the step was already used
+var useTOTPStepScript = valkey.NewLuaScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {0}
+end
+local step = tonumber(ARGV[1])
+if step <= (tonumber(redis.call("HGET", KEYS[1], "totp_last_step")) or 0) then
+	return {0}
+end
+redis.call("HSET", KEYS[1], "totp_last_step", step)
+return {1}
+`)
+
+// Removes the recovery code hash from the user, returning false if it was already used
+var useRecoveryCodeScript = valkey.NewLuaScript(`
+local rawCodes = redis.call("HGET", KEYS[1], "recovery_codes")
+if not rawCodes or rawCodes == "" or rawCodes == "null" then
+	return {0}
+end
+local codes = cjson.decode(rawCodes)
+for i, code in ipairs(codes) do
+	if code == ARGV[1] then
+		table.remove(codes, i)
+		local encoded = "null"
+		if #codes > 0 then
+			encoded = cjson.encode(codes)
+		end
+		redis.call("HSET", KEYS[1], "recovery_codes", encoded)
+		return {1}
+	end
+end
+return {0}
+`)
+
+func (db DB) useTOTPStep(ctx context.Context, username string, step int64) (bool, error) {
+	values, err := db.basicDB.RunScript(ctx, useTOTPStepScript, []string{"User:" + username}, []string{strconv.FormatInt(step, 10)})
+	if err != nil {
+		return false, errors.New("Unable to use TOTP code: " + err.Error())
+	}
+	if len(values) != 1 {
+		return false, errors.New("Unexpected TOTP script result")
+	}
+	return values[0] == 1, nil
+}
+
+func (db DB) useRecoveryCode(ctx context.Context, username string, hash string) (bool, error) {
+	values, err := db.basicDB.RunScript(ctx, useRecoveryCodeScript, []string{"User:" + username}, []string{hash})
+	if err != nil {
+		return false, errors.New("Unable to use recovery code: " + err.Error())
+	}
+	if len(values) != 1 {
+		return false, errors.New("Unexpected recovery code script result")
+	}
+	return values[0] == 1, nil
+}
+
+func (db DB) getUsers(ctx context.Context) ([]User, error) {
+	usernames, err := db.basicDB.GetList(ctx, "Users")
+	if err != nil {
+		return nil, errors.New("Unable to get users list: " + err.Error())
+	}
+	users := make([]User, 0, len(usernames))
+	for _, username := range usernames {
+		user, err := db.getUser(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if user != nil {
+			users = append(users, *user)
+		}
+	}
+	return users, nil
+}
+
+// Creates or replaces the user
+func (db DB) setUser(ctx context.Context, user User) error {
+	existing, err := db.getUser(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	recoveryCodes, err := json.Marshal(user.RecoveryCodes)
+	if err != nil {
+		return errors.New("Unable to encode recovery codes: " + err.Error())
+	}
+	err = db.basicDB.SetHash(ctx, "User:"+user.Username, map[string]string{
+		"role":           string(user.Role),
+		"services":       user.Services.encode(),
+		"provider":       user.Provider,
+		"subject":        user.Subject,
+		"password_hash":  user.PasswordHash,
+		"totp_secret":    user.TOTPSecret,
+		"totp_last_step": strconv.FormatInt(user.TOTPLastStep, 10),
+		"recovery_codes": string(recoveryCodes),
+	})
+	if err != nil {
+		return errors.New("Unable to set user: " + err.Error())
+	}
+	if user.Subject != "" {
+		err = db.basicDB.Set(ctx, "OIDCSubject:"+user.Subject, user.Username, 0)
+		if err != nil {
+			return errors.New("Unable to set OIDC subject: " + err.Error())
+		}
+	}
+	if existing != nil {
+		return nil
+	}
+	err = db.basicDB.AddToList(ctx, "Users", user.Username)
+	if err != nil {
+		return errors.New("Unable to add user to users list: " + err.Error())
 	}
 	return nil
 }
 
-func (db DB) GetJWTSecret(ctx context.Context) (string, error) {
-	secret, err := db.basicDB.Get(ctx, "JWTSecret")
+func (db DB) removeUser(ctx context.Context, username string) error {
+	user, err := db.getUser(ctx, username)
 	if err != nil {
-		return "", errors.New("Failed to get JWT Secret: " + err.Error())
+		return err
+	}
+	err = db.removeSessions(ctx, username)
+	if err != nil {
+		return err
+	}
+	if user != nil && user.Subject != "" {
+		err = db.basicDB.Delete(ctx, "OIDCSubject:"+user.Subject)
+		if err != nil {
+			return errors.New("Unable to remove OIDC subject: " + err.Error())
+		}
+	}
+	passkeys, err := db.getPasskeys(ctx, username)
+	if err != nil {
+		return err
+	}
+	for _, passkey := range passkeys {
+		err = db.removePasskey(ctx, passkey)
+		if err != nil {
+			return err
+		}
+	}
+	err = db.basicDB.RemoveFromList(ctx, "Users", username)
+	if err != nil {
+		return errors.New("Unable to remove user from users list: " + err.Error())
+	}
+	err = db.basicDB.Delete(ctx, "User:"+username)
+	if err != nil {
+		return errors.New("Unable to delete user: " + err.Error())
+	}
+	return nil
+}
+
+// A TOTP secret waiting for its first code, which expires if enrollment isn't finished
+func (db DB) setTOTPEnrollment(ctx context.Context, username string, secret string, lifetime time.Duration) error {
+	return db.basicDB.Set(ctx, "TOTPEnrollment:"+username, secret, lifetime)
+}
+
+func (db DB) getTOTPEnrollment(ctx context.Context, username string) (string, error) {
+	return db.basicDB.Get(ctx, "TOTPEnrollment:"+username)
+}
+
+func (db DB) removeTOTPEnrollment(ctx context.Context, username string) error {
+	return db.basicDB.Delete(ctx, "TOTPEnrollment:"+username)
+}
+
+// Nil if the passkey doesn't exist
+func (db DB) getPasskey(ctx context.Context, id string) (*Passkey, error) {
+	passkeyHash, err := db.basicDB.GetHash(ctx, "Passkey:"+id)
+	if err != nil {
+		return nil, errors.New("Unable to get passkey: " + err.Error())
 	}
-	return secret, nil
+	if len(passkeyHash) == 0 {
+		return nil, nil
+	}
+	publicKey, err := base64.StdEncoding.DecodeString(passkeyHash["public_key"])
+	if err != nil {
+		return nil, errors.New("Unable to decode passkey public key: " + err.Error())
+	}
+	created, _ := strconv.ParseInt(passkeyHash["created"], 10, 64)
+	signCount, _ := strconv.ParseUint(passkeyHash["sign_count"], 10, 32)
+	passkey := Passkey{
+		ID:        id,
+		Name:      passkeyHash["name"],
+		Created:   time.Unix(created, 0),
+		Username:  passkeyHash["username"],
+		PublicKey: publicKey,
+		SignCount: uint32(signCount),
+	}
+	if lastUsed, err := strconv.ParseInt(passkeyHash["last_used"], 10, 64); err == nil {
+		lastUsedTime := time.Unix(lastUsed, 0)
+		passkey.LastUsed = &lastUsedTime
+	}
+	return &passkey, nil
 }
 
-func (db DB) GetUserPasswordHash(ctx context.Context) (string, error) {
-	passwordHash, err := db.basicDB.Get(ctx, "Password_Hash")
+func (db DB) getPasskeys(ctx context.Context, username string) ([]Passkey, error) {
+	ids, err := db.basicDB.GetList(ctx, "Passkeys:"+username)
 	if err != nil {
-		return "", errors.New("Unable to get the password hash" + err.Error())
+		return nil, errors.New("Unable to get passkeys list: " + err.Error())
 	}
-	return passwordHash, nil
+	passkeys := make([]Passkey, 0, len(ids))
+	for _, id := range ids {
+		passkey, err := db.getPasskey(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if passkey != nil {
+			passkeys = append(passkeys, *passkey)
+		}
+	}
+	return passkeys, nil
 }
 
-func (db DB) SetUserPasswordHash(ctx context.Context, hash string) {
-	err := db.basicDB.Set(ctx, "Password_Hash", hash, 0)
+// Creates or replaces the passkey
+func (db DB) setPasskey(ctx context.Context, passkey Passkey) error {
+	existing, err := db.getPasskey(ctx, passkey.ID)
+	if err != nil {
+		return err
+	}
+	passkeyHash := map[string]string{
+		"name":       passkey.Name,
+		"username":   passkey.Username,
+		"public_key": base64.StdEncoding.EncodeToString(passkey.PublicKey),
+		"sign_count": strconv.FormatUint(uint64(passkey.SignCount), 10),
+		"created":    strconv.FormatInt(passkey.Created.Unix(), 10),
+	}
+	if passkey.LastUsed != nil {
+		passkeyHash["last_used"] = strconv.FormatInt(passkey.LastUsed.Unix(), 10)
+	}
+	err = db.basicDB.SetHash(ctx, "Passkey:"+passkey.ID, passkeyHash)
 	if err != nil {
-		panic("Unable to set the user's password hash: " + err.Error())
+		return errors.New("Unable to set passkey: " + err.Error())
 	}
+	if existing != nil {
+		return nil
+	}
+	err = db.basicDB.AddToList(ctx, "Passkeys:"+passkey.Username, passkey.ID)
+	if err != nil {
+		return errors.New("Unable to add passkey to passkeys list: " + err.Error())
+	}
+	return nil
+}
+
+func (db DB) removePasskey(ctx context.Context, passkey Passkey) error {
+	err := db.basicDB.RemoveFromList(ctx, "Passkeys:"+passkey.Username, passkey.ID)
+	if err != nil {
+		return errors.New("Unable to remove passkey from passkeys list: " + err.Error())
+	}
+	err = db.basicDB.Delete(ctx, "Passkey:"+passkey.ID)
+	if err != nil {
+		return errors.New("Unable to delete passkey: " + err.Error())
+	}
+	return nil
+}
+
+// What a passkey challenge was issued for, until it's used or expires
+func (db DB) setWebAuthnChallenge(ctx context.Context, challenge string, purpose string, lifetime time.Duration) error {
+	return db.basicDB.Set(ctx, "WebAuthnChallenge:"+challenge, purpose, lifetime)
+}
+
+// Challenges can only be used once
+func (db DB) takeWebAuthnChallenge(ctx context.Context, challenge string) (string, error) {
+	return db.basicDB.GetAndDelete(ctx, "WebAuthnChallenge:"+challenge)
+}
+
+// Marks a solved browser challenge as used, returning false if it already was. Challenges expire on their own, so
+// they only need to be remembered for their lifetime.
+func (db DB) spendBrowserChallenge(ctx context.Context, challenge string, lifetime time.Duration) (bool, error) {
+	return db.basicDB.SetIfMissing(ctx, "SpentChallenge:"+challenge, "1", lifetime)
+}
+
+// Counts the failure for its IP and everyone, locking out the IP with exponential backoff past the threshold, and
+// every IP with failures of its own past the global threshold. Also logs the failure for the dashboard. Returns the lockout in milliseconds.
+var signInFailureScript = valkey.NewLuaScript(`
+local threshold = tonumber(ARGV[1])
+local globalThreshold = tonumber(ARGV[2])
+local window = tonumber(ARGV[3])
+local baseLockout = tonumber(ARGV[4])
+local maximumLockout = tonumber(ARGV[5])
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local failures = redis.call("HINCRBY", KEYS[1], "failures", 1)
+local lockout = 0
+if failures >= threshold then
+	lockout = math.floor(math.min(maximumLockout, baseLockout * 2 ^ (failures - threshold)))
+	redis.call("HSET", KEYS[1], "locked_until", now + lockout)
+end
+redis.call("PEXPIRE", KEYS[1], math.max(window, lockout))
+
+if globalThreshold > 0 then
+	local globalFailures = redis.call("INCR", KEYS[2])
+	if globalFailures == 1 then
+		redis.call("PEXPIRE", KEYS[2], window)
+	end
+	if globalFailures >= globalThreshold then
+		redis.call("SET", KEYS[3], "1", "PX", baseLockout)
+		lockout = math.max(lockout, baseLockout)
+	end
+end
+
+local entry = cjson.decode(ARGV[6])
+entry["lockout"] = math.ceil(lockout / 1000)
+redis.call("LPUSH", KEYS[4], cjson.encode(entry))
+redis.call("LTRIM", KEYS[4], 0, tonumber(ARGV[7]) - 1)
+return {lockout}
+`)
+
+// Milliseconds until the IP can try again. The global lockout only holds back IPs that failed recently themselves, so
+// whoever set it off can't lock out everyone else.
+var signInLockoutScript = valkey.NewLuaScript(`
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local lockedUntil = tonumber(redis.call("HGET", KEYS[1], "locked_until")) or 0
+local globalLockout = 0
+if (tonumber(redis.call("HGET", KEYS[1], "failures")) or 0) > 0 then
+	globalLockout = redis.call("PTTL", KEYS[2])
+end
+return {math.max(lockedUntil - now, globalLockout, 0)}
+`)
+
+func (db DB) addSignInFailure(ctx context.Context, failure SignInFailure, threshold int, globalThreshold int, window time.Duration, baseLockout time.Duration, maximumLockout time.Duration) (time.Duration, error) {
+	entry, err := json.Marshal(failure)
+	if err != nil {
+		return 0, errors.New("Unable to encode failed sign in: " + err.Error())
+	}
+	values, err := db.basicDB.RunScript(ctx, signInFailureScript,
+		[]string{"SignInFailures:" + failure.IP, "SignInFailures", "SignInLockout", "SignInFailureLog"},
+		[]string{
+			strconv.Itoa(threshold),
+			strconv.Itoa(globalThreshold),
+			strconv.FormatInt(window.Milliseconds(), 10),
+			strconv.FormatInt(baseLockout.Milliseconds(), 10),
+			strconv.FormatInt(maximumLockout.Milliseconds(), 10),
+			string(entry),
+			strconv.Itoa(signInFailureLogLength),
+		})
+	if err != nil {
+		return 0, errors.New("Unable to record failed sign in: " + err.Error())
+	}
+	if len(values) != 1 {
+		return 0, errors.New("Unexpected failed sign in script result")
+	}
+	return time.Duration(values[0]) * time.Millisecond, nil
+}
+
+func (db DB) getSignInLockout(ctx context.Context, ip string) (time.Duration, error) {
+	values, err := db.basicDB.RunScript(ctx, signInLockoutScript, []string{"SignInFailures:" + ip, "SignInLockout"}, nil)
+	if err != nil {
+		return 0, errors.New("Unable to get sign in lockout: " + err.Error())
+	}
+	if len(values) != 1 {
+		return 0, errors.New("Unexpected sign in lockout script result")
+	}
+	return time.Duration(values[0]) * time.Millisecond, nil
+}
+
+func (db DB) removeSignInFailures(ctx context.Context, ip string) error {
+	return db.basicDB.Delete(ctx, "SignInFailures:"+ip)
+}
+
+func (db DB) getSignInFailures(ctx context.Context) ([]SignInFailure, error) {
+	entries, err := db.basicDB.GetList(ctx, "SignInFailureLog")
+	if err != nil {
+		return nil, errors.New("Unable to get failed sign ins: " + err.Error())
+	}
+	failures := make([]SignInFailure, 0, len(entries))
+	for _, entry := range entries {
+		var failure SignInFailure
+		if json.Unmarshal([]byte(entry), &failure) == nil {
+			failures = append(failures, failure)
+		}
+	}
+	return failures, nil
+}
+
+// Also drops events older than the retention
+func (db DB) addAuditEvent(ctx context.Context, event AuditEvent, retention time.Duration) error {
+	entry, err := json.Marshal(event)
+	if err != nil {
+		return errors.New("Unable to encode audit event: " + err.Error())
+	}
+	// Scored by time so events can be queried by time range and aged out
+	err = db.basicDB.AddToSortedSet(ctx, "AuditLog", string(entry), float64(event.Time.UnixMilli()))
+	if err != nil {
+		return errors.New("Unable to save audit event: " + err.Error())
+	}
+	cutoff := strconv.FormatInt(event.Time.Add(-retention).UnixMilli(), 10)
+	err = db.basicDB.RemoveFromSortedSetByScore(ctx, "AuditLog", "-inf", "("+cutoff)
+	if err != nil {
+		return errors.New("Unable to clean up audit log: " + err.Error())
+	}
+	return nil
+}
+
+// Oldest first
+func (db DB) getAuditEvents(ctx context.Context, since time.Time, until time.Time) ([]AuditEvent, error) {
+	entries, err := db.basicDB.GetSortedSetByScore(ctx, "AuditLog", strconv.FormatInt(since.UnixMilli(), 10), strconv.FormatInt(until.UnixMilli(), 10))
+	if err != nil {
+		return nil, errors.New("Unable to get audit log: " + err.Error())
+	}
+	events := make([]AuditEvent, 0, len(entries))
+	for _, entry := range entries {
+		var event AuditEvent
+		if json.Unmarshal([]byte(entry), &event) == nil {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// Nil if the session doesn't exist, was revoked, or expired
+func (db DB) getSession(ctx context.Context, id string) (*Session, error) {
+	sessionHash, err := db.basicDB.GetHash(ctx, "Session:"+id)
+	if err != nil {
+		return nil, errors.New("Unable to get session: " + err.Error())
+	}
+	if len(sessionHash) == 0 {
+		return nil, nil
+	}
+	created, _ := strconv.ParseInt(sessionHash["created"], 10, 64)
+	lastSeen, _ := strconv.ParseInt(sessionHash["last_seen"], 10, 64)
+	return &Session{
+		ID:       id,
+		Username: sessionHash["username"],
+		Created:  time.Unix(created, 0),
+		LastSeen: time.Unix(lastSeen, 0),
+		IP:       sessionHash["ip"],
+		Device:   sessionHash["device"],
+	}, nil
+}
+
+// Also forgets sessions that expired
+func (db DB) getSessions(ctx context.Context, username string) ([]Session, error) {
+	ids, err := db.basicDB.GetList(ctx, "Sessions:"+username)
+	if err != nil {
+		return nil, errors.New("Unable to get sessions list: " + err.Error())
+	}
+	sessions := make([]Session, 0, len(ids))
+	for _, id := range ids {
+		session, err := db.getSession(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		if session == nil {
+			db.basicDB.RemoveFromList(ctx, "Sessions:"+username, id)
+			continue
+		}
+		sessions = append(sessions, *session)
+	}
+	return sessions, nil
+}
+
+func (db DB) setSession(ctx context.Context, session Session, lifetime time.Duration) error {
+	err := db.basicDB.SetHash(ctx, "Session:"+session.ID, map[string]string{
+		"username":  session.Username,
+		"created":   strconv.FormatInt(session.Created.Unix(), 10),
+		"last_seen": strconv.FormatInt(session.LastSeen.Unix(), 10),
+		"ip":        session.IP,
+		"device":    session.Device,
+	})
+	if err != nil {
+		return errors.New("Unable to set session: " + err.Error())
+	}
+	err = db.basicDB.SetExpiration(ctx, "Session:"+session.ID, lifetime)
+	if err != nil {
+		db.basicDB.Delete(ctx, "Session:"+session.ID)
+		return errors.New("Unable to set session expiration: " + err.Error())
+	}
+	err = db.basicDB.AddToList(ctx, "Sessions:"+session.Username, session.ID)
+	if err != nil {
+		return errors.New("Unable to add session to sessions list: " + err.Error())
+	}
+	return nil
+}
+
+// Only updates sessions that still exist, so a request racing a revocation can't bring the session back
+var touchSessionScript = valkey.NewLuaScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return {0}
+end
+redis.call("HSET", KEYS[1], "last_seen", ARGV[1])
+return {1}
+`)
+
+func (db DB) touchSession(ctx context.Context, id string, lastSeen time.Time) error {
+	_, err := db.basicDB.RunScript(ctx, touchSessionScript, []string{"Session:" + id}, []string{strconv.FormatInt(lastSeen.Unix(), 10)})
+	if err != nil {
+		return errors.New("Unable to update session: " + err.Error())
+	}
+	return nil
+}
+
+func (db DB) removeSession(ctx context.Context, session Session) error {
+	err := db.basicDB.Delete(ctx, "Session:"+session.ID)
+	if err != nil {
+		return errors.New("Unable to delete session: " + err.Error())
+	}
+	err = db.basicDB.RemoveFromList(ctx, "Sessions:"+session.Username, session.ID)
+	if err != nil {
+		return errors.New("Unable to remove session from sessions list: " + err.Error())
+	}
+	return nil
+}
+
+// Signs the user out everywhere
+func (db DB) removeSessions(ctx context.Context, username string) error {
+	ids, err := db.basicDB.GetList(ctx, "Sessions:"+username)
+	if err != nil {
+		return errors.New("Unable to get sessions list: " + err.Error())
+	}
+	for _, id := range ids {
+		err = db.basicDB.Delete(ctx, "Session:"+id)
+		if err != nil {
+			return errors.New("Unable to delete session: " + err.Error())
+		}
+	}
+	err = db.basicDB.Delete(ctx, "Sessions:"+username)
+	if err != nil {
+		return errors.New("Unable to delete sessions list: " + err.Error())
+	}
+	return nil
+}
+
+// The PKCE verifier and nonce for a sign in at the OIDC provider, until the provider sends the user back
+func (db DB) setOIDCState(ctx context.Context, state string, pending oidcState, lifetime time.Duration) error {
+	rawPending, err := json.Marshal(pending)
+	if err != nil {
+		return errors.New("Unable to encode OIDC state: " + err.Error())
+	}
+	return db.basicDB.Set(ctx, "OIDCState:"+state, string(rawPending), lifetime)
+}
+
+// States can only be used once
+func (db DB) takeOIDCState(ctx context.Context, state string) (*oidcState, error) {
+	rawPending, err := db.basicDB.GetAndDelete(ctx, "OIDCState:"+state)
+	if err != nil {
+		return nil, err
+	}
+	var pending oidcState
+	err = json.Unmarshal([]byte(rawPending), &pending)
+	if err != nil {
+		return nil, errors.New("Unable to decode OIDC state: " + err.Error())
+	}
+	return &pending, nil
 }
 
 func (db DB) getServiceLinks(ctx context.Context) (ServiceLinks, error) {
@@ -553,10 +1547,75 @@ func (db DB) getServiceLinks(ctx context.Context) (ServiceLinks, error) {
 			continue
 		}
 
+		var accessList AccessList
+		if serviceHash["access_list"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["access_list"]), &accessList)
+			if err != nil { // Fail closed, a service meant to be private shouldn't become public
+				Printing.PrintErrStr("Invalid access list for service " + id + ", denying everyone: " + err.Error())
+				accessList = AccessList{Deny: []string{"0.0.0.0/0", "::/0"}}
+			}
+		}
+		var geoFence GeoFence
+		if serviceHash["geo_fence"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["geo_fence"]), &geoFence)
+			if err != nil { // Fail closed, an empty allow list lets no country through
+				Printing.PrintErrStr("Invalid geo-fence for service " + id + ", denying everyone: " + err.Error())
+				geoFence = GeoFence{Mode: GeoFenceModeAllow}
+			}
+		}
+		var challenge ChallengeSettings
+		if serviceHash["challenge"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["challenge"]), &challenge)
+			if err != nil { // Fail closed, challenging everyone is safer than letting scrapers in
+				Printing.PrintErrStr("Invalid challenge settings for service " + id + ", challenging everyone: " + err.Error())
+				challenge = ChallengeSettings{Enabled: true}
+			}
+		}
+		var crawlerPolicy CrawlerPolicy
+		if serviceHash["crawler_policy"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["crawler_policy"]), &crawlerPolicy)
+			if err != nil {
+				Printing.PrintErrStr("Invalid crawler policy for service " + id + ", ignoring it: " + err.Error())
+				crawlerPolicy = CrawlerPolicy{}
+			}
+		}
+		var blockLists BlockListSettings
+		if serviceHash["block_lists"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["block_lists"]), &blockLists)
+			if err != nil {
+				Printing.PrintErrStr("Invalid block list settings for service " + id + ", ignoring them: " + err.Error())
+				blockLists = BlockListSettings{}
+			}
+		}
+		var waf WAFSettings
+		if serviceHash["waf"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["waf"]), &waf)
+			if err != nil { // Fail closed, blocking is what the WAF was most likely set to
+				Printing.PrintErrStr("Invalid WAF settings for service " + id + ", blocking: " + err.Error())
+				waf = WAFSettings{Mode: WAFModeBlock}
+			}
+		}
+		var rateLimits []RateLimit
+		if serviceHash["rate_limits"] != "" {
+			err = json.Unmarshal([]byte(serviceHash["rate_limits"]), &rateLimits)
+			if err != nil {
+				Printing.PrintErrStr("Invalid rate limits for service " + id + ", ignoring them: " + err.Error())
+				rateLimits = nil
+			}
+		}
+
 		// Build the ServiceLink
 		serviceLink := ServiceLink{
 			ID:                id,
 			Title:             serviceHash["title"],
+			PageTracking:      serviceHash["page_tracking"] == "true",
+			AccessList:        accessList,
+			GeoFence:          geoFence,
+			RateLimits:        rateLimits,
+			Challenge:         challenge,
+			WAF:               waf,
+			BlockLists:        blockLists,
+			CrawlerPolicy:     crawlerPolicy,
 			IncomingAddresses: incomingAddresses,
 			OutgoingAddress: ServiceAddress{
 				Protocol: serviceHash["outgoing_protocol"],
@@ -585,15 +1644,52 @@ func (db DB) setServiceLinks(ctx context.Context, serviceLinks ServiceLinks) err
 	for _, serviceLink := range serviceLinks {
 		newIDs = append(newIDs, serviceLink.ID)
 
+		accessList, err := json.Marshal(serviceLink.AccessList)
+		if err != nil {
+			return errors.New("Unable to encode access list for " + serviceLink.ID + ": " + err.Error())
+		}
+		geoFence, err := json.Marshal(serviceLink.GeoFence)
+		if err != nil {
+			return errors.New("Unable to encode geo-fence for " + serviceLink.ID + ": " + err.Error())
+		}
+		crawlerPolicy, err := json.Marshal(serviceLink.CrawlerPolicy)
+		if err != nil {
+			return errors.New("Unable to encode crawler policy for " + serviceLink.ID + ": " + err.Error())
+		}
+		blockLists, err := json.Marshal(serviceLink.BlockLists)
+		if err != nil {
+			return errors.New("Unable to encode block list settings for " + serviceLink.ID + ": " + err.Error())
+		}
+		waf, err := json.Marshal(serviceLink.WAF)
+		if err != nil {
+			return errors.New("Unable to encode WAF settings for " + serviceLink.ID + ": " + err.Error())
+		}
+		challenge, err := json.Marshal(serviceLink.Challenge)
+		if err != nil {
+			return errors.New("Unable to encode challenge settings for " + serviceLink.ID + ": " + err.Error())
+		}
+		rateLimits, err := json.Marshal(serviceLink.RateLimits)
+		if err != nil {
+			return errors.New("Unable to encode rate limits for " + serviceLink.ID + ": " + err.Error())
+		}
+
 		// Store the service hash
 		serviceHash := map[string]string{
 			"title":             serviceLink.Title,
 			"outgoing_protocol": serviceLink.OutgoingAddress.Protocol,
 			"outgoing_domain":   serviceLink.OutgoingAddress.Domain,
 			"outgoing_port":     strconv.Itoa(serviceLink.OutgoingAddress.Port),
+			"page_tracking":     strconv.FormatBool(serviceLink.PageTracking),
+			"access_list":       string(accessList),
+			"geo_fence":         string(geoFence),
+			"rate_limits":       string(rateLimits),
+			"challenge":         string(challenge),
+			"waf":               string(waf),
+			"block_lists":       string(blockLists),
+			"crawler_policy":    string(crawlerPolicy),
 		}
 
-		err := db.basicDB.SetHash(ctx, "ServiceLink:"+serviceLink.ID, serviceHash)
+		err = db.basicDB.SetHash(ctx, "ServiceLink:"+serviceLink.ID, serviceHash)
 		if err != nil {
 			return errors.New("Unable to set service link hash for " + serviceLink.ID + ": " + err.Error())
 		}
@@ -627,3 +1723,304 @@ func (db DB) setServiceLinks(ctx context.Context, serviceLinks ServiceLinks) err
 
 	return nil
 }
+
+func (db DB) getScannerRules(ctx context.Context) ([]ScannerRule, error) {
+	return getJSONList[ScannerRule](ctx, db, "ScannerRules")
+}
+
+func (db DB) setScannerRules(ctx context.Context, rules []ScannerRule) error {
+	return setJSONList(ctx, db, "ScannerRules", rules)
+}
+
+// Reads a list of JSON encoded values, skipping any that can't be decoded
+func getJSONList[ValueType any](ctx context.Context, db DB, key string) ([]ValueType, error) {
+	valuesRaw, err := db.basicDB.GetList(ctx, key)
+	if err != nil {
+		return nil, errors.New("Unable to get list \"" + key + "\": " + err.Error())
+	}
+	values := make([]ValueType, 0, len(valuesRaw))
+	for _, valueRaw := range valuesRaw {
+		var value ValueType
+		err := json.Unmarshal([]byte(valueRaw), &value)
+		if err != nil {
+			Printing.PrintErrStr("Could not read value from list \"" + key + "\": " + err.Error())
+			continue
+		}
+		values = append(values, value)
+	}
+	slices.Reverse(values) // SetList pushes to the head, restore the original order
+	return values, nil
+}
+
+// Replaces a list with the JSON encoding of values
+func setJSONList[ValueType any](ctx context.Context, db DB, key string, values []ValueType) error {
+	valuesRaw := make([]string, len(values))
+	for i, value := range values {
+		valueRaw, err := json.Marshal(value)
+		if err != nil {
+			return errors.New("Unable to encode value for list \"" + key + "\": " + err.Error())
+		}
+		valuesRaw[i] = string(valueRaw)
+	}
+	return db.basicDB.SetList(ctx, key, valuesRaw)
+}
+
+func (db DB) recordSuspiciousActivity(ctx context.Context, ip string, serviceID string, rules []ScannerRule) error {
+	now := time.Now()
+	expiration := now.Add(suspicionWindow)
+	clientKey := "Suspicious:" + ip
+	client, err := db.basicDB.GetHash(ctx, clientKey)
+	if err != nil {
+		return errors.New("Unable to get suspicious client: " + err.Error())
+	}
+
+	score, _ := strconv.ParseFloat(client["score"], 64)
+	lastSeen, err := strconv.ParseInt(client["last_seen"], 10, 64)
+	if err == nil {
+		score = decaySuspicionScore(score, time.Unix(lastSeen, 0), now)
+	}
+	for _, rule := range rules {
+		score += float64(rule.Score)
+		err := db.basicDB.IncrementHashField(ctx, clientKey+":rules", rule.ID, 1, expiration)
+		if err != nil {
+			return errors.New("Unable to record suspicious client rule: " + err.Error())
+		}
+	}
+	err = db.basicDB.IncrementHashField(ctx, clientKey+":services", serviceID, len(rules), expiration)
+	if err != nil {
+		return errors.New("Unable to record suspicious client service: " + err.Error())
+	}
+
+	firstSeen := client["first_seen"]
+	if firstSeen == "" {
+		firstSeen = strconv.FormatInt(now.Unix(), 10)
+	}
+	err = db.basicDB.SetHash(ctx, clientKey, map[string]string{
+		"score":      strconv.FormatFloat(score, 'f', -1, 64),
+		"first_seen": firstSeen,
+		"last_seen":  strconv.FormatInt(now.Unix(), 10),
+	})
+	if err != nil {
+		return errors.New("Unable to save suspicious client: " + err.Error())
+	}
+	err = db.basicDB.SetExpiration(ctx, clientKey, suspicionWindow)
+	if err != nil {
+		return errors.New("Unable to set suspicious client expiration: " + err.Error())
+	}
+	// Indexed by last seen so clients that aged out can be dropped
+	return db.basicDB.AddToSortedSet(ctx, "SuspiciousClients", ip, float64(now.Unix()))
+}
+
+func (db DB) getSuspiciousClients(ctx context.Context) ([]SuspiciousClient, error) {
+	now := time.Now()
+	cutoff := strconv.FormatInt(now.Add(-suspicionWindow).Unix(), 10)
+	err := db.basicDB.RemoveFromSortedSetByScore(ctx, "SuspiciousClients", "-inf", "("+cutoff)
+	if err != nil {
+		return nil, errors.New("Unable to clean up suspicious clients: " + err.Error())
+	}
+	ips, err := db.basicDB.GetSortedSetByScore(ctx, "SuspiciousClients", cutoff, "+inf")
+	if err != nil {
+		return nil, errors.New("Unable to get suspicious clients: " + err.Error())
+	}
+
+	clients := make([]SuspiciousClient, 0, len(ips))
+	for _, ip := range ips {
+		clientKey := "Suspicious:" + ip
+		client, err := db.basicDB.GetHash(ctx, clientKey)
+		if err != nil || len(client) == 0 {
+			continue
+		}
+		score, _ := strconv.ParseFloat(client["score"], 64)
+		firstSeen, _ := strconv.ParseInt(client["first_seen"], 10, 64)
+		lastSeen, _ := strconv.ParseInt(client["last_seen"], 10, 64)
+		clients = append(clients, SuspiciousClient{
+			IP:        ip,
+			Score:     decaySuspicionScore(score, time.Unix(lastSeen, 0), now),
+			Rules:     db.getCountHash(ctx, clientKey+":rules"),
+			Services:  db.getCountHash(ctx, clientKey+":services"),
+			FirstSeen: time.Unix(firstSeen, 0),
+			LastSeen:  time.Unix(lastSeen, 0),
+		})
+	}
+	return clients, nil
+}
+
+func (db DB) getBanRules(ctx context.Context) ([]BanRule, error) {
+	return getJSONList[BanRule](ctx, db, "BanRules")
+}
+
+func (db DB) setBanRules(ctx context.Context, rules []BanRule) error {
+	return setJSONList(ctx, db, "BanRules", rules)
+}
+
+// Counts an occurrence for a rule and IP in the current fixed window, returning the window's total
+func (db DB) incrementBanCounter(ctx context.Context, ruleID string, ip string, window time.Duration) (int, error) {
+	windowStart := time.Now().Truncate(window)
+	counterKey := "BanCounter:" + ruleID + ":" + ip + ":" + strconv.FormatInt(windowStart.Unix(), 10)
+	err := db.basicDB.IncrementKey(ctx, counterKey, 1, windowStart.Add(window))
+	if err != nil {
+		return 0, errors.New("Unable to increment ban counter: " + err.Error())
+	}
+	countRaw, err := db.basicDB.Get(ctx, counterKey)
+	if err != nil {
+		return 0, errors.New("Unable to get ban counter: " + err.Error())
+	}
+	return strconv.Atoi(countRaw)
+}
+
+// A duration of 0 bans permanently
+func (db DB) addBan(ctx context.Context, ban Ban, duration time.Duration) error {
+	now := time.Now()
+	banKey := "Ban:" + ban.IP
+	expires := ""
+	expiresScore := math.Inf(1)
+	if duration > 0 {
+		expires = strconv.FormatInt(now.Add(duration).Unix(), 10)
+		expiresScore = float64(now.Add(duration).Unix())
+	}
+
+	err := db.basicDB.Delete(ctx, banKey) // Clear any previous expiration
+	if err != nil {
+		return errors.New("Unable to replace ban: " + err.Error())
+	}
+	err = db.basicDB.SetHash(ctx, banKey, map[string]string{
+		"reason":   ban.Reason,
+		"rule_id":  ban.RuleID,
+		"created":  strconv.FormatInt(now.Unix(), 10),
+		"expires":  expires,
+		"attempts": "0",
+	})
+	if err != nil {
+		return errors.New("Unable to save ban: " + err.Error())
+	}
+	if duration > 0 {
+		err = db.basicDB.SetExpiration(ctx, banKey, duration)
+		if err != nil {
+			return errors.New("Unable to set ban expiration: " + err.Error())
+		}
+	}
+	return db.basicDB.AddToSortedSet(ctx, "Bans", ban.IP, expiresScore)
+}
+
+func (db DB) removeBan(ctx context.Context, ip string) error {
+	err := db.basicDB.Delete(ctx, "Ban:"+ip)
+	if err != nil {
+		return errors.New("Unable to remove ban: " + err.Error())
+	}
+	return db.basicDB.RemoveFromSortedSet(ctx, "Bans", ip)
+}
+
+// Returns nil if the IP isn't banned
+func (db DB) getBan(ctx context.Context, ip string) (*Ban, error) {
+	banHash, err := db.basicDB.GetHash(ctx, "Ban:"+ip)
+	if err != nil {
+		return nil, errors.New("Unable to get ban: " + err.Error())
+	}
+	if len(banHash) == 0 {
+		return nil, nil
+	}
+	created, _ := strconv.ParseInt(banHash["created"], 10, 64)
+	attempts, _ := strconv.Atoi(banHash["attempts"])
+	ban := Ban{
+		IP:       ip,
+		Reason:   banHash["reason"],
+		RuleID:   banHash["rule_id"],
+		Created:  time.Unix(created, 0),
+		Attempts: attempts,
+	}
+	if expires, err := strconv.ParseInt(banHash["expires"], 10, 64); err == nil {
+		expiresTime := time.Unix(expires, 0)
+		ban.Expires = &expiresTime
+	}
+	return &ban, nil
+}
+
+func (db DB) getBans(ctx context.Context) ([]Ban, error) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	err := db.basicDB.RemoveFromSortedSetByScore(ctx, "Bans", "-inf", "("+now)
+	if err != nil {
+		return nil, errors.New("Unable to clean up bans: " + err.Error())
+	}
+	ips, err := db.basicDB.GetSortedSetByScore(ctx, "Bans", now, "+inf")
+	if err != nil {
+		return nil, errors.New("Unable to get bans: " + err.Error())
+	}
+	bans := make([]Ban, 0, len(ips))
+	for _, ip := range ips {
+		ban, err := db.getBan(ctx, ip)
+		if err != nil || ban == nil {
+			continue
+		}
+		bans = append(bans, *ban)
+	}
+	return bans, nil
+}
+
+func (db DB) recordBanAttempt(ctx context.Context, ban Ban) error {
+	expiration := time.Time{}
+	if ban.Expires != nil { // Keeps a ban that just expired from being recreated without an expiration
+		expiration = *ban.Expires
+	}
+	return db.basicDB.IncrementHashField(ctx, "Ban:"+ban.IP, "attempts", 1, expiration)
+}
+
+// Refills and takes from a token bucket atomically, using Valkey's clock so every instance agrees.
+// Returns whether a token was taken, the tokens left, and milliseconds until the next token and a full bucket.
+var rateLimitScript = valkey.NewLuaScript(`
+local capacity = tonumber(ARGV[1])
+local refillPerMillisecond = tonumber(ARGV[2]) / 1000
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "updated")
+local tokens = tonumber(bucket[1]) or capacity
+local updated = tonumber(bucket[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * refillPerMillisecond)
+local allowed = 0
+local retryAfter = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retryAfter = math.ceil((1 - tokens) / refillPerMillisecond)
+end
+local reset = math.ceil((capacity - tokens) / refillPerMillisecond)
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "updated", now)
+redis.call("PEXPIRE", KEYS[1], reset + 1000)
+return {allowed, math.floor(tokens), retryAfter, reset}
+`)
+
+func (db DB) takeRateLimitToken(ctx context.Context, key string, capacity int, refillPerSecond float64) (RateLimitResult, error) {
+	values, err := db.basicDB.RunScript(ctx, rateLimitScript, []string{"RateLimit:" + key}, []string{strconv.Itoa(capacity), strconv.FormatFloat(refillPerSecond, 'f', -1, 64)})
+	if err != nil {
+		return RateLimitResult{}, errors.New("Unable to take rate limit token: " + err.Error())
+	}
+	if len(values) != 4 {
+		return RateLimitResult{}, errors.New("Unexpected rate limit script result")
+	}
+	return RateLimitResult{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		RetryAfter: time.Duration(values[2]) * time.Millisecond,
+		Reset:      time.Duration(values[3]) * time.Millisecond,
+	}, nil
+}
+
+// Custom WAF rules in SecLang, empty if none were saved
+func (db DB) getWAFRules(ctx context.Context) (string, error) {
+	rules, err := db.basicDB.Get(ctx, "WAFRules")
+	if valkey.IsValkeyNil(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", errors.New("Unable to get WAF rules: " + err.Error())
+	}
+	return rules, nil
+}
+
+func (db DB) setWAFRules(ctx context.Context, rules string) error {
+	err := db.basicDB.Set(ctx, "WAFRules", rules, 0)
+	if err != nil {
+		return errors.New("Unable to set WAF rules: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+const (
+	maximumEventsPerRequest    = 100
+	maximumEventProperties     = 10
+	maximumEventFieldLength    = 64
+	eventPropertySeparator     = "|"
+	maximumEventPropertyValues = 1000 // Distinct event/property/value combinations per bucket
+)
+
+// A business event reported by a service, ex. a sign up or a failed job
+type CustomEvent struct {
+	Name       string            `json:"name"`
+	Value      *float64          `json:"value,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+}
+
+type CustomEventRequest struct {
+	Service string        `json:"service"` // Service ID or one of its incoming addresses
+	Events  []CustomEvent `json:"events"`
+}
+
+// Totals for one event name within a bucket
+type EventSummary struct {
+	Count      int                       `json:"count"`
+	Value      float64                   `json:"value"`      // Sum of all reported values
+	Properties map[string]map[string]int `json:"properties"` // Property name → property value → count
+}
+
+func eventsSet(serviceLinks *ServiceLinks, db AdvancedDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		apiKey, err := db.getAPIKey(r.Context(), requestAPIKey(r))
+		if err != nil || apiKey == nil {
+			Printing.PrintErrStr("Could not verify API key for custom events")
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		eventRequest, err := requestReceived[CustomEventRequest](r)
+		if err != nil {
+			Printing.PrintErrStr("Could not read custom events: " + err.Error())
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		service, err := serviceLinks.GetServiceByID(eventRequest.Service)
+		if err != nil {
+			service, err = serviceLinks.GetServiceFromIncomingURL(eventRequest.Service)
+		}
+		if err != nil || !apiKey.Services.Includes(service.ID) { // Keys limited to other services shouldn't learn this one exists
+			Printing.PrintErrStr("Could not find service \"" + eventRequest.Service + "\" for custom events")
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		if len(eventRequest.Events) == 0 || len(eventRequest.Events) > maximumEventsPerRequest {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		for _, event := range eventRequest.Events {
+			if err := event.validate(); err != nil {
+				Printing.PrintErrStr("Invalid custom event: " + err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, err.Error())
+				return
+			}
+		}
+
+		// Use background context with timeout so a disconnecting client doesn't lose half of its events
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, event := range eventRequest.Events {
+			err := db.recordCustomEvent(ctx, service.ID, event)
+			if err != nil {
+				Printing.PrintErrStr("Could not record custom event: " + err.Error())
+				requestRespondCode(w, http.StatusInternalServerError)
+				return
+			}
+		}
+		requestRespond(w, len(eventRequest.Events))
+	}
+}
+
+func (event CustomEvent) validate() error {
+	if !validEventField(event.Name) {
+		return errors.New("event names must be 1-64 characters without \"" + eventPropertySeparator + "\"")
+	}
+	if event.Value != nil && (math.IsNaN(*event.Value) || math.IsInf(*event.Value, 0)) {
+		return errors.New("event \"" + event.Name + "\" has a non-finite value")
+	}
+	if len(event.Properties) > maximumEventProperties {
+		return errors.New("event \"" + event.Name + "\" has too many properties")
+	}
+	for key, value := range event.Properties {
+		if !validEventField(key) || len(value) > maximumEventFieldLength {
+			return errors.New("event \"" + event.Name + "\" has an invalid property \"" + key + "\"")
+		}
+	}
+	return nil
+}
+
+func validEventField(field string) bool {
+	return field != "" && len(field) <= maximumEventFieldLength && !strings.Contains(field, eventPropertySeparator)
+}
+
+// Hash field for counting an event's property value
+func eventPropertyField(eventName string, key string, value string) string {
+	return eventName + eventPropertySeparator + key + eventPropertySeparator + value
+}
+
+// Combines the bucket's event hashes into summaries keyed by event name
+func newEventSummaries(counts map[string]int, values map[string]float64, properties map[string]int) map[string]EventSummary {
+	events := make(map[string]EventSummary, len(counts))
+	for name, count := range counts {
+		events[name] = EventSummary{Count: count, Value: values[name], Properties: map[string]map[string]int{}}
+	}
+	for field, count := range properties {
+		parts := strings.SplitN(field, eventPropertySeparator, 3)
+		if len(parts) != 3 {
+			continue
+		}
+		event, ok := events[parts[0]]
+		if !ok {
+			continue
+		}
+		if event.Properties[parts[1]] == nil {
+			event.Properties[parts[1]] = map[string]int{}
+		}
+		event.Properties[parts[1]][parts[2]] = count
+	}
+	return events
+}
+
+// Reads an API key from the X-API-Key header, or the api-key query parameter
+func requestAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("api-key")
+}
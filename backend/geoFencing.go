@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Analytics reason for requests refused by a service's geo-fence
+const blockedGeoFence = "geo_fence"
+
+type GeoFenceMode string
+
+const (
+	GeoFenceModeOff   GeoFenceMode = ""
+	GeoFenceModeAllow GeoFenceMode = "allow" // Only the listed countries may reach the service
+	GeoFenceModeBlock GeoFenceMode = "block" // The listed countries may not reach the service
+)
+
+type GeoFence struct {
+	Mode         GeoFenceMode   `json:"mode"`
+	Countries    []string       `json:"countries"`     // ISO 3166-1 alpha-2 codes, ex. "US"
+	AllowUnknown bool           `json:"allow_unknown"` // Whether requests without a known country get through
+	Denial       DenialResponse `json:"denial"`
+}
+
+// Header an edge provider puts the client's country in, set by COUNTRY_HEADER. Empty to only use the GeoIP database.
+var countryHeader = "CF-IPCountry"
+
+func loadCountryHeader() {
+	if rawHeader, ok := os.LookupEnv("COUNTRY_HEADER"); ok {
+		countryHeader = strings.TrimSpace(rawHeader)
+	}
+}
+
+// A range of addresses in the local GeoIP database
+type geoIPRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+}
+
+// Sorted by start address, loaded from GEOIP_DATABASE
+var geoIPRanges []geoIPRange
+
+func (geoFence GeoFence) validate() error {
+	switch geoFence.Mode {
+	case GeoFenceModeOff, GeoFenceModeAllow, GeoFenceModeBlock:
+	default:
+		return errors.New("unknown geo-fence mode \"" + string(geoFence.Mode) + "\"")
+	}
+	for _, country := range geoFence.Countries {
+		if len(country) != 2 {
+			return errors.New("\"" + country + "\" isn't a two letter country code")
+		}
+	}
+	return geoFence.Denial.validate()
+}
+
+// Checks if a request from the country may reach the service
+func (geoFence GeoFence) Allows(country string) bool {
+	if geoFence.Mode == GeoFenceModeOff {
+		return true
+	}
+	if !knownCountry(country) {
+		return geoFence.AllowUnknown
+	}
+	listed := slices.ContainsFunc(geoFence.Countries, func(listedCountry string) bool {
+		return strings.EqualFold(listedCountry, country)
+	})
+	return listed == (geoFence.Mode == GeoFenceModeAllow)
+}
+
+// Edge providers use XX for addresses they can't place
+func knownCountry(country string) bool {
+	return country != "" && !strings.EqualFold(country, "XX")
+}
+
+// Reads the CSV at GEOIP_DATABASE, if set. Each row is either "network,country" with an IP or CIDR network,
+// or "start IP,end IP,country" like the free DB-IP and IP2Location country databases.
+func loadGeoIPDatabase() {
+	path := os.Getenv("GEOIP_DATABASE")
+	if path == "" {
+		return
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		Printing.PrintErrStr("Could not open GeoIP database, countries will only come from request headers: " + err.Error())
+		return
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	reader.Comment = '#'
+	var ranges []geoIPRange
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			Printing.PrintErrStr("Could not read GeoIP database, countries will only come from request headers: " + err.Error())
+			return
+		}
+		addressRange, ok := parseGeoIPRow(row)
+		if ok { // Skips headers and comments
+			ranges = append(ranges, addressRange)
+		}
+	}
+	slices.SortFunc(ranges, func(a geoIPRange, b geoIPRange) int { return a.start.Compare(b.start) })
+	geoIPRanges = ranges
+	Printing.Println("Loaded " + strconv.Itoa(len(geoIPRanges)) + " GeoIP ranges")
+}
+
+func parseGeoIPRow(row []string) (geoIPRange, bool) {
+	switch len(row) {
+	case 2:
+		prefix, err := parseAccessListEntry(row[0])
+		if err != nil {
+			return geoIPRange{}, false
+		}
+		return geoIPRange{start: prefix.Addr(), end: lastAddress(prefix), country: strings.ToUpper(strings.TrimSpace(row[1]))}, true
+	case 3:
+		start, startErr := netip.ParseAddr(strings.TrimSpace(row[0]))
+		end, endErr := netip.ParseAddr(strings.TrimSpace(row[1]))
+		if startErr != nil || endErr != nil {
+			return geoIPRange{}, false
+		}
+		return geoIPRange{start: start.Unmap(), end: end.Unmap(), country: strings.ToUpper(strings.TrimSpace(row[2]))}, true
+	}
+	return geoIPRange{}, false
+}
+
+// The highest address within the prefix
+func lastAddress(prefix netip.Prefix) netip.Addr {
+	address := prefix.Masked().Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(address)*8; bit++ {
+		address[bit/8] |= 0x80 >> (bit % 8)
+	}
+	last, _ := netip.AddrFromSlice(address)
+	return last
+}
+
+// Looks up the IP in the local GeoIP database, returning an empty string if it isn't covered
+func geoIPCountry(ip string) string {
+	address, err := netip.ParseAddr(ip)
+	if err != nil || len(geoIPRanges) == 0 {
+		return ""
+	}
+	address = address.Unmap()
+	// Find the last range starting at or before the address
+	i, found := slices.BinarySearchFunc(geoIPRanges, address, func(addressRange geoIPRange, target netip.Addr) int {
+		return addressRange.start.Compare(target)
+	})
+	if !found {
+		i--
+	}
+	if i < 0 || geoIPRanges[i].end.Compare(address) < 0 {
+		return ""
+	}
+	return geoIPRanges[i].country
+}
@@ -1,55 +1,92 @@
 package main
 
 import (
-	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"net/http"
-	"os"
+	"slices"
 	"time"
 
-	"github.com/benjaminRoberts01375/CheckBag/backend/logging"
-
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type Claims struct {
+	Username string       `json:"username,omitempty"`
+	Role     UserRole     `json:"role,omitempty"`
+	Services ServiceScope `json:"services,omitempty"`
+	Client   string       `json:"client,omitempty"` // IP a browser challenge was solved from
 	jwt.RegisteredClaims
 }
 
+// Subjects keep tokens signed with the same secret from being used for each other
+const (
+	sessionTokenSubject     = "Session Token"
+	browserChallengeSubject = "Browser Challenge"
+	twoFactorSubject        = "Two-Factor Pending"
+)
+
+// How long a user has to enter their two-factor code after their password
+const twoFactorLifetime = 5 * time.Minute
+
 // TimeFunc allows mocking time in tests
 type TimeFunc func() time.Time
 
 type JWTService struct {
-	secret        []byte
+	keys          *JWTKeyring
 	timeFunc      TimeFunc
 	cookieName    string
 	loginDuration time.Duration
+	db            AdvancedDB // Where sessions are tracked, so they can be listed and revoked
 }
 
-func NewJWTService(secret string, timeGenerator TimeFunc) JWTService {
+const loginDuration = time.Hour*24*6 + time.Hour*12 // 6.5 days
+
+func NewJWTService(keys *JWTKeyring, timeGenerator TimeFunc, db AdvancedDB) JWTService {
 	return JWTService{
-		secret:        []byte(secret),
+		keys:          keys,
 		timeFunc:      timeGenerator,
 		cookieName:    "checkbag-session-token",
-		loginDuration: time.Hour*24*6 + time.Hour*12, // 6.5 days
+		loginDuration: loginDuration,
+		db:            db,
 	}
 }
 
-func (s *JWTService) GenerateJWT(duration time.Duration) (string, error) {
+// Signs with the current key, naming it in the header so the right key verifies it after rotation
+func (s *JWTService) signClaims(claims Claims) (string, error) {
+	key := s.keys.signingKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Secret)
+}
+
+func (s *JWTService) GenerateJWT(user User, sessionID string, duration time.Duration) (string, error) {
 	now := s.timeFunc()
-	claims := Claims{}
+	claims := Claims{Username: user.Username, Role: user.Role, Services: user.Services}
+	claims.ID = sessionID
 	claims.ExpiresAt = jwt.NewNumericDate(now.Add(duration))
 	claims.IssuedAt = jwt.NewNumericDate(now)
 	claims.NotBefore = jwt.NewNumericDate(now)
 	claims.Issuer = "Backend API"
-	claims.Subject = "Session Token"
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(s.secret)
+	claims.Subject = sessionTokenSubject
+	return s.signClaims(claims)
 }
 
 func (s *JWTService) ValidateJWT(tokenString string) (*Claims, bool) {
+	claims, ok := s.parseJWT(tokenString)
+	return claims, ok && claims.Subject == sessionTokenSubject
+}
+
+func (s *JWTService) parseJWT(tokenString string) (*Claims, bool) {
 	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (any, error) {
-		return s.secret, nil
-	})
+		keyID, _ := token.Header["kid"].(string)
+		secret, ok := s.keys.verificationKey(keyID)
+		if !ok {
+			return nil, errors.New("unknown or expired signing key " + keyID)
+		}
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 	if err != nil {
 		return nil, false
 	}
@@ -60,60 +97,155 @@ func (s *JWTService) ValidateJWT(tokenString string) (*Claims, bool) {
 	return claims, claims.ExpiresAt.After(s.timeFunc())
 }
 
-func (s *JWTService) ReadAndValidateJWT(r *http.Request) error {
+// Reads the session from the request, making sure its user has at least the required role
+func (s *JWTService) ReadAndValidateJWT(r *http.Request, role UserRole) (*Claims, error) {
 	cookie, err := r.Cookie(s.cookieName)
 	if err != nil {
-		return err
+		return nil, err
 	} else if cookie.Value == "" {
-		return errors.New("JWT is empty")
+		return nil, errors.New("JWT is empty")
 	}
-	_, ok := s.ValidateJWT(cookie.Value)
+	claims, ok := s.ValidateJWT(cookie.Value)
 	if !ok {
-		return errors.New("JWT is invalid")
+		return nil, errors.New("JWT is invalid")
 	}
-	return nil
-}
-
-func loadJWTSecret(db AdvancedDB) JWTService {
-	// Check if the JWT secret was passed in as an environment variable
-	jwtSecret := os.Getenv("JWT_SECRET")
-	if jwtSecret != "" {
-		logging.Println("JWT provided as an environment variable")
-		return NewJWTService(jwtSecret, time.Now)
+	if !safeMethod(r.Method) && !s.verifySignature(csrfTokenData(claims.ID), r.Header.Get(csrfHeaderName)) {
+		return nil, errors.New("missing or incorrect " + csrfHeaderName + " header")
 	}
-
-	// Read the JWT secret from database
-	jwtSecret, err := db.GetJWTSecret(context.Background())
-	if err == nil && jwtSecret != "" {
-		logging.Println("JWT secret provided in database")
-		return NewJWTService(jwtSecret, time.Now)
+	session, err := s.db.getSession(r.Context(), claims.ID)
+	if err != nil {
+		return nil, err
 	}
+	if session == nil || session.Username != claims.Username {
+		return nil, errors.New("session for " + claims.Username + " was signed out or revoked")
+	}
+	now := s.timeFunc()
+	if now.Sub(session.LastSeen) > sessionTouchInterval {
+		s.db.touchSession(r.Context(), session.ID, now)
+	}
+	if !claims.Role.allows(role) {
+		return nil, errors.New(claims.Username + " needs the " + string(role) + " role")
+	}
+	return claims, nil
+}
 
-	// Generate a new JWT secret
-	logging.Println("Generating JWT secret and storing in database")
-	newJWT := generateRandomString(15)
-	err = db.SetJWTSecret(context.Background(), newJWT)
+// Like ReadAndValidateJWT, but also refuses users limited to some services, for settings shared by every service
+func (s *JWTService) ReadAndValidateUnscopedJWT(r *http.Request, role UserRole) (*Claims, error) {
+	claims, err := s.ReadAndValidateJWT(r, role)
 	if err != nil {
-		panic("Failed to save JWT secret to database: " + err.Error())
+		return nil, err
+	}
+	if !claims.Services.unscoped() {
+		return nil, errors.New(claims.Username + " is limited to some services")
 	}
-	return NewJWTService(newJWT, time.Now)
+	return claims, nil
+}
+
+func loadJWTService(db AdvancedDB) JWTService {
+	return NewJWTService(loadJWTKeyring(db, loginDuration), time.Now, db) // Retired keys verify for as long as their sessions last
 }
 
-func (s *JWTService) setJWT(w http.ResponseWriter) error {
+// Starts a session for the user, remembering the device and IP it was started from
+func (s *JWTService) setJWT(w http.ResponseWriter, r *http.Request, user User) error {
+	now := s.timeFunc()
+	session := Session{
+		ID:       newSessionID(),
+		Username: user.Username,
+		Created:  now,
+		LastSeen: now,
+		IP:       requestClientIP(r),
+		Device:   r.UserAgent(),
+	}
+	err := s.db.setSession(r.Context(), session, s.loginDuration)
+	if err != nil {
+		return err
+	}
 	// Generate a new JWT
-	token, err := s.GenerateJWT(s.loginDuration)
+	token, err := s.GenerateJWT(user, session.ID, s.loginDuration)
 	if err != nil {
 		return err
 	}
 
-	http.SetCookie(w, &http.Cookie{
-		Name:     s.cookieName,
-		Value:    token,
-		HttpOnly: false,
-		Secure:   false,
-		SameSite: http.SameSiteStrictMode,
-		Expires:  time.Now().Add(s.loginDuration),
-		Path:     "/",
+	expires := time.Now().Add(s.loginDuration)
+	http.SetCookie(w, newCookie(r, s.cookieName, token, expires, true))
+	// Other sites can't read this, so sending it back in a header proves the request came from the dashboard
+	http.SetCookie(w, newCookie(r, csrfCookieName, s.sign(csrfTokenData(session.ID)), expires, false))
+	audit(r, s.db, user.Username, AuditSignIn, user.Username, nil, session)
+	return nil
+}
+
+func (s *JWTService) clearJWT(w http.ResponseWriter) {
+	http.SetCookie(w, expiredCookie(s.cookieName))
+	http.SetCookie(w, expiredCookie(csrfCookieName))
+}
+
+// What a session's CSRF token signs, so the token only works alongside that session's cookie
+func csrfTokenData(sessionID string) string {
+	return "csrf:" + sessionID
+}
+
+// Proof that a browser solved a service's challenge, only good from the IP that solved it
+func (s *JWTService) GenerateChallengeJWT(serviceID string, client string, duration time.Duration) (string, error) {
+	now := s.timeFunc()
+	claims := Claims{Client: client}
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(duration))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.Issuer = "Backend API"
+	claims.Subject = browserChallengeSubject
+	claims.Audience = jwt.ClaimStrings{serviceID}
+	return s.signClaims(claims)
+}
+
+func (s *JWTService) ValidateChallengeJWT(tokenString string, serviceID string, client string) bool {
+	claims, ok := s.parseJWT(tokenString)
+	return ok && claims.Subject == browserChallengeSubject && slices.Contains(claims.Audience, serviceID) && claims.Client == client
+}
+
+// HMAC of the data with the current signing key, for values that don't need to be full JWTs
+func (s *JWTService) sign(data string) string {
+	return hmacHex(s.keys.signingKey().Secret, data)
+}
+
+// Checks a signature from sign, which may have been made with a key that has since been rotated
+func (s *JWTService) verifySignature(data string, signature string) bool {
+	return slices.ContainsFunc(s.keys.verificationKeys(), func(secret []byte) bool {
+		return hmac.Equal([]byte(hmacHex(secret, data)), []byte(signature))
 	})
+}
+
+func hmacHex(secret []byte, data string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Proof that a user got their password right, but still needs their two-factor code
+func (s *JWTService) GenerateTwoFactorJWT(username string) (string, error) {
+	now := s.timeFunc()
+	claims := Claims{Username: username}
+	claims.ExpiresAt = jwt.NewNumericDate(now.Add(twoFactorLifetime))
+	claims.IssuedAt = jwt.NewNumericDate(now)
+	claims.NotBefore = jwt.NewNumericDate(now)
+	claims.Issuer = "Backend API"
+	claims.Subject = twoFactorSubject
+	return s.signClaims(claims)
+}
+
+// Returns the username waiting on a two-factor code
+func (s *JWTService) ValidateTwoFactorJWT(tokenString string) (string, bool) {
+	claims, ok := s.parseJWT(tokenString)
+	if !ok || claims.Subject != twoFactorSubject {
+		return "", false
+	}
+	return claims.Username, true
+}
+
+func (s *JWTService) setTwoFactorJWT(w http.ResponseWriter, r *http.Request, username string) error {
+	token, err := s.GenerateTwoFactorJWT(username)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, newCookie(r, twoFactorCookieName, token, time.Now().Add(twoFactorLifetime), true))
 	return nil
 }
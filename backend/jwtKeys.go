@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+const (
+	defaultJWTKeyRotation = 30 * 24 * time.Hour
+	jwtKeyCheckInterval   = time.Hour        // How often keys are checked for scheduled rotation and reloaded
+	jwtKeyReloadInterval  = 10 * time.Second // Unknown key IDs reload the keyring, but no more often than this
+	jwtKeySize            = 32
+)
+
+// Key ID given to JWT_SECRET, which is never rotated
+const staticJWTKeyID = "env"
+
+type JWTKey struct {
+	ID      string     `json:"id"`
+	Secret  []byte     `json:"secret,omitempty"`
+	Created time.Time  `json:"created"`
+	Retired *time.Time `json:"retired,omitempty"` // When a newer key took over. Retired keys still verify until the grace period ends.
+}
+
+type JWTKeyRotation struct {
+	Revoke bool `json:"revoke"` // Drops the old keys right away, signing everyone out
+}
+
+// Signing keys shared by every CheckBag instance through Valkey, newest first. The newest key signs, and retired keys
+// keep verifying tokens they signed for the grace period.
+type JWTKeyring struct {
+	mutex       sync.RWMutex
+	keys        []JWTKey
+	db          AdvancedDB
+	rotation    time.Duration // 0 to only rotate on demand
+	gracePeriod time.Duration
+	reloaded    time.Time
+	static      bool // Set from JWT_SECRET, which can't be rotated
+}
+
+func newJWTKey() JWTKey {
+	secret := make([]byte, jwtKeySize)
+	rand.Read(secret)
+	return JWTKey{ID: generateRandomString(12), Secret: secret, Created: time.Now()}
+}
+
+// Loads the keyring, creating its first key if needed. JWT_KEY_ROTATION sets the days between rotations.
+func loadJWTKeyring(db AdvancedDB, gracePeriod time.Duration) *JWTKeyring {
+	// Check if the JWT secret was passed in as an environment variable
+	if jwtSecret := os.Getenv("JWT_SECRET"); jwtSecret != "" {
+		Printing.Println("JWT provided as an environment variable, signing keys won't be rotated")
+		return &JWTKeyring{keys: []JWTKey{{ID: staticJWTKeyID, Secret: []byte(jwtSecret)}}, static: true}
+	}
+
+	keyring := &JWTKeyring{db: db, rotation: defaultJWTKeyRotation, gracePeriod: gracePeriod}
+	if rawRotation := os.Getenv("JWT_KEY_ROTATION"); rawRotation != "" {
+		days, err := strconv.Atoi(rawRotation)
+		if err != nil || days < 0 {
+			Printing.PrintErrStr("Invalid JWT_KEY_ROTATION \"" + rawRotation + "\", rotating every " + strconv.Itoa(int(defaultJWTKeyRotation.Hours()/24)) + " days")
+		} else {
+			keyring.rotation = time.Duration(days) * 24 * time.Hour
+		}
+	}
+	ctx := context.Background()
+	err := keyring.reload(ctx)
+	if err != nil {
+		panic("Failed to get JWT signing keys from database: " + err.Error())
+	}
+	if len(keyring.keys) == 0 {
+		Printing.Println("Generating JWT signing key and storing in database")
+		_, err = keyring.Rotate(ctx, false)
+		if err != nil {
+			panic("Failed to save JWT signing key to database: " + err.Error())
+		}
+	}
+	go func() {
+		for range time.Tick(jwtKeyCheckInterval) {
+			keyring.maintain()
+		}
+	}()
+	return keyring
+}
+
+// Picks up keys rotated by other instances, and rotates when the signing key is old enough
+func (keyring *JWTKeyring) maintain() {
+	ctx := context.Background()
+	err := keyring.reload(ctx)
+	if err != nil {
+		Printing.PrintErrStr("Could not reload JWT signing keys: " + err.Error())
+		return
+	}
+	if keyring.rotation == 0 || time.Since(keyring.signingKey().Created) < keyring.rotation {
+		return
+	}
+	_, err = keyring.Rotate(ctx, false)
+	if err != nil {
+		Printing.PrintErrStr("Could not rotate JWT signing key: " + err.Error())
+		return
+	}
+	Printing.Println("Rotated JWT signing key")
+}
+
+func (keyring *JWTKeyring) reload(ctx context.Context) error {
+	keys, err := keyring.db.getJWTKeys(ctx)
+	if err != nil {
+		return err
+	}
+	keyring.mutex.Lock()
+	defer keyring.mutex.Unlock()
+	keyring.reloaded = time.Now()
+	if len(keys) != 0 {
+		keyring.keys = keys
+	}
+	return nil
+}
+
+// Replaces the signing key, retiring the current one. Revoking drops every other key instead of letting them verify
+// for the grace period.
+func (keyring *JWTKeyring) Rotate(ctx context.Context, revoke bool) (JWTKey, error) {
+	if keyring.static {
+		return JWTKey{}, errors.New("keys from JWT_SECRET can't be rotated")
+	}
+	err := keyring.reload(ctx) // Another instance may have rotated already
+	if err != nil {
+		return JWTKey{}, err
+	}
+	keyring.mutex.Lock()
+	defer keyring.mutex.Unlock()
+	now := time.Now()
+	key := newJWTKey()
+	keys := []JWTKey{key}
+	if !revoke {
+		for _, oldKey := range keyring.keys {
+			if oldKey.Retired == nil {
+				oldKey.Retired = &now
+			}
+			if now.Sub(*oldKey.Retired) < keyring.gracePeriod {
+				keys = append(keys, oldKey)
+			}
+		}
+	}
+	err = keyring.db.setJWTKeys(ctx, keys)
+	if err != nil {
+		return JWTKey{}, err
+	}
+	keyring.keys = keys
+	return key, nil
+}
+
+// The key new tokens are signed with
+func (keyring *JWTKeyring) signingKey() JWTKey {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	return keyring.keys[0]
+}
+
+// The secret for the key ID, if it's still allowed to verify tokens
+func (keyring *JWTKeyring) verificationKey(id string) ([]byte, bool) {
+	if secret, ok := keyring.findKey(id); ok {
+		return secret, true
+	}
+	keyring.mutex.RLock()
+	recentlyReloaded := keyring.static || time.Since(keyring.reloaded) < jwtKeyReloadInterval
+	keyring.mutex.RUnlock()
+	if recentlyReloaded || keyring.reload(context.Background()) != nil {
+		return nil, false
+	}
+	return keyring.findKey(id)
+}
+
+func (keyring *JWTKeyring) findKey(id string) ([]byte, bool) {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	index := slices.IndexFunc(keyring.keys, func(key JWTKey) bool { return key.ID == id })
+	if index == -1 {
+		return nil, false
+	}
+	key := keyring.keys[index]
+	if key.Retired != nil && time.Since(*key.Retired) >= keyring.gracePeriod {
+		return nil, false
+	}
+	return key.Secret, true
+}
+
+// Every secret still allowed to verify, for signatures without a key ID
+func (keyring *JWTKeyring) verificationKeys() [][]byte {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	var secrets [][]byte
+	for _, key := range keyring.keys {
+		if key.Retired == nil || time.Since(*key.Retired) < keyring.gracePeriod {
+			secrets = append(secrets, key.Secret)
+		}
+	}
+	return secrets
+}
+
+// The keys without their secrets
+func (keyring *JWTKeyring) describe() []JWTKey {
+	keyring.mutex.RLock()
+	defer keyring.mutex.RUnlock()
+	keys := make([]JWTKey, len(keyring.keys))
+	for i, key := range keyring.keys {
+		key.Secret = nil
+		keys[i] = key
+	}
+	return keys
+}
+
+func jwtKeysGet(jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not get JWT signing keys: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		requestRespond(w, jwt.keys.describe())
+	}
+}
+
+// Rotates the signing key now, for when it may have leaked
+func jwtKeysRotate(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rotation, claims, err := formatUserRequest[JWTKeyRotation](r, jwt, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not rotate JWT signing key: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		if jwt.keys.static {
+			w.WriteHeader(http.StatusConflict)
+			requestRespond(w, "JWT_SECRET is set, so signing keys can't be rotated")
+			return
+		}
+		key, err := jwt.keys.Rotate(r.Context(), rotation.Revoke)
+		if err != nil {
+			Printing.PrintErrStr("Could not rotate JWT signing key: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditJWTKeyRotate, key.ID, nil, rotation)
+		if rotation.Revoke {
+			// Other instances keep the old keys until they reload, but every session is checked in Valkey
+			err = removeAllSessions(r.Context(), db)
+			if err != nil {
+				Printing.PrintErrStr("Rotated JWT signing key, but could not revoke sessions: " + err.Error())
+				requestRespondCode(w, http.StatusInternalServerError)
+				return
+			}
+			jwt.clearJWT(w)
+			Printing.Println("Rotated JWT signing key and revoked the old keys")
+		} else {
+			Printing.Println("Rotated JWT signing key")
+		}
+		requestRespond(w, jwt.keys.describe())
+	}
+}
@@ -8,7 +8,7 @@ import (
 )
 
 // TODO To be removed in CheckBag v5
-func migrateFSToDB(db AdvancedDB) {
+func migrateFSToDB(db DB) {
 	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		return
@@ -20,7 +20,10 @@ func migrateFSToDB(db AdvancedDB) {
 	userHashFile := filepath.Join(CheckBagPath, "userdata.txt")
 	userHash, err := os.ReadFile(userHashFile)
 	if err == nil { // User hash migration needed
-		db.SetUserPasswordHash(ctx, string(userHash)) // Can panic
+		err := db.basicDB.Set(ctx, "Password_Hash", string(userHash), 0) // Moved to a user by migrateToUsers
+		if err != nil {
+			panic("Unable to set the user's password hash during migration: " + err.Error())
+		}
 		os.Remove(userHashFile)
 	}
 	serviceDataFile := filepath.Join(CheckBagPath, "services.json")
@@ -43,3 +46,22 @@ func migrateFSToDB(db AdvancedDB) {
 	}
 	os.RemoveAll(CheckBagPath) // You'll be missed :')
 }
+
+// Turns the single password from before CheckBag had usernames into an admin account
+func migrateToUsers(db DB) {
+	ctx := context.Background()
+	passwordHash, err := db.basicDB.Get(ctx, "Password_Hash")
+	if err != nil || passwordHash == "" { // Never signed up
+		return
+	}
+	err = db.setUser(ctx, User{Username: legacyUsername, Role: UserRoleAdmin, PasswordHash: passwordHash})
+	if err != nil {
+		panic("Unable to create the " + legacyUsername + " user during migration: " + err.Error())
+	}
+	db.basicDB.Delete(ctx, "Password_Hash")
+}
+
+// Drops the single JWT secret for the rotating keyring. Tokens it signed have no session to go with them, so nothing is lost.
+func migrateJWTSecret(db DB) {
+	db.basicDB.Delete(context.Background(), "JWTSecret")
+}
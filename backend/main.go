@@ -13,31 +13,94 @@ import (
 
 func main() {
 	var serviceLinks = ServiceLinks{}
+	var scannerRules = ScannerRuleEngine{}
+	var bans = BanEngine{}
+	var rateLimiter = RateLimiter{}
+	var waf = WAFEngine{}
+	var blockLists = BlockListEngine{}
+	var oidcProvider = OIDCProvider{}
+	var signInGuard = SignInGuard{}
 
 	// Coms setup
 	Printing.ReadConfig()
 	// Cache setup
 	db := SetupDB()
+	if len(os.Args) == 3 && os.Args[1] == "disable-two-factor" { // Run in the container when an authenticator is lost
+		disableTwoFactorCommand(db, os.Args[2])
+		return
+	}
 	// Services setup
 	serviceLinks.Setup(db)
+	// Analytics setup
+	loadVisitTimeout()
+	loadAuditLogRetention()
+	loadCookieSettings()
+	loadGeoIPDatabase()
+	loadCountryHeader()
+	scannerRules.Setup(db)
+	bans.Setup(db)
+	rateLimiter.Setup(db)
+	waf.Setup(db)
+	blockLists.Setup()
+	oidcProvider.Setup()
+	signInGuard.Setup(db)
 	// JWT Setup
-	jwt := loadJWTSecret(db)
+	jwt := loadJWTService(db)
 	// Setup endpoints
-	setupEndpoints(&serviceLinks, db, jwt, strings.ToLower(os.Getenv("DEV_MODE")) == "true")
+	setupEndpoints(&serviceLinks, &scannerRules, &bans, &rateLimiter, &waf, &blockLists, &oidcProvider, &signInGuard, db, jwt, strings.ToLower(os.Getenv("DEV_MODE")) == "true")
 	Printing.Println("Listening on port 8080")
-	http.ListenAndServe(":8080", nil)
+	http.ListenAndServe(":8080", crossOriginProtection(http.DefaultServeMux))
 }
 
-func setupEndpoints(serviceLinks *ServiceLinks, db AdvancedDB, jwt JWTService, devMode bool) {
-	http.HandleFunc("GET /api/user-exists", userExists(db))                         // Check if the user already exists
-	http.HandleFunc("POST /api/user-sign-up", newUser(db, jwt))                     // Sign up with username and password
-	http.HandleFunc("POST /api/user-sign-in", userSignIn(db, jwt))                  // Sign in with username and password
-	http.HandleFunc("POST /api/user-sign-in-jwt", userJWTSignIn(jwt))               // Sign in with JWT
-	http.HandleFunc("POST /api/services-set", servicesSet(serviceLinks, db, jwt))   // Setting/replacing all services
-	http.HandleFunc("GET /api/service-data", getServiceData(serviceLinks, db, jwt)) // Getting analytics
-	http.HandleFunc("/api/service/{path...}", requestForwarding(serviceLinks, db))  // Proxying requests
-	http.HandleFunc("GET /api/api-keys", APIGet(db, jwt))                           // Getting API keys
-	http.HandleFunc("POST /api/api-keys", APISet(db, jwt))                          // Setting API keys
+func setupEndpoints(serviceLinks *ServiceLinks, scannerRules *ScannerRuleEngine, bans *BanEngine, rateLimiter *RateLimiter, waf *WAFEngine, blockLists *BlockListEngine, oidcProvider *OIDCProvider, signInGuard *SignInGuard, db AdvancedDB, jwt JWTService, devMode bool) {
+	http.HandleFunc("GET /api/user-exists", userExists(db, oidcProvider))                                                                 // Check if the user already exists
+	http.HandleFunc("POST /api/user-sign-up", newUser(db, jwt, oidcProvider, signInGuard))                                                // Sign up as the first admin
+	http.HandleFunc("POST /api/user-sign-in", userSignIn(db, jwt, oidcProvider, signInGuard))                                             // Sign in with username and password
+	http.HandleFunc("GET /api/sign-in-methods", signInMethodsGet(oidcProvider))                                                           // Checking if password and OIDC sign in are available
+	http.HandleFunc("GET /api/oidc/sign-in", oidcSignIn(oidcProvider, db))                                                                // Starting a sign in at the OIDC provider
+	http.HandleFunc("GET /api/oidc/callback", oidcCallback(oidcProvider, db, jwt))                                                        // Finishing a sign in from the OIDC provider
+	http.HandleFunc("POST /api/user-sign-in-jwt", userJWTSignIn(jwt))                                                                     // Sign in with JWT
+	http.HandleFunc("POST /api/sign-out", userSignOut(db, jwt))                                                                           // Signing out of this session
+	http.HandleFunc("GET /api/sessions", sessionsGet(db, jwt))                                                                            // Getting the user's signed in sessions
+	http.HandleFunc("DELETE /api/sessions", sessionsRemove(db, jwt))                                                                      // Signing out of every session
+	http.HandleFunc("DELETE /api/sessions/{id}", sessionRemove(db, jwt))                                                                  // Revoking a session
+	http.HandleFunc("POST /api/user-sign-in-two-factor", userSignInTwoFactor(db, jwt, signInGuard))                                       // Finish signing in with a two-factor code
+	http.HandleFunc("POST /api/two-factor/enroll", twoFactorEnroll(db, jwt))                                                              // Starting two-factor enrollment
+	http.HandleFunc("POST /api/two-factor/confirm", twoFactorConfirm(db, jwt))                                                            // Enabling two-factor authentication
+	http.HandleFunc("POST /api/two-factor/disable", twoFactorDisable(db, jwt))                                                            // Disabling two-factor authentication
+	http.HandleFunc("POST /api/user-sign-in-passkey/begin", userSignInPasskeyBegin(db, jwt, signInGuard))                                 // Starting a passkey sign in
+	http.HandleFunc("POST /api/user-sign-in-passkey/finish", userSignInPasskeyFinish(db, jwt, signInGuard))                               // Signing in with a passkey
+	http.HandleFunc("GET /api/passkeys", passkeysGet(db, jwt))                                                                            // Getting the user's passkeys
+	http.HandleFunc("POST /api/passkeys/register/begin", passkeyRegisterBegin(db, jwt))                                                   // Starting passkey registration
+	http.HandleFunc("POST /api/passkeys/register/finish", passkeyRegisterFinish(db, jwt))                                                 // Saving a new passkey
+	http.HandleFunc("POST /api/passkeys/{id}", passkeyRename(db, jwt))                                                                    // Renaming a passkey
+	http.HandleFunc("DELETE /api/passkeys/{id}", passkeyRemove(db, jwt))                                                                  // Revoking a passkey
+	http.HandleFunc("POST /api/services-set", servicesSet(serviceLinks, db, jwt))                                                         // Setting/replacing all services
+	http.HandleFunc("GET /api/service-data", getServiceData(serviceLinks, db, jwt))                                                       // Getting analytics
+	http.HandleFunc("/api/service/{path...}", requestForwarding(serviceLinks, db, scannerRules, bans, rateLimiter, waf, blockLists, jwt)) // Proxying requests
+	http.HandleFunc("GET /api/api-keys", APIGet(db, jwt))                                                                                 // Getting API keys
+	http.HandleFunc("POST /api/api-keys", APISet(db, jwt))                                                                                // Setting API keys
+	http.HandleFunc("POST /api/events", eventsSet(serviceLinks, db))                                                                      // Reporting custom events with an API key
+	http.HandleFunc("GET /api/unmatched-requests", getUnmatchedRequests(db, jwt))                                                         // Getting requests for unknown hosts
+	http.HandleFunc("GET /api/scanner-rules", scannerRulesGet(scannerRules, jwt))                                                         // Getting built-in and user-defined scanner rules
+	http.HandleFunc("POST /api/scanner-rules", scannerRulesSet(scannerRules, db, jwt))                                                    // Setting user-defined scanner rules
+	http.HandleFunc("GET /api/suspicious-clients", getSuspiciousClients(db, jwt))                                                         // Getting IPs that matched scanner rules
+	http.HandleFunc("GET /api/ban-rules", banRulesGet(bans, jwt))                                                                         // Getting automatic ban rules
+	http.HandleFunc("POST /api/ban-rules", banRulesSet(bans, db, jwt))                                                                    // Setting automatic ban rules
+	http.HandleFunc("GET /api/bans", bansGet(db, jwt))                                                                                    // Getting banned IPs
+	http.HandleFunc("POST /api/bans", banAdd(db, jwt))                                                                                    // Manually banning an IP
+	http.HandleFunc("DELETE /api/bans/{ip}", banRemove(db, jwt))                                                                          // Lifting a ban
+	http.HandleFunc("GET /api/waf-rules", wafRulesGet(waf, jwt))                                                                          // Getting built-in and custom WAF rules
+	http.HandleFunc("POST /api/waf-rules", wafRulesSet(waf, db, jwt))                                                                     // Setting custom WAF rules
+	http.HandleFunc("GET /api/block-lists", blockListsGet(blockLists, jwt))                                                               // Getting loaded block lists
+	http.HandleFunc("GET /api/jwt-keys", jwtKeysGet(jwt))                                                                                 // Getting session signing keys, without their secrets
+	http.HandleFunc("POST /api/jwt-keys/rotate", jwtKeysRotate(db, jwt))                                                                  // Rotating the session signing key
+	http.HandleFunc("GET /api/sign-in-failures", signInFailuresGet(db, jwt))                                                              // Getting recent failed sign ins
+	http.HandleFunc("GET /api/audit-log", auditLogGet(db, jwt))                                                                           // Querying who changed what
+	http.HandleFunc("GET /api/users", usersGet(db, jwt))                                                                                  // Getting users and their roles
+	http.HandleFunc("POST /api/users", userSet(db, jwt))                                                                                  // Creating or updating a user
+	http.HandleFunc("DELETE /api/users/{username}", userRemove(db, jwt))                                                                  // Removing a user
+	http.HandleFunc("DELETE /api/users/{username}/sessions", userSessionsRemove(db, jwt))                                                 // Signing a user out everywhere
 
 	http.HandleFunc("/", spaHandler(devMode)) // Serve the frontend
 }
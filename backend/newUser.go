@@ -3,29 +3,57 @@ package main
 import (
 	"net/http"
 
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func newUser(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+// Creates the first admin, everyone after that is added by an admin
+func newUser(db AdvancedDB, jwt JWTService, provider *OIDCProvider, guard *SignInGuard) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		userData, _ := db.GetUserPasswordHash(r.Context())
-		if userData != "" {
+		if !provider.PasswordSignIn() {
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		if guard.refuse(w, r) {
+			return
+		}
+		users, err := db.getUsers(r.Context())
+		if err != nil || len(users) != 0 {
+			if err == nil { // Signing up after the first admin exists is someone looking for a way in
+				guard.fail(r, "", SignInMethodSignUp)
+			}
 			requestRespondCode(w, http.StatusForbidden)
 			return
 		}
 
-		newUserPassword, err := requestReceived[string](r)
-		if err != nil {
+		signUp, err := requestReceived[SignInRequest](r)
+		if err != nil || signUp.Password == "" {
 			requestRespondCode(w, http.StatusBadRequest)
 			return
 		}
-		userPasswordHash, err := createPasswordHash(*newUserPassword)
+		if err := (UserRequest{Username: signUp.Username, Role: UserRoleAdmin}).validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, err.Error())
+			return
+		}
+		userPasswordHash, err := createPasswordHash(signUp.Password)
 		if err != nil {
 			requestRespondCode(w, http.StatusBadRequest)
 			return
 		}
-		db.SetUserPasswordHash(r.Context(), string(userPasswordHash))
-		jwt.setJWT(w)
+		user := User{Username: signUp.Username, Role: UserRoleAdmin, PasswordHash: string(userPasswordHash)}
+		err = db.setUser(r.Context(), user)
+		if err != nil {
+			Printing.PrintErrStr("Could not save user: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		err = jwt.setJWT(w, r, user)
+		if err != nil {
+			Printing.PrintErrStr("Could not start session: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
 		requestRespondCode(w, http.StatusOK)
 	}
 }
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+	jwtLibrary "github.com/golang-jwt/jwt/v5"
+)
+
+const oidcStateCookieName = "checkbag-oidc-state"
+
+// How long the user has to sign in at the provider
+const oidcStateLifetime = 10 * time.Minute
+
+// Unknown key IDs refetch the provider's keys, but no more often than this
+const oidcKeyRefreshInterval = time.Minute
+
+// Marks users created by signing in with the OIDC provider
+const userProviderOIDC = "oidc"
+
+// Signs in through an OpenID Connect provider with the authorization code flow and PKCE, configured with OIDC_ISSUER,
+// OIDC_CLIENT_ID, and OIDC_CLIENT_SECRET. Provider groups map to roles with OIDC_ADMIN_GROUPS and OIDC_VIEWER_GROUPS.
+type OIDCProvider struct {
+	mutex          sync.Mutex
+	issuer         string
+	clientID       string
+	clientSecret   string
+	redirectURL    string // Empty to build it from the dashboard's address
+	scopes         string
+	usernameClaim  string
+	groupsClaim    string
+	adminGroups    []string
+	viewerGroups   []string // "*" lets everyone the provider signs in be a viewer
+	client         *http.Client
+	discovery      *oidcDiscovery
+	keys           map[string]any // Key ID → *rsa.PublicKey or *ecdsa.PublicKey
+	keysFetched    time.Time
+	passwordSignIn bool
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Kept in Valkey from the redirect to the provider until it sends the user back
+type oidcState struct {
+	Verifier string `json:"verifier"` // PKCE code verifier
+	Nonce    string `json:"nonce"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type SignInMethods struct {
+	Password bool `json:"password"`
+	OIDC     bool `json:"oidc"`
+}
+
+func (provider *OIDCProvider) Setup() {
+	provider.passwordSignIn = strings.ToLower(os.Getenv("PASSWORD_SIGN_IN")) != "false"
+	provider.issuer = strings.TrimSuffix(os.Getenv("OIDC_ISSUER"), "/")
+	provider.clientID = os.Getenv("OIDC_CLIENT_ID")
+	if provider.issuer == "" || provider.clientID == "" {
+		provider.issuer = ""
+		provider.passwordSignIn = true // Never lock everyone out
+		return
+	}
+	provider.clientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	provider.redirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	provider.scopes = "openid profile email"
+	if scopes := os.Getenv("OIDC_SCOPES"); scopes != "" {
+		provider.scopes = scopes
+	}
+	provider.usernameClaim = "preferred_username"
+	if claim := os.Getenv("OIDC_USERNAME_CLAIM"); claim != "" {
+		provider.usernameClaim = claim
+	}
+	provider.groupsClaim = "groups"
+	if claim := os.Getenv("OIDC_GROUPS_CLAIM"); claim != "" {
+		provider.groupsClaim = claim
+	}
+	provider.adminGroups = splitList(os.Getenv("OIDC_ADMIN_GROUPS"))
+	provider.viewerGroups = splitList(os.Getenv("OIDC_VIEWER_GROUPS"))
+	provider.client = &http.Client{Timeout: 10 * time.Second}
+	Printing.Println("Signing in with OIDC through " + provider.issuer)
+}
+
+func (provider *OIDCProvider) Enabled() bool {
+	return provider.issuer != ""
+}
+
+// Whether local passwords can still be used, which PASSWORD_SIGN_IN=false turns off once OIDC is set up
+func (provider *OIDCProvider) PasswordSignIn() bool {
+	return provider.passwordSignIn
+}
+
+func splitList(list string) []string {
+	var items []string
+	for item := range strings.SplitSeq(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Fetches the provider's endpoints the first time they're needed, so CheckBag still starts while the provider is down
+func (provider *OIDCProvider) endpoints(ctx context.Context) (*oidcDiscovery, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	if provider.discovery != nil {
+		return provider.discovery, nil
+	}
+	var discovery oidcDiscovery
+	err := provider.getJSON(ctx, provider.issuer+"/.well-known/openid-configuration", &discovery)
+	if err != nil {
+		return nil, errors.New("Unable to discover OIDC provider: " + err.Error())
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != provider.issuer {
+		return nil, errors.New("OIDC provider claims to be " + discovery.Issuer + " instead of " + provider.issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, errors.New("OIDC provider is missing endpoints")
+	}
+	provider.discovery = &discovery
+	return provider.discovery, nil
+}
+
+func (provider *OIDCProvider) getJSON(ctx context.Context, address string, destination any) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return err
+	}
+	response, err := provider.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.New(address + " responded with " + response.Status)
+	}
+	return json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(destination)
+}
+
+// The provider's signing key with the ID, refetching the key set if the provider rotated its keys
+func (provider *OIDCProvider) signingKey(ctx context.Context, keyID string) (any, error) {
+	discovery, err := provider.endpoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+	key, ok := provider.findKey(keyID)
+	if ok {
+		return key, nil
+	}
+	if time.Since(provider.keysFetched) < oidcKeyRefreshInterval {
+		return nil, errors.New("unknown OIDC signing key " + keyID)
+	}
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = provider.getJSON(ctx, discovery.JWKSURI, &keySet)
+	if err != nil {
+		return nil, errors.New("Unable to get OIDC signing keys: " + err.Error())
+	}
+	provider.keysFetched = time.Now()
+	provider.keys = map[string]any{}
+	for _, webKey := range keySet.Keys {
+		if webKey.Use != "" && webKey.Use != "sig" {
+			continue
+		}
+		publicKey, err := webKey.publicKey()
+		if err != nil {
+			Printing.PrintErrStr("Skipping OIDC signing key " + webKey.KeyID + ": " + err.Error())
+			continue
+		}
+		provider.keys[webKey.KeyID] = publicKey
+	}
+	key, ok = provider.findKey(keyID)
+	if !ok {
+		return nil, errors.New("unknown OIDC signing key " + keyID)
+	}
+	return key, nil
+}
+
+func (provider *OIDCProvider) findKey(keyID string) (any, bool) {
+	if key, ok := provider.keys[keyID]; ok {
+		return key, true
+	}
+	if keyID == "" && len(provider.keys) == 1 { // Providers with one key may leave out its ID
+		for _, onlyKey := range provider.keys {
+			return onlyKey, true
+		}
+	}
+	return nil, false
+}
+
+func (webKey jsonWebKey) publicKey() (any, error) {
+	decode := func(value string) (*big.Int, error) {
+		decoded, err := webAuthnEncoding.DecodeString(value)
+		return new(big.Int).SetBytes(decoded), err
+	}
+	switch webKey.KeyType {
+	case "RSA":
+		n, err := decode(webKey.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(webKey.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		if n.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[webKey.Curve]
+		if !ok {
+			return nil, errors.New("unsupported curve " + webKey.Curve)
+		}
+		x, err := decode(webKey.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(webKey.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + webKey.KeyType)
+}
+
+// Checks the ID token's signature, issuer, audience, expiry, and nonce, returning its claims
+func (provider *OIDCProvider) verifyIDToken(ctx context.Context, rawIDToken string, nonce string) (jwtLibrary.MapClaims, error) {
+	claims := jwtLibrary.MapClaims{}
+	_, err := jwtLibrary.ParseWithClaims(rawIDToken, claims, func(token *jwtLibrary.Token) (any, error) {
+		keyID, _ := token.Header["kid"].(string)
+		return provider.signingKey(ctx, keyID)
+	},
+		jwtLibrary.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}),
+		jwtLibrary.WithIssuer(provider.issuer),
+		jwtLibrary.WithAudience(provider.clientID),
+		jwtLibrary.WithExpirationRequired(),
+		jwtLibrary.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce == "" || tokenNonce != nonce {
+		return nil, errors.New("ID token nonce doesn't match")
+	}
+	return claims, nil
+}
+
+// Maps the provider's groups to a role, admin winning over viewer. Users in neither can't sign in.
+func (provider *OIDCProvider) role(claims jwtLibrary.MapClaims) (UserRole, bool) {
+	var groups []string
+	switch claimedGroups := claims[provider.groupsClaim].(type) {
+	case string:
+		groups = []string{claimedGroups}
+	case []any:
+		for _, group := range claimedGroups {
+			if groupName, ok := group.(string); ok {
+				groups = append(groups, groupName)
+			}
+		}
+	}
+	inAny := func(allowed []string) bool {
+		return slices.ContainsFunc(groups, func(group string) bool { return slices.Contains(allowed, group) })
+	}
+	switch {
+	case inAny(provider.adminGroups):
+		return UserRoleAdmin, true
+	case inAny(provider.viewerGroups) || slices.Contains(provider.viewerGroups, "*"):
+		return UserRoleViewer, true
+	}
+	return "", false
+}
+
+func (provider *OIDCProvider) redirectURI(r *http.Request) string {
+	if provider.redirectURL != "" {
+		return provider.redirectURL
+	}
+	return requestOrigin(r) + "/api/oidc/callback"
+}
+
+// Random and URL safe, for PKCE verifiers, states, and nonces
+func newOIDCToken() string {
+	token := make([]byte, 32)
+	rand.Read(token)
+	return webAuthnEncoding.EncodeToString(token)
+}
+
+// Tells the sign in screen which ways of signing in are available
+func signInMethodsGet(provider *OIDCProvider) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestRespond(w, SignInMethods{Password: provider.PasswordSignIn(), OIDC: provider.Enabled()})
+	}
+}
+
+// Sends the browser to the provider
+func oidcSignIn(provider *OIDCProvider, db AdvancedDB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !provider.Enabled() {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		discovery, err := provider.endpoints(r.Context())
+		if err != nil {
+			Printing.PrintErrStr(err.Error())
+			requestRespondCode(w, http.StatusBadGateway)
+			return
+		}
+		state := newOIDCToken()
+		pending := oidcState{Verifier: newOIDCToken(), Nonce: newOIDCToken()}
+		err = db.setOIDCState(r.Context(), state, pending, oidcStateLifetime)
+		if err != nil {
+			Printing.PrintErrStr("Could not save OIDC state: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		// Ties the sign in to this browser, so nobody can finish their own sign in in someone else's browser
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookieName,
+			Value:    state,
+			HttpOnly: true,
+			Secure:   cookieSecure(r),
+			SameSite: http.SameSiteLaxMode, // The provider's redirect back is cross-site
+			Expires:  time.Now().Add(oidcStateLifetime),
+			Path:     "/api/oidc/",
+		})
+
+		challenge := sha256.Sum256([]byte(pending.Verifier))
+		parameters := url.Values{}
+		parameters.Set("response_type", "code")
+		parameters.Set("client_id", provider.clientID)
+		parameters.Set("redirect_uri", provider.redirectURI(r))
+		parameters.Set("scope", provider.scopes)
+		parameters.Set("state", state)
+		parameters.Set("nonce", pending.Nonce)
+		parameters.Set("code_challenge", webAuthnEncoding.EncodeToString(challenge[:]))
+		parameters.Set("code_challenge_method", "S256")
+		separator := "?"
+		if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+			separator = "&"
+		}
+		http.Redirect(w, r, discovery.AuthorizationEndpoint+separator+parameters.Encode(), http.StatusFound)
+	}
+}
+
+// Finishes signing in when the provider sends the browser back, then continues to the dashboard
+func oidcCallback(provider *OIDCProvider, db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !provider.Enabled() {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		user, err := provider.finishSignIn(r, db)
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookieName, Value: "", Path: "/api/oidc/", MaxAge: -1})
+		if err != nil {
+			Printing.PrintErrStr("Could not sign in with OIDC: " + err.Error())
+			http.Redirect(w, r, "/signin?error=oidc", http.StatusFound)
+			return
+		}
+		err = jwt.setJWT(w, r, *user)
+		if err != nil {
+			Printing.PrintErrStr("Could not start session: " + err.Error())
+			http.Redirect(w, r, "/signin?error=oidc", http.StatusFound)
+			return
+		}
+		Printing.Println("Signed in " + user.Username + " with OIDC")
+		http.Redirect(w, r, "/dashboard", http.StatusFound)
+	}
+}
+
+func (provider *OIDCProvider) finishSignIn(r *http.Request, db AdvancedDB) (*User, error) {
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		return nil, errors.New("provider refused: " + providerError)
+	}
+	state := query.Get("state")
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || state == "" || cookie.Value != state {
+		return nil, errors.New("state doesn't match this browser")
+	}
+	pending, err := db.takeOIDCState(r.Context(), state)
+	if err != nil || pending == nil {
+		return nil, errors.New("unknown or expired state")
+	}
+	discovery, err := provider.endpoints(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	// Trade the code for tokens
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", query.Get("code"))
+	form.Set("redirect_uri", provider.redirectURI(r))
+	form.Set("client_id", provider.clientID)
+	form.Set("code_verifier", pending.Verifier)
+	request, err := http.NewRequestWithContext(r.Context(), http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if provider.clientSecret != "" {
+		request.SetBasicAuth(url.QueryEscape(provider.clientID), url.QueryEscape(provider.clientSecret))
+	}
+	response, err := provider.client.Do(request)
+	if err != nil {
+		return nil, errors.New("Unable to reach token endpoint: " + err.Error())
+	}
+	defer response.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	err = json.NewDecoder(io.LimitReader(response.Body, 1<<20)).Decode(&tokens)
+	if err != nil || response.StatusCode != http.StatusOK || tokens.IDToken == "" {
+		return nil, errors.New("token endpoint responded with " + response.Status + " " + tokens.Error)
+	}
+
+	claims, err := provider.verifyIDToken(r.Context(), tokens.IDToken, pending.Nonce)
+	if err != nil {
+		return nil, errors.New("invalid ID token: " + err.Error())
+	}
+	// Users are matched on the issuer and sub, which never change. The username claim can usually be changed by the
+	// user at the provider, so it only names the user the first time they sign in.
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("the ID token has no sub claim")
+	}
+	subject := provider.issuer + "|" + sub
+	claimedUsername, _ := claims[provider.usernameClaim].(string)
+	role, ok := provider.role(claims)
+	if !ok {
+		return nil, errors.New(claimedUsername + " isn't in any group allowed to use CheckBag")
+	}
+
+	// Keep the user around so admins can limit their services, updating their role from the provider every time
+	username, err := db.getOIDCUsername(r.Context(), subject)
+	if err != nil {
+		return nil, err
+	}
+	var user *User
+	if username != "" {
+		user, err = db.getUser(r.Context(), username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if user == nil || user.Subject != subject {
+		username = claimedUsername
+		if !usernamePattern.MatchString(username) {
+			return nil, errors.New("the " + provider.usernameClaim + " claim isn't a valid username")
+		}
+		existing, err := db.getUser(r.Context(), username)
+		if err != nil {
+			return nil, err
+		}
+		if existing != nil { // Local users, and OIDC users with a different sub, are someone else
+			return nil, errors.New("a different user named " + username + " already exists")
+		}
+		user = &User{Username: username, Provider: userProviderOIDC, Subject: subject}
+	}
+	roleChanged := user.Role != "" && user.Role != role
+	user.Role = role
+	err = db.setUser(r.Context(), *user)
+	if err != nil {
+		return nil, err
+	}
+	if roleChanged { // Sessions keep the role they were started with
+		err = db.removeSessions(r.Context(), username)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Paths under this prefix are answered by CheckBag for services with page tracking enabled
+const pageTrackingPrefix = "/_checkbag/"
+
+const pageTrackingScriptTag = `<script defer src="` + pageTrackingPrefix + `script.js"></script>`
+
+// Reports a view when a page loads or a SPA navigates, and the time spent when it's left
+const pageTrackingScript = `(() => {
+	const url = "` + pageTrackingPrefix + `beacon";
+	let path = location.pathname;
+	let shown = Date.now();
+	const send = (data) => navigator.sendBeacon(url, JSON.stringify(data));
+	const leave = () => send({ type: "leave", path, duration: Date.now() - shown });
+	const view = () => {
+		path = location.pathname;
+		shown = Date.now();
+		send({ type: "view", path, screen: screen.width + "x" + screen.height });
+	};
+	const navigate = () => {
+		if (location.pathname === path) return;
+		leave();
+		view();
+	};
+	const pushState = history.pushState;
+	history.pushState = function () {
+		pushState.apply(this, arguments);
+		navigate();
+	};
+	addEventListener("popstate", navigate);
+	addEventListener("pagehide", leave);
+	view();
+})();
+`
+
+// Longest time on page that's still believable, anything longer is an abandoned tab
+const maximumTimeOnPage = 6 * time.Hour
+
+type PageBeacon struct {
+	Type     string `json:"type"` // "view" or "leave"
+	Path     string `json:"path"`
+	Screen   string `json:"screen"`
+	Duration int    `json:"duration"` // Milliseconds, only for "leave"
+}
+
+// Page views reported by the tracking script, rather than counted from proxied requests
+type PageViewSummary struct {
+	PageViews         int            `json:"page_views"`
+	PageView          map[string]int `json:"page_view"`
+	Screen            map[string]int `json:"screen"`
+	PageTime          int            `json:"page_time"` // Seconds, summed across all reported page leaves
+	PageTimeSamples   int            `json:"page_time_samples"`
+	AverageTimeOnPage float64        `json:"average_time_on_page"` // Seconds
+}
+
+func newPageViewSummary(views int, time int, timeSamples int) PageViewSummary {
+	summary := PageViewSummary{
+		PageViews:       views,
+		PageTime:        time,
+		PageTimeSamples: timeSamples,
+	}
+	if timeSamples > 0 {
+		summary.AverageTimeOnPage = float64(time) / float64(timeSamples)
+	}
+	return summary
+}
+
+// Serves the tracking script and receives its beacons
+func pageTrackingHandler(w http.ResponseWriter, r *http.Request, service *ServiceLink, path string, db AdvancedDB) {
+	switch strings.TrimPrefix(path, pageTrackingPrefix) {
+	case "script.js":
+		w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Write([]byte(pageTrackingScript))
+	case "beacon":
+		if r.Method != http.MethodPost {
+			requestRespondCode(w, http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 4096)
+		beacon, err := requestReceived[PageBeacon](r)
+		if err != nil || !strings.HasPrefix(beacon.Path, "/") || (beacon.Type != "view" && beacon.Type != "leave") {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		if beacon.Type == "leave" && (beacon.Duration < 0 || time.Duration(beacon.Duration)*time.Millisecond > maximumTimeOnPage) {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		// Use background context with timeout so the beacon is recorded even if the page is gone
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = db.recordPageBeacon(ctx, service.ID, *beacon)
+		if err != nil {
+			Printing.PrintErrStr("Could not record page beacon: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		requestRespondCode(w, http.StatusNotFound)
+	}
+}
+
+// Only bother with uncompressed, regular HTML documents
+func shouldInjectTrackingScript(response *http.Response) bool {
+	contentType := strings.ToLower(response.Header.Get("Content-Type"))
+	contentEncoding := strings.ToLower(response.Header.Get("Content-Encoding"))
+	return response.StatusCode == http.StatusOK &&
+		strings.HasPrefix(contentType, "text/html") &&
+		(contentEncoding == "" || contentEncoding == "identity")
+}
+
+// Adds the tracking script to the page's head, falling back to the body or the end of the document
+func injectTrackingScript(document []byte) []byte {
+	for _, closingTag := range []string{"</head>", "</body>"} {
+		if i := indexASCIIFold(document, closingTag); i != -1 {
+			return bytes.Join([][]byte{document[:i], []byte(pageTrackingScriptTag), document[i:]}, nil)
+		}
+	}
+	return append(document, pageTrackingScriptTag...)
+}
+
+// Finds the first match of the lowercase ASCII token ignoring case. Only ASCII letters are folded, so the index is
+// always into the original document, whatever else it contains.
+func indexASCIIFold(document []byte, token string) int {
+	for i := 0; i+len(token) <= len(document); i++ {
+		if asciiEqualFold(document[i:i+len(token)], token) {
+			return i
+		}
+	}
+	return -1
+}
+
+func asciiEqualFold(text []byte, token string) bool {
+	for i := range len(token) {
+		character := text[i]
+		if 'A' <= character && character <= 'Z' {
+			character += 'a' - 'A'
+		}
+		if character != token[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks if the client is navigating to a page, and may get HTML the tracking script should be added to
+func isDocumentRequest(r *http.Request) bool {
+	if fetchDestination := r.Header.Get("Sec-Fetch-Dest"); fetchDestination != "" {
+		return fetchDestination == "document"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// Converts the beacon's screen size into a canonical "WIDTHxHEIGHT", or an empty string if it's malformed
+func normalizeScreenSize(screen string) string {
+	widthRaw, heightRaw, found := strings.Cut(screen, "x")
+	width, widthErr := strconv.Atoi(widthRaw)
+	height, heightErr := strconv.Atoi(heightRaw)
+	if !found || widthErr != nil || heightErr != nil || width <= 0 || height <= 0 || width > 16384 || height > 16384 {
+		return ""
+	}
+	return strconv.Itoa(width) + "x" + strconv.Itoa(height)
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// How long the browser has to finish a passkey ceremony
+const webAuthnTimeout = 5 * time.Minute
+
+// Prefixes of stored challenges, so one started for registration can't finish a sign in
+const (
+	webAuthnRegistration   = "register"
+	webAuthnAuthentication = "authenticate"
+)
+
+// Authenticator data flags
+const (
+	authenticatorUserPresent  = 0x01
+	authenticatorUserVerified = 0x04 // PIN or biometrics, which counts as a second factor on its own
+	authenticatorAttested     = 0x40
+)
+
+// ES256, the one algorithm every authenticator supports
+const coseAlgorithmES256 = -7
+
+const maximumPasskeyIDLength = 1023
+
+var webAuthnEncoding = base64.RawURLEncoding
+
+type Passkey struct {
+	ID        string     `json:"id"` // Base64url credential ID
+	Name      string     `json:"name"`
+	Created   time.Time  `json:"created"`
+	LastUsed  *time.Time `json:"last_used"`
+	Username  string     `json:"-"`
+	PublicKey []byte     `json:"-"` // Uncompressed P-256 point
+	SignCount uint32     `json:"-"`
+}
+
+type PasskeyRename struct {
+	Name string `json:"name"`
+}
+
+// Sent by the browser after navigator.credentials.create, as encoded by PublicKeyCredential.toJSON
+type PasskeyRegistration struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// Sent by the browser after navigator.credentials.get, as encoded by PublicKeyCredential.toJSON
+type PasskeyAssertion struct {
+	ID       string `json:"id"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AuthenticatorData string `json:"authenticatorData"`
+		Signature         string `json:"signature"`
+	} `json:"response"`
+}
+
+type PasskeySignInRequest struct {
+	Username string `json:"username"` // Optional, discoverable passkeys don't need it
+}
+
+type webAuthnCredentialDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIDHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte // Uncompressed P-256 point, only when registering
+}
+
+// The origin passkeys are bound to and its relying party ID. WEBAUTHN_ORIGIN overrides the origin the dashboard was reached at.
+func webAuthnRelyingParty(r *http.Request) (string, string) {
+	origin := os.Getenv("WEBAUTHN_ORIGIN")
+	if origin == "" {
+		origin = requestOrigin(r)
+	}
+	origin = strings.TrimSuffix(origin, "/")
+	parsedOrigin, err := url.Parse(origin)
+	if err != nil {
+		return origin, ""
+	}
+	return origin, parsedOrigin.Hostname()
+}
+
+func newWebAuthnChallenge() string {
+	challenge := make([]byte, 32)
+	rand.Read(challenge)
+	return webAuthnEncoding.EncodeToString(challenge)
+}
+
+// Not the username itself, since authenticators may show or sync it
+func webAuthnUserHandle(username string) string {
+	handle := sha256.Sum256([]byte("CheckBag user " + username))
+	return webAuthnEncoding.EncodeToString(handle[:])
+}
+
+// A passkey that doesn't exist, the same each time for the username so it can't be told apart from a real one
+func decoyPasskey(username string, jwt JWTService) Passkey {
+	rawID, _ := hex.DecodeString(jwt.sign("decoy passkey:" + username))
+	return Passkey{ID: webAuthnEncoding.EncodeToString(rawID)}
+}
+
+func passkeyDescriptors(passkeys []Passkey) []webAuthnCredentialDescriptor {
+	descriptors := make([]webAuthnCredentialDescriptor, len(passkeys))
+	for i, passkey := range passkeys {
+		descriptors[i] = webAuthnCredentialDescriptor{Type: "public-key", ID: passkey.ID}
+	}
+	return descriptors
+}
+
+// Checks the browser's client data for the ceremony, returning the challenge it signed
+func verifyWebAuthnClientData(rawClientData []byte, ceremony string, origin string) (string, error) {
+	var clientData webAuthnClientData
+	err := json.Unmarshal(rawClientData, &clientData)
+	if err != nil {
+		return "", errors.New("invalid client data: " + err.Error())
+	}
+	if clientData.Type != ceremony {
+		return "", errors.New("expected a " + ceremony + " ceremony, got " + clientData.Type)
+	}
+	if clientData.Origin != origin {
+		return "", errors.New("passkey used from " + clientData.Origin + " instead of " + origin)
+	}
+	return clientData.Challenge, nil
+}
+
+// Parses the authenticator data, including the attested credential when registering
+func parseAuthenticatorData(data []byte, rpID string) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data is too short")
+	}
+	parsed := authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	if !bytes.Equal(parsed.rpIDHash, rpIDHash[:]) {
+		return authenticatorData{}, errors.New("passkey belongs to another site")
+	}
+	if parsed.flags&authenticatorUserPresent == 0 {
+		return authenticatorData{}, errors.New("user wasn't present")
+	}
+	if parsed.flags&authenticatorAttested == 0 {
+		return parsed, nil
+	}
+
+	attested := data[37:]
+	if len(attested) < 18 {
+		return authenticatorData{}, errors.New("attested credential data is too short")
+	}
+	credentialIDLength := int(binary.BigEndian.Uint16(attested[16:18])) // After the 16 byte AAGUID
+	attested = attested[18:]
+	if credentialIDLength > maximumPasskeyIDLength || len(attested) < credentialIDLength {
+		return authenticatorData{}, errors.New("invalid credential ID length")
+	}
+	parsed.credentialID = attested[:credentialIDLength]
+	coseKey, _, err := decodeCBOR(attested[credentialIDLength:]) // Extensions may follow the key
+	if err != nil {
+		return authenticatorData{}, errors.New("invalid credential public key: " + err.Error())
+	}
+	parsed.publicKey, err = parseCOSEKey(coseKey)
+	if err != nil {
+		return authenticatorData{}, err
+	}
+	return parsed, nil
+}
+
+// Converts an ES256 COSE key (RFC 9053) to an uncompressed point
+func parseCOSEKey(key any) ([]byte, error) {
+	keyMap, ok := key.(map[any]any)
+	if !ok {
+		return nil, errors.New("credential public key isn't a map")
+	}
+	x, xOK := keyMap[int64(-2)].([]byte)
+	y, yOK := keyMap[int64(-3)].([]byte)
+	if keyMap[int64(1)] != int64(2) || keyMap[int64(3)] != int64(coseAlgorithmES256) || keyMap[int64(-1)] != int64(1) || !xOK || !yOK || len(x) != 32 || len(y) != 32 {
+		return nil, errors.New("only ES256 passkeys are supported")
+	}
+	point := append(append([]byte{4}, x...), y...)
+	if _, err := ecdh.P256().NewPublicKey(point); err != nil { // Checks the point is on the curve
+		return nil, errors.New("invalid credential public key: " + err.Error())
+	}
+	return point, nil
+}
+
+func verifyPasskeySignature(publicKey []byte, authenticatorData []byte, clientDataJSON []byte, signature []byte) bool {
+	if len(publicKey) != 65 {
+		return false
+	}
+	key := ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(publicKey[1:33]),
+		Y:     new(big.Int).SetBytes(publicKey[33:]),
+	}
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := sha256.Sum256(append(append([]byte(nil), authenticatorData...), clientDataHash[:]...))
+	return ecdsa.VerifyASN1(&key, signed[:], signature)
+}
+
+// Starts registering a passkey for the signed in user
+func passkeyRegisterBegin(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := sessionUser(r, db, jwt)
+		if err != nil {
+			Printing.PrintErrStr("Could not start passkey registration: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		passkeys, err := db.getPasskeys(r.Context(), user.Username)
+		if err != nil {
+			Printing.PrintErrStr("Could not get passkeys: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		challenge := newWebAuthnChallenge()
+		err = db.setWebAuthnChallenge(r.Context(), challenge, webAuthnRegistration+"|"+user.Username, webAuthnTimeout)
+		if err != nil {
+			Printing.PrintErrStr("Could not save passkey challenge: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		_, rpID := webAuthnRelyingParty(r)
+		requestRespond(w, map[string]any{
+			"challenge":          challenge,
+			"rp":                 map[string]string{"id": rpID, "name": "CheckBag"},
+			"user":               map[string]string{"id": webAuthnUserHandle(user.Username), "name": user.Username, "displayName": user.Username},
+			"pubKeyCredParams":   []map[string]any{{"type": "public-key", "alg": coseAlgorithmES256}},
+			"timeout":            webAuthnTimeout.Milliseconds(),
+			"excludeCredentials": passkeyDescriptors(passkeys),
+			"authenticatorSelection": map[string]string{
+				"residentKey":      "preferred",
+				"userVerification": "preferred",
+			},
+			"attestation": "none",
+		})
+	}
+}
+
+// Saves the passkey the browser created. Attestation isn't checked, since CheckBag doesn't restrict authenticator models.
+func passkeyRegisterFinish(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := sessionUser(r, db, jwt)
+		if err != nil {
+			Printing.PrintErrStr("Could not finish passkey registration: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+		registration, err := requestReceived[PasskeyRegistration](r)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		passkey, err := verifyPasskeyRegistration(r, db, user.Username, *registration)
+		if err != nil {
+			Printing.PrintErrStr("Could not register passkey for " + user.Username + ": " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, err.Error())
+			return
+		}
+		err = db.setPasskey(r.Context(), passkey)
+		if err != nil {
+			Printing.PrintErrStr("Could not save passkey: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, user.Username, AuditPasskeyAdd, passkey.Name, nil, passkey)
+		Printing.Println("Registered passkey \"" + passkey.Name + "\" for " + user.Username)
+		requestRespond(w, passkey)
+	}
+}
+
+func verifyPasskeyRegistration(r *http.Request, db AdvancedDB, username string, registration PasskeyRegistration) (Passkey, error) {
+	origin, rpID := webAuthnRelyingParty(r)
+	clientDataJSON, err := webAuthnEncoding.DecodeString(registration.Response.ClientDataJSON)
+	if err != nil {
+		return Passkey{}, errors.New("invalid client data encoding")
+	}
+	challenge, err := verifyWebAuthnClientData(clientDataJSON, "webauthn.create", origin)
+	if err != nil {
+		return Passkey{}, err
+	}
+	purpose, err := db.takeWebAuthnChallenge(r.Context(), challenge)
+	if err != nil || purpose != webAuthnRegistration+"|"+username {
+		return Passkey{}, errors.New("unknown or expired challenge")
+	}
+
+	rawAttestation, err := webAuthnEncoding.DecodeString(registration.Response.AttestationObject)
+	if err != nil {
+		return Passkey{}, errors.New("invalid attestation encoding")
+	}
+	attestation, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return Passkey{}, errors.New("invalid attestation: " + err.Error())
+	}
+	attestationMap, _ := attestation.(map[any]any)
+	rawAuthenticatorData, ok := attestationMap["authData"].([]byte)
+	if !ok {
+		return Passkey{}, errors.New("attestation is missing authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthenticatorData, rpID)
+	if err != nil {
+		return Passkey{}, err
+	}
+	if authData.publicKey == nil {
+		return Passkey{}, errors.New("no credential was created")
+	}
+	passkeyID := webAuthnEncoding.EncodeToString(authData.credentialID)
+	if existing, err := db.getPasskey(r.Context(), passkeyID); err != nil || existing != nil {
+		return Passkey{}, errors.New("passkey is already registered")
+	}
+
+	name := strings.TrimSpace(registration.Name)
+	if name == "" {
+		name = "Passkey"
+	}
+	return Passkey{
+		ID:        passkeyID,
+		Name:      name,
+		Created:   time.Now(),
+		Username:  username,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+	}, nil
+}
+
+// Starts a passkey sign in, limited to the user's passkeys if a username is given
+func userSignInPasskeyBegin(db AdvancedDB, jwt JWTService, guard *SignInGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if guard.refuse(w, r) || guard.throttleChallenges(w, r) {
+			return
+		}
+		signIn, err := requestReceived[PasskeySignInRequest](r)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		allowedPasskeys := []Passkey{}
+		if signIn.Username != "" {
+			allowedPasskeys, err = db.getPasskeys(r.Context(), signIn.Username)
+			if err != nil {
+				Printing.PrintErrStr("Could not get passkeys: " + err.Error())
+				requestRespondCode(w, http.StatusInternalServerError)
+				return
+			}
+			if len(allowedPasskeys) == 0 { // Unknown users and users without passkeys look like everyone else
+				allowedPasskeys = []Passkey{decoyPasskey(signIn.Username, jwt)}
+			}
+		}
+		challenge := newWebAuthnChallenge()
+		err = db.setWebAuthnChallenge(r.Context(), challenge, webAuthnAuthentication+"|"+signIn.Username, webAuthnTimeout)
+		if err != nil {
+			Printing.PrintErrStr("Could not save passkey challenge: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		_, rpID := webAuthnRelyingParty(r)
+		requestRespond(w, map[string]any{
+			"challenge":        challenge,
+			"rpId":             rpID,
+			"timeout":          webAuthnTimeout.Milliseconds(),
+			"allowCredentials": passkeyDescriptors(allowedPasskeys),
+			"userVerification": "preferred",
+		})
+	}
+}
+
+// Checks the passkey's signature and issues a session. Users with two-factor authentication still need a code unless
+// the authenticator verified them itself.
+func userSignInPasskeyFinish(db AdvancedDB, jwt JWTService, guard *SignInGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if guard.refuse(w, r) {
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
+		assertion, err := requestReceived[PasskeyAssertion](r)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		passkey, userVerified, err := verifyPasskeyAssertion(r, db, *assertion)
+		if err != nil {
+			Printing.PrintErrStr("Could not sign in with passkey: " + err.Error())
+			guard.fail(r, "", SignInMethodPasskey)
+			requestRespondCode(w, http.StatusBadRequest) // Intentionally obscure the error
+			return
+		}
+		err = db.setPasskey(r.Context(), passkey)
+		if err != nil {
+			Printing.PrintErrStr("Could not update passkey: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		user, err := db.getUser(r.Context(), passkey.Username)
+		if err != nil || user == nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		if user.TOTPSecret != "" && !userVerified {
+			err = jwt.setTwoFactorJWT(w, r, user.Username)
+			if err != nil {
+				Printing.PrintErrStr("Could not start two-factor sign in: " + err.Error())
+				requestRespondCode(w, http.StatusInternalServerError)
+				return
+			}
+			requestRespond(w, SignInResponse{TwoFactor: true})
+			return
+		}
+		err = jwt.setJWT(w, r, *user)
+		if err != nil {
+			Printing.PrintErrStr("Could not start session: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		guard.succeed(r)
+		requestRespond(w, SignInResponse{})
+	}
+}
+
+// Returns the passkey with its new sign count and use time, and whether the authenticator verified the user
+func verifyPasskeyAssertion(r *http.Request, db AdvancedDB, assertion PasskeyAssertion) (Passkey, bool, error) {
+	origin, rpID := webAuthnRelyingParty(r)
+	clientDataJSON, err := webAuthnEncoding.DecodeString(assertion.Response.ClientDataJSON)
+	if err != nil {
+		return Passkey{}, false, errors.New("invalid client data encoding")
+	}
+	challenge, err := verifyWebAuthnClientData(clientDataJSON, "webauthn.get", origin)
+	if err != nil {
+		return Passkey{}, false, err
+	}
+	purpose, err := db.takeWebAuthnChallenge(r.Context(), challenge)
+	expectedUsername, found := strings.CutPrefix(purpose, webAuthnAuthentication+"|")
+	if err != nil || !found {
+		return Passkey{}, false, errors.New("unknown or expired challenge")
+	}
+	passkey, err := db.getPasskey(r.Context(), assertion.ID)
+	if err != nil || passkey == nil {
+		return Passkey{}, false, errors.New("unknown passkey")
+	}
+	if expectedUsername != "" && passkey.Username != expectedUsername {
+		return Passkey{}, false, errors.New("passkey belongs to another user")
+	}
+
+	rawAuthenticatorData, err := webAuthnEncoding.DecodeString(assertion.Response.AuthenticatorData)
+	if err != nil {
+		return Passkey{}, false, errors.New("invalid authenticator data encoding")
+	}
+	signature, err := webAuthnEncoding.DecodeString(assertion.Response.Signature)
+	if err != nil {
+		return Passkey{}, false, errors.New("invalid signature encoding")
+	}
+	authData, err := parseAuthenticatorData(rawAuthenticatorData, rpID)
+	if err != nil {
+		return Passkey{}, false, err
+	}
+	if !verifyPasskeySignature(passkey.PublicKey, rawAuthenticatorData, clientDataJSON, signature) {
+		return Passkey{}, false, errors.New("invalid signature")
+	}
+	// Authenticators that count uses should always count up, anything else suggests a cloned key
+	if (authData.signCount != 0 || passkey.SignCount != 0) && authData.signCount <= passkey.SignCount {
+		return Passkey{}, false, errors.New("passkey " + passkey.ID + " may have been cloned")
+	}
+	now := time.Now()
+	passkey.SignCount = authData.signCount
+	passkey.LastUsed = &now
+	return *passkey, authData.flags&authenticatorUserVerified != 0, nil
+}
+
+// Lists the signed in user's passkeys
+func passkeysGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get passkeys: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		passkeys, err := db.getPasskeys(r.Context(), claims.Username)
+		if err != nil {
+			Printing.PrintErrStr("Could not get passkeys: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		requestRespond(w, passkeys)
+	}
+}
+
+// Renames one of the signed in user's passkeys
+func passkeyRename(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not rename passkey: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		rename, err := requestReceived[PasskeyRename](r)
+		if err != nil || strings.TrimSpace(rename.Name) == "" {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		passkey, err := db.getPasskey(r.Context(), r.PathValue("id"))
+		if err != nil || passkey == nil || passkey.Username != claims.Username {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		oldPasskey := *passkey
+		passkey.Name = strings.TrimSpace(rename.Name)
+		err = db.setPasskey(r.Context(), *passkey)
+		if err != nil {
+			Printing.PrintErrStr("Could not rename passkey: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditPasskeyRename, passkey.Name, oldPasskey, passkey)
+		requestRespond(w, passkey)
+	}
+}
+
+// Revokes one of the signed in user's passkeys
+func passkeyRemove(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not remove passkey: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		passkey, err := db.getPasskey(r.Context(), r.PathValue("id"))
+		if err != nil || passkey == nil || passkey.Username != claims.Username {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		err = db.removePasskey(r.Context(), *passkey)
+		if err != nil {
+			Printing.PrintErrStr("Could not remove passkey: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditPasskeyRemove, passkey.Name, passkey, nil)
+		Printing.Println("Removed passkey \"" + passkey.Name + "\" for " + claims.Username)
+		requestRespondCode(w, http.StatusOK)
+	}
+}
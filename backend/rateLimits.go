@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Analytics reason for requests refused by a service's rate limits
+const blockedRateLimit = "rate_limit"
+
+type RateLimitKey string
+
+const (
+	RateLimitKeyIP     RateLimitKey = "ip"
+	RateLimitKeyAPIKey RateLimitKey = "api_key" // Falls back to the IP for requests without a valid API key for the service
+)
+
+// A token bucket per client, refilled by Requests every Window seconds and holding up to Burst tokens
+type RateLimit struct {
+	PathPrefix string       `json:"path_prefix"` // Empty limits every resource
+	Key        RateLimitKey `json:"key"`
+	Requests   int          `json:"requests"`
+	Window     int          `json:"window"` // Seconds
+	Burst      int          `json:"burst"`  // Defaults to Requests
+}
+
+// The state of a client's bucket after taking a token
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // Until the next token, only when not allowed
+	Reset      time.Duration // Until the bucket is full again
+}
+
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, capacity int, refillPerSecond float64) (RateLimitResult, error)
+}
+
+type RateLimiter struct {
+	store RateLimitStore
+	db    AdvancedDB
+}
+
+// Reads RATE_LIMIT_STORE, "memory" keeps buckets per instance and "valkey" shares them between instances
+func (limiter *RateLimiter) Setup(db AdvancedDB) {
+	limiter.db = db
+	switch strings.ToLower(os.Getenv("RATE_LIMIT_STORE")) {
+	case "valkey":
+		limiter.store = valkeyRateLimitStore{db: db}
+		Printing.Println("Rate limits are stored in Valkey")
+	case "", "memory":
+		store := &memoryRateLimitStore{buckets: map[string]*memoryRateLimitBucket{}}
+		go store.cleanUp()
+		limiter.store = store
+		Printing.Println("Rate limits are stored in memory")
+	default:
+		panic("Unknown RATE_LIMIT_STORE \"" + os.Getenv("RATE_LIMIT_STORE") + "\"")
+	}
+}
+
+func (rateLimit RateLimit) validate() error {
+	if rateLimit.Requests <= 0 || rateLimit.Window <= 0 || rateLimit.Burst < 0 {
+		return errors.New("rate limits need a positive number of requests and window")
+	}
+	if rateLimit.PathPrefix != "" && !strings.HasPrefix(rateLimit.PathPrefix, "/") {
+		return errors.New("rate limit path prefix \"" + rateLimit.PathPrefix + "\" must start with /")
+	}
+	switch rateLimit.Key {
+	case "", RateLimitKeyIP, RateLimitKeyAPIKey:
+	default:
+		return errors.New("unknown rate limit key \"" + string(rateLimit.Key) + "\"")
+	}
+	return nil
+}
+
+func (rateLimit RateLimit) capacity() int {
+	if rateLimit.Burst > 0 {
+		return rateLimit.Burst
+	}
+	return rateLimit.Requests
+}
+
+func (rateLimit RateLimit) refillPerSecond() float64 {
+	return float64(rateLimit.Requests) / float64(rateLimit.Window)
+}
+
+// Identifies whose bucket the request draws from. Only API keys that exist and can reach the service get their own
+// bucket, otherwise a fresh made up key on every request would never run out.
+func (limiter *RateLimiter) client(r *http.Request, service *ServiceLink, key RateLimitKey) string {
+	if rawAPIKey := requestAPIKey(r); key == RateLimitKeyAPIKey && rawAPIKey != "" {
+		apiKey, err := limiter.db.getAPIKey(r.Context(), rawAPIKey)
+		if err != nil {
+			Printing.PrintErrStr("Could not check API key for rate limit: " + err.Error())
+		} else if apiKey != nil && apiKey.Services.Includes(service.ID) {
+			return "key:" + apiKey.ID
+		}
+	}
+	return "ip:" + requestClientIP(r)
+}
+
+// Takes a token from every one of the service's limits covering the path, and sets the headers of the most
+// restrictive one. Returns false if the client is over any limit.
+func (limiter *RateLimiter) Allow(w http.ResponseWriter, r *http.Request, service *ServiceLink, path string) bool {
+	var mostRestrictive *RateLimitResult
+	var mostRestrictiveLimit RateLimit
+	clients := map[RateLimitKey]string{} // Limits keyed the same way share the API key lookup
+	for i, rateLimit := range service.RateLimits {
+		if !strings.HasPrefix(path, rateLimit.PathPrefix) {
+			continue
+		}
+		client, ok := clients[rateLimit.Key]
+		if !ok {
+			client = limiter.client(r, service, rateLimit.Key)
+			clients[rateLimit.Key] = client
+		}
+		key := service.ID + ":" + strconv.Itoa(i) + ":" + client
+		result, err := limiter.store.Take(r.Context(), key, rateLimit.capacity(), rateLimit.refillPerSecond())
+		if err != nil { // Fail open, CheckBag shouldn't take every service down with it
+			Printing.PrintErrStr("Could not check rate limit: " + err.Error())
+			continue
+		}
+		if mostRestrictive == nil || (!result.Allowed && mostRestrictive.Allowed) || (result.Allowed == mostRestrictive.Allowed && result.Remaining < mostRestrictive.Remaining) {
+			mostRestrictive = &result
+			mostRestrictiveLimit = rateLimit
+		}
+	}
+	if mostRestrictive == nil {
+		return true
+	}
+	mostRestrictive.writeHeaders(mostRestrictiveLimit, w.Header())
+	return mostRestrictive.Allowed
+}
+
+// Sets the RateLimit-* headers from the IETF draft, and Retry-After when the request was refused
+func (result RateLimitResult) writeHeaders(rateLimit RateLimit, header http.Header) {
+	header.Set("RateLimit-Limit", strconv.Itoa(rateLimit.capacity()))
+	header.Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+	header.Set("RateLimit-Policy", strconv.Itoa(rateLimit.Requests)+";w="+strconv.Itoa(rateLimit.Window)+";burst="+strconv.Itoa(rateLimit.capacity()))
+	if !result.Allowed {
+		header.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(result.RetryAfter.Seconds())))))
+	}
+}
+
+type memoryRateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	full    time.Time // When the bucket will be full again, and can be forgotten
+}
+
+type memoryRateLimitStore struct {
+	mutex   sync.Mutex
+	buckets map[string]*memoryRateLimitBucket
+}
+
+func (store *memoryRateLimitStore) Take(ctx context.Context, key string, capacity int, refillPerSecond float64) (RateLimitResult, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	now := time.Now()
+	bucket, ok := store.buckets[key]
+	if !ok {
+		bucket = &memoryRateLimitBucket{tokens: float64(capacity), updated: now}
+		store.buckets[key] = bucket
+	}
+	bucket.tokens = min(float64(capacity), bucket.tokens+now.Sub(bucket.updated).Seconds()*refillPerSecond)
+	bucket.updated = now
+	result := takeRateLimitToken(&bucket.tokens, capacity, refillPerSecond)
+	bucket.full = now.Add(result.Reset)
+	return result, nil
+}
+
+// Forgets full buckets so clients that went away don't use memory forever
+func (store *memoryRateLimitStore) cleanUp() {
+	for range time.Tick(time.Minute) {
+		store.mutex.Lock()
+		now := time.Now()
+		for key, bucket := range store.buckets {
+			if now.After(bucket.full) {
+				delete(store.buckets, key)
+			}
+		}
+		store.mutex.Unlock()
+	}
+}
+
+type valkeyRateLimitStore struct {
+	db AdvancedDB
+}
+
+func (store valkeyRateLimitStore) Take(ctx context.Context, key string, capacity int, refillPerSecond float64) (RateLimitResult, error) {
+	return store.db.takeRateLimitToken(ctx, key, capacity, refillPerSecond)
+}
+
+// Takes a token from an already refilled bucket
+func takeRateLimitToken(tokens *float64, capacity int, refillPerSecond float64) RateLimitResult {
+	result := RateLimitResult{}
+	if *tokens >= 1 {
+		*tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - *tokens) / refillPerSecond * float64(time.Second))
+	}
+	result.Remaining = int(*tokens)
+	result.Reset = time.Duration((float64(capacity) - *tokens) / refillPerSecond * float64(time.Second))
+	return result
+}
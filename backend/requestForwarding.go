@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -15,12 +17,39 @@ import (
 )
 
 // Attempts act as a proxy server for incoming requests to outgoing services
-func requestForwarding(serviceLinks *ServiceLinks, db AdvancedDB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+func requestForwarding(serviceLinks *ServiceLinks, db AdvancedDB, scannerRules *ScannerRuleEngine, bans *BanEngine, rateLimiter *RateLimiter, waf *WAFEngine, blockLists *BlockListEngine, jwt JWTService) http.HandlerFunc {
+	return func(writer http.ResponseWriter, r *http.Request) {
+		r, annotations := annotateRequest(r)
+		annotations.ScannerRules = scannerRules.Match(r)
+		annotations.BlockLists = blockLists.Match(requestClientIP(r))
+		w := &statusRecorder{ResponseWriter: writer}
+		defer func() { go bans.Observe(r, w.statusCode, annotations, db) }()
+
 		requestedService, err := serviceLinks.GetServiceFromIncomingURL(r.Host)
+		serviceID := unmatchedServiceID
+		if err == nil {
+			serviceID = requestedService.ID
+		}
+		go recordSuspiciousActivity(r, serviceID, annotations.ScannerRules, db)
+		if rejectBannedClient(w, r, annotations, *serviceLinks, db) {
+			return
+		}
 		if err != nil {
 			Printing.PrintErrStr("No service found for incoming URL \"" + r.Host + "\": " + err.Error())
 			requestRespondCode(w, http.StatusNotFound)
+			go analytics(r, http.StatusNotFound, *serviceLinks, db, unforwardedRequestBytes(r), unforwardedResponseBytes(r, w, http.StatusNotFound, 4)) // 4 bytes for the "null" body
+			return
+		}
+		if !requestedService.AccessList.Allows(requestClientIP(r)) {
+			blockRequest(w, r, annotations, blockedAccessList, requestedService.AccessList.Denial, *serviceLinks, db)
+			return
+		}
+		if !requestedService.GeoFence.Allows(requestCountry(r)) {
+			blockRequest(w, r, annotations, blockedGeoFence, requestedService.GeoFence.Denial, *serviceLinks, db)
+			return
+		}
+		if requestedService.BlockLists.Blocks(annotations.BlockLists) {
+			blockRequest(w, r, annotations, blockedBlockList, requestedService.BlockLists.Denial, *serviceLinks, db)
 			return
 		}
 		outgoingAddress := requestedService.OutgoingAddress.String()
@@ -30,17 +59,76 @@ func requestForwarding(serviceLinks *ServiceLinks, db AdvancedDB) http.HandlerFu
 		}
 		outgoingAddress += path
 
+		if enforceCrawlerPolicy(w, r, annotations, requestedService, path, *serviceLinks, db) {
+			return
+		}
+		if !rateLimiter.Allow(w, r, requestedService, path) {
+			blockRequest(w, r, annotations, blockedRateLimit, DenialResponse{StatusCode: http.StatusTooManyRequests}, *serviceLinks, db)
+			return
+		}
+		if browserChallenge(w, r, annotations, requestedService, path, jwt, *serviceLinks, db) {
+			return
+		}
+		if inspectRequest(w, r, annotations, requestedService, waf, *serviceLinks, db) {
+			return
+		}
+
+		if requestedService.PageTracking && strings.HasPrefix(path, pageTrackingPrefix) {
+			pageTrackingHandler(w, r, requestedService, path, db)
+			return
+		}
+
 		// Check for WebSocket upgrade
 		if websocket.IsWebSocketUpgrade(r) {
 			websocketProxy(w, r, requestedService.OutgoingAddress, path, *serviceLinks, db)
 		} else if isSSERequest(r) {
 			sseProxy(w, r, requestedService.OutgoingAddress, path, *serviceLinks, db)
 		} else {
-			restForwarding(w, r, requestedService.OutgoingAddress, path, *serviceLinks, db)
+			restForwarding(w, r, requestedService, path, *serviceLinks, db)
 		}
 	}
 }
 
+// Remembers the status code of the response written through it
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (recorder *statusRecorder) WriteHeader(statusCode int) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = statusCode
+	}
+	recorder.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (recorder *statusRecorder) Write(data []byte) (int, error) {
+	if recorder.statusCode == 0 {
+		recorder.statusCode = http.StatusOK
+	}
+	return recorder.ResponseWriter.Write(data)
+}
+
+func (recorder *statusRecorder) Flush() {
+	if flusher, ok := recorder.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Needed for WebSocket upgrades
+func (recorder *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := recorder.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	recorder.statusCode = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (recorder *statusRecorder) Unwrap() http.ResponseWriter {
+	return recorder.ResponseWriter
+}
+
 // isSSERequest checks if the request is for Server-Sent Events
 func isSSERequest(r *http.Request) bool {
 	accept := r.Header.Get("Accept")
@@ -172,8 +260,9 @@ func sseProxy(w http.ResponseWriter, r *http.Request, serviceAddress ServiceAddr
 }
 
 // Handles typical HTTP requests like GET, POST, etc.
-func restForwarding(w http.ResponseWriter, r *http.Request, serviceAddress ServiceAddress, path string, serviceLinks ServiceLinks, db AdvancedDB) {
-	outgoingAddress := serviceAddress.String() + path
+// pageTracking adds the tracking script to HTML responses.
+func restForwarding(w http.ResponseWriter, r *http.Request, service *ServiceLink, path string, serviceLinks ServiceLinks, db AdvancedDB) {
+	outgoingAddress := service.OutgoingAddress.String() + path
 	// Preserve query parameters for HTTP requests
 	if r.URL.RawQuery != "" {
 		outgoingAddress += "?" + r.URL.RawQuery
@@ -206,6 +295,10 @@ func restForwarding(w http.ResponseWriter, r *http.Request, serviceAddress Servi
 			incomingHeaderBytes += len(fmt.Sprintf("%s: %s\r\n", name, value))
 		}
 	}
+	injectScript := service.PageTracking && isDocumentRequest(r)
+	if injectScript { // Let the HTTP client negotiate and decompress the page so the script can be added
+		proxyRequest.Header.Del("Accept-Encoding")
+	}
 
 	client := &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -226,6 +319,16 @@ func restForwarding(w http.ResponseWriter, r *http.Request, serviceAddress Servi
 		requestRespondCode(w, http.StatusInternalServerError)
 		return
 	}
+	if service.CrawlerPolicy.RobotsTxt && path == "/robots.txt" && proxyResponse.StatusCode == http.StatusNotFound {
+		responseBytes = []byte(generateRobotsTxt(service.CrawlerPolicy))
+		proxyResponse.StatusCode = http.StatusOK
+		proxyResponse.Header = http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+	}
+	responseSizes.record(service.ID, path, len(responseBytes))
+	if injectScript && shouldInjectTrackingScript(proxyResponse) {
+		responseBytes = injectTrackingScript(responseBytes)
+		proxyResponse.Header.Del("Content-Length") // Recalculated when writing the response
+	}
 	// Add proxy response headers to client response
 	outgoingHeaderBytes := 0
 	for name, values := range proxyResponse.Header {
@@ -394,3 +497,32 @@ func forwardSocketMessage(ctx context.Context, incoming *websocket.Conn, outgoin
 		*bytesTransferred += len(message)
 	}
 }
+
+// Approximate size of the request line and headers, for requests that aren't forwarded
+func unforwardedRequestBytes(r *http.Request) int {
+	headerBytes := 0
+	for name, values := range r.Header {
+		for _, value := range values {
+			headerBytes += len(fmt.Sprintf("%s: %s\r\n", name, value))
+		}
+	}
+	return headerBytes + len(fmt.Sprintf("%s %s %s\r\n", r.Method, r.RequestURI, r.Proto)) + 2
+}
+
+// Answers a request CheckBag refused to forward, recording why in analytics
+func blockRequest(w http.ResponseWriter, r *http.Request, annotations *RequestAnnotations, reason string, denial DenialResponse, serviceLinks ServiceLinks, db AdvancedDB) {
+	annotations.Blocked = reason
+	statusCode, bodyBytes := denial.write(w)
+	go analytics(r, statusCode, serviceLinks, db, unforwardedRequestBytes(r), unforwardedResponseBytes(r, w, statusCode, bodyBytes))
+}
+
+// Approximate size of a response CheckBag answered itself
+func unforwardedResponseBytes(r *http.Request, w http.ResponseWriter, statusCode int, bodyBytes int) int {
+	headerBytes := 0
+	for name, values := range w.Header() {
+		for _, value := range values {
+			headerBytes += len(fmt.Sprintf("%s: %s\r\n", name, value))
+		}
+	}
+	return bodyBytes + headerBytes + len(fmt.Sprintf("%s %d %s\r\n", r.Proto, statusCode, http.StatusText(statusCode))) + 2
+}
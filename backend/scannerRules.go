@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+type ScannerRuleTarget string
+
+const (
+	ScannerRuleTargetPath      ScannerRuleTarget = "path"
+	ScannerRuleTargetQuery     ScannerRuleTarget = "query"
+	ScannerRuleTargetUserAgent ScannerRuleTarget = "user_agent"
+)
+
+// A signature of vulnerability scanning, matched case-insensitively against part of a request
+type ScannerRule struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Target  ScannerRuleTarget `json:"target"`
+	Pattern string            `json:"pattern"` // Go regular expression
+	Score   int               `json:"score"`   // Added to the client's suspicion score on every match
+	BuiltIn bool              `json:"built_in"`
+}
+
+type compiledScannerRule struct {
+	ScannerRule
+	expression *regexp.Regexp
+}
+
+type ScannerRuleEngine struct {
+	mutex sync.RWMutex
+	rules []compiledScannerRule
+}
+
+var builtInScannerRules = []ScannerRule{
+	{ID: "builtin-env-file", Name: "Environment file", Target: ScannerRuleTargetPath, Pattern: `/\.env(\.|$|/)`, Score: 20},
+	{ID: "builtin-git", Name: "Git repository", Target: ScannerRuleTargetPath, Pattern: `/\.git(/|$)`, Score: 20},
+	{ID: "builtin-svn", Name: "SVN/Mercurial repository", Target: ScannerRuleTargetPath, Pattern: `/\.(svn|hg)(/|$)`, Score: 20},
+	{ID: "builtin-wordpress", Name: "WordPress login/admin", Target: ScannerRuleTargetPath, Pattern: `/(wp-login\.php|wp-admin|xmlrpc\.php|wp-content/plugins|wp-includes)`, Score: 10},
+	{ID: "builtin-php-admin", Name: "phpMyAdmin/Adminer", Target: ScannerRuleTargetPath, Pattern: `/(phpmyadmin|pma|myadmin|adminer)(\.php|/|$)`, Score: 15},
+	{ID: "builtin-phpunit", Name: "PHPUnit RCE", Target: ScannerRuleTargetPath, Pattern: `/vendor/phpunit/`, Score: 30},
+	{ID: "builtin-php-probe", Name: "PHP info/shell probe", Target: ScannerRuleTargetPath, Pattern: `/(phpinfo|info|shell|cmd|eval-stdin|c99|r57)\.php`, Score: 20},
+	{ID: "builtin-cloud-credentials", Name: "Cloud credentials", Target: ScannerRuleTargetPath, Pattern: `/(\.aws/credentials|\.docker/config\.json|\.kube/config|\.ssh/|id_rsa)`, Score: 30},
+	{ID: "builtin-config-files", Name: "Server config files", Target: ScannerRuleTargetPath, Pattern: `/(\.htaccess|\.htpasswd|web\.config|\.DS_Store|config\.php\.bak|wp-config\.php)`, Score: 15},
+	{ID: "builtin-path-traversal", Name: "Path traversal", Target: ScannerRuleTargetPath, Pattern: `(\.\./|\.\.%2f|%2e%2e/|/etc/passwd|/proc/self/)`, Score: 30},
+	{ID: "builtin-cgi", Name: "CGI scripts", Target: ScannerRuleTargetPath, Pattern: `/cgi-bin/`, Score: 15},
+	{ID: "builtin-java-actuator", Name: "Spring actuator / Java consoles", Target: ScannerRuleTargetPath, Pattern: `/(actuator|jmx-console|manager/html|solr/admin|console/login)`, Score: 15},
+	{ID: "builtin-router-exploits", Name: "Router/IoT exploits", Target: ScannerRuleTargetPath, Pattern: `/(boaform|hnap1|goform|setup\.cgi|gponform|cgi/ddns|device\.rsp)`, Score: 30},
+	{ID: "builtin-exchange", Name: "Exchange/OWA probes", Target: ScannerRuleTargetPath, Pattern: `/(owa/auth|autodiscover/autodiscover\.xml|ecp/)`, Score: 10},
+	{ID: "builtin-server-status", Name: "Server status pages", Target: ScannerRuleTargetPath, Pattern: `/server-(status|info)(/|$)`, Score: 10},
+	{ID: "builtin-backup-files", Name: "Backup archives", Target: ScannerRuleTargetPath, Pattern: `/(backup|db|database|dump|site|www)\.(sql|zip|tar|tar\.gz|tgz|rar|bak)$`, Score: 20},
+	{ID: "builtin-sql-injection", Name: "SQL injection probe", Target: ScannerRuleTargetQuery, Pattern: `(union(\s|\+|%20)+select|'(\s|\+|%20)*or(\s|\+|%20)+'?1'?=|sleep\(\d+\)|benchmark\()`, Score: 30},
+	{ID: "builtin-log4shell", Name: "Log4Shell", Target: ScannerRuleTargetQuery, Pattern: `\$\{jndi:`, Score: 50},
+	{ID: "builtin-log4shell-user-agent", Name: "Log4Shell", Target: ScannerRuleTargetUserAgent, Pattern: `\$\{jndi:`, Score: 50},
+	{ID: "builtin-scanner-tools", Name: "Scanner tools", Target: ScannerRuleTargetUserAgent, Pattern: `(sqlmap|nikto|nmap|masscan|zgrab|nuclei|wpscan|dirbuster|gobuster|ffuf|feroxbuster|acunetix|nessus|openvas|censysinspect|l9explore|l9tcpid)`, Score: 25},
+}
+
+func (rule ScannerRule) compile() (compiledScannerRule, error) {
+	switch rule.Target {
+	case ScannerRuleTargetPath, ScannerRuleTargetQuery, ScannerRuleTargetUserAgent:
+	default:
+		return compiledScannerRule{}, errors.New("unknown target \"" + string(rule.Target) + "\"")
+	}
+	expression, err := regexp.Compile("(?i)" + rule.Pattern)
+	if err != nil {
+		return compiledScannerRule{}, err
+	}
+	return compiledScannerRule{ScannerRule: rule, expression: expression}, nil
+}
+
+func (engine *ScannerRuleEngine) Setup(db AdvancedDB) {
+	userRules, err := db.getScannerRules(context.Background())
+	if err != nil {
+		Printing.PrintErrStr("Could not get scanner rules from database, using built-in rules only: " + err.Error())
+	}
+	err = engine.SetRules(userRules)
+	if err != nil { // A rule that compiled when saved should still compile, but don't leave the engine empty
+		Printing.PrintErrStr(err.Error())
+		engine.SetRules(nil)
+	}
+	Printing.Println("Loaded " + strconv.Itoa(len(engine.Rules())) + " scanner rules")
+}
+
+// Replaces the user-defined rules, built-in rules are always included
+func (engine *ScannerRuleEngine) SetRules(userRules []ScannerRule) error {
+	rules := make([]compiledScannerRule, 0, len(builtInScannerRules)+len(userRules))
+	for _, rule := range builtInScannerRules {
+		rule.BuiltIn = true
+		compiledRule, err := rule.compile()
+		if err != nil {
+			panic("Built-in scanner rule " + rule.ID + " is invalid: " + err.Error())
+		}
+		rules = append(rules, compiledRule)
+	}
+	for _, rule := range userRules {
+		rule.BuiltIn = false
+		compiledRule, err := rule.compile()
+		if err != nil {
+			return errors.New("Scanner rule \"" + rule.Name + "\" is invalid: " + err.Error())
+		}
+		rules = append(rules, compiledRule)
+	}
+
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.rules = rules
+	return nil
+}
+
+// All rules matching the request
+func (engine *ScannerRuleEngine) Match(r *http.Request) []ScannerRule {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	var matches []ScannerRule
+	for _, rule := range engine.rules {
+		var subject string
+		switch rule.Target {
+		case ScannerRuleTargetPath:
+			subject = "/" + r.PathValue("path")
+		case ScannerRuleTargetQuery:
+			subject = r.URL.RawQuery
+		case ScannerRuleTargetUserAgent:
+			subject = r.UserAgent()
+		}
+		if subject != "" && rule.expression.MatchString(subject) {
+			matches = append(matches, rule.ScannerRule)
+		}
+	}
+	return matches
+}
+
+func (engine *ScannerRuleEngine) Rules() []ScannerRule {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	rules := make([]ScannerRule, len(engine.rules))
+	for i, rule := range engine.rules {
+		rules[i] = rule.ScannerRule
+	}
+	return rules
+}
+
+func scannerRulesGet(engine *ScannerRuleEngine, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get scanner rules: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		requestRespond(w, engine.Rules())
+	}
+}
+
+// Replaces all user-defined scanner rules
+func scannerRulesSet(engine *ScannerRuleEngine, db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		newRules, claims, err := formatUserRequest[[]ScannerRule](r, jwt, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not set scanner rules: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+
+		// Built-in rules aren't stored
+		userRules := slices.DeleteFunc(*newRules, func(rule ScannerRule) bool { return rule.BuiltIn })
+		for i := range userRules {
+			if userRules[i].ID == "" {
+				userRules[i].ID = generateRandomString(15)
+			}
+		}
+		oldRules := slices.DeleteFunc(engine.Rules(), func(rule ScannerRule) bool { return rule.BuiltIn })
+		err = engine.SetRules(userRules)
+		if err != nil {
+			Printing.PrintErrStr(err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, err.Error())
+			return
+		}
+		err = db.setScannerRules(r.Context(), userRules)
+		if err != nil {
+			Printing.PrintErrStr("Could not save scanner rules: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditScannerRulesSet, "", oldRules, userRules)
+		Printing.Println("Updated scanner rules")
+		requestRespond(w, engine.Rules())
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A subset of ModSecurity's SecLang, enough for common OWASP Core Rule Set style rules:
+//   - SecRule VARIABLES "OPERATOR" "ACTIONS", with chain
+//   - SecRuleRemoveById, and SecRuleEngine/SecDefaultAction/SecAction are accepted and ignored
+//   - Variables: ARGS, ARGS_GET, ARGS_POST, ARGS_NAMES, QUERY_STRING, REQUEST_URI, REQUEST_FILENAME,
+//     REQUEST_BASENAME, REQUEST_METHOD, REQUEST_PROTOCOL, REQUEST_HEADERS, REQUEST_HEADERS_NAMES, REQUEST_COOKIES,
+//     REQUEST_COOKIES_NAMES, REQUEST_BODY, and REMOTE_ADDR, with ":key", ":/regex/" and "!" exclusions
+//   - Operators: @rx, @pm, @contains, @streq, @beginsWith, @endsWith, @within, @eq, @gt, @ge, @lt, @le, negated with !
+//   - Transformations: none, lowercase, uppercase, urlDecode, urlDecodeUni, htmlEntityDecode, compressWhitespace,
+//     removeWhitespace, removeNulls, trim, and length
+//   - Actions: id, msg, phase, deny, block, drop, pass, status, t, chain, and informational actions like tag
+
+type wafRule struct {
+	ID              int
+	Message         string
+	Disruptive      bool // Blocks the request when the service's WAF is in blocking mode
+	variables       []wafVariable
+	operator        wafOperator
+	transformations []func(string) string
+	chained         *wafRule // Must also match for the rule to match
+}
+
+type wafVariable struct {
+	collection string
+	key        string         // Only values with this key, case-insensitive
+	keyPattern *regexp.Regexp // Only values with a key matching this
+	excluded   bool           // Removes matching keys from the rest of the variables
+}
+
+type wafOperator struct {
+	name     string
+	argument string
+	negated  bool
+	pattern  *regexp.Regexp
+	phrases  []string
+	number   int
+}
+
+var wafCollections = []string{
+	"ARGS", "ARGS_GET", "ARGS_POST", "ARGS_NAMES", "QUERY_STRING", "REQUEST_URI", "REQUEST_FILENAME", "REQUEST_BASENAME",
+	"REQUEST_METHOD", "REQUEST_PROTOCOL", "REQUEST_HEADERS", "REQUEST_HEADERS_NAMES", "REQUEST_COOKIES",
+	"REQUEST_COOKIES_NAMES", "REQUEST_BODY", "REMOTE_ADDR",
+}
+
+var wafTransformations = map[string]func(string) string{
+	"lowercase":          strings.ToLower,
+	"uppercase":          strings.ToUpper,
+	"urlDecode":          wafURLDecode,
+	"urlDecodeUni":       wafURLDecode,
+	"htmlEntityDecode":   html.UnescapeString,
+	"compressWhitespace": func(value string) string { return strings.Join(strings.Fields(value), " ") },
+	"removeWhitespace":   func(value string) string { return strings.Join(strings.Fields(value), "") },
+	"removeNulls":        func(value string) string { return strings.ReplaceAll(value, "\x00", "") },
+	"trim":               strings.TrimSpace,
+	"length":             func(value string) string { return strconv.Itoa(len(value)) },
+}
+
+// Informational actions that don't change how a rule is evaluated
+var wafIgnoredActions = []string{
+	"tag", "severity", "ver", "rev", "maturity", "accuracy", "logdata", "log", "nolog", "auditlog", "noauditlog",
+	"capture", "multiMatch", "setvar", "ctl", "expirevar", "initcol", "skipAfter", "skip", "allow", "status",
+}
+
+// Parses the rule set, returning an error naming the offending line
+func parseSecLang(source string) ([]wafRule, error) {
+	var rules []wafRule
+	var removedIDs []int
+	chaining := false // The previous rule chains to this one
+	for _, line := range joinSecLangLines(source) {
+		lineError := func(message string) error { return errors.New("line " + strconv.Itoa(line.number) + ": " + message) }
+		text := strings.TrimSpace(line.text)
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		arguments, err := splitSecLangArguments(text)
+		if err != nil {
+			return nil, lineError(err.Error())
+		}
+		switch arguments[0] {
+		case "SecRuleEngine", "SecDefaultAction", "SecAction", "SecMarker", "SecComponentSignature":
+		case "SecRuleRemoveById":
+			for _, rawID := range arguments[1:] {
+				id, err := strconv.Atoi(rawID)
+				if err != nil {
+					return nil, lineError("invalid rule ID \"" + rawID + "\"")
+				}
+				removedIDs = append(removedIDs, id)
+			}
+		case "SecRule":
+			if len(arguments) != 3 && len(arguments) != 4 {
+				return nil, lineError("SecRule needs variables, an operator, and actions")
+			}
+			actions := ""
+			if len(arguments) == 4 {
+				actions = arguments[3]
+			}
+			rule, chains, err := parseSecRule(arguments[1], arguments[2], actions)
+			if err != nil {
+				return nil, lineError(err.Error())
+			}
+			if chaining {
+				lastChainLink(&rules[len(rules)-1]).chained = &rule
+			} else if rule.ID == 0 {
+				return nil, lineError("rule needs an id action")
+			} else {
+				rules = append(rules, rule)
+			}
+			chaining = chains
+		default:
+			return nil, lineError("unsupported directive \"" + arguments[0] + "\"")
+		}
+	}
+	if chaining {
+		return nil, errors.New("the last rule is chained to nothing")
+	}
+	return slices.DeleteFunc(rules, func(rule wafRule) bool { return slices.Contains(removedIDs, rule.ID) }), nil
+}
+
+func lastChainLink(rule *wafRule) *wafRule {
+	for rule.chained != nil {
+		rule = rule.chained
+	}
+	return rule
+}
+
+type secLangLine struct {
+	number int // Where the line starts, for errors
+	text   string
+}
+
+// Joins lines ending in a backslash with the next line
+func joinSecLangLines(source string) []secLangLine {
+	var lines []secLangLine
+	continuing := false
+	for i, text := range strings.Split(strings.ReplaceAll(source, "\r\n", "\n"), "\n") {
+		if continuing {
+			lines[len(lines)-1].text += " " + strings.TrimSpace(text)
+		} else {
+			lines = append(lines, secLangLine{number: i + 1, text: text})
+		}
+		continuing = strings.HasSuffix(lines[len(lines)-1].text, "\\")
+		lines[len(lines)-1].text = strings.TrimSuffix(lines[len(lines)-1].text, "\\")
+	}
+	return lines
+}
+
+// Splits a directive on whitespace, keeping double quoted arguments together
+func splitSecLangArguments(line string) ([]string, error) {
+	var arguments []string
+	var argument strings.Builder
+	inQuotes := false
+	inArgument := false
+	for i := 0; i < len(line); i++ {
+		character := line[i]
+		switch {
+		case character == '\\' && inQuotes && i+1 < len(line) && line[i+1] == '"':
+			argument.WriteByte('"')
+			i++
+		case character == '"':
+			inQuotes = !inQuotes
+			inArgument = true
+		case (character == ' ' || character == '\t') && !inQuotes:
+			if inArgument {
+				arguments = append(arguments, argument.String())
+				argument.Reset()
+				inArgument = false
+			}
+		default:
+			argument.WriteByte(character)
+			inArgument = true
+		}
+	}
+	if inQuotes {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArgument {
+		arguments = append(arguments, argument.String())
+	}
+	return arguments, nil
+}
+
+// Parses one SecRule, reporting whether it chains to the next
+func parseSecRule(rawVariables string, rawOperator string, rawActions string) (wafRule, bool, error) {
+	rule := wafRule{}
+	for _, rawVariable := range strings.Split(rawVariables, "|") {
+		variable, err := parseWAFVariable(rawVariable)
+		if err != nil {
+			return wafRule{}, false, err
+		}
+		rule.variables = append(rule.variables, variable)
+	}
+	operator, err := parseWAFOperator(rawOperator)
+	if err != nil {
+		return wafRule{}, false, err
+	}
+	rule.operator = operator
+
+	chains := false
+	for _, action := range splitSecLangActions(rawActions) {
+		name, value, _ := strings.Cut(action, ":")
+		name = strings.TrimSpace(name)
+		value = strings.Trim(strings.TrimSpace(value), "'")
+		switch name {
+		case "id":
+			rule.ID, err = strconv.Atoi(value)
+			if err != nil || rule.ID <= 0 {
+				return wafRule{}, false, errors.New("invalid rule id \"" + value + "\"")
+			}
+		case "msg":
+			rule.Message = value
+		case "phase":
+		case "deny", "block", "drop":
+			rule.Disruptive = true
+		case "pass":
+			rule.Disruptive = false
+		case "chain":
+			chains = true
+		case "t":
+			if value == "none" {
+				rule.transformations = nil
+				continue
+			}
+			transformation, ok := wafTransformations[value]
+			if !ok {
+				return wafRule{}, false, errors.New("unsupported transformation \"" + value + "\"")
+			}
+			rule.transformations = append(rule.transformations, transformation)
+		case "":
+		default:
+			if !slices.Contains(wafIgnoredActions, name) {
+				return wafRule{}, false, errors.New("unsupported action \"" + name + "\"")
+			}
+		}
+	}
+	return rule, chains, nil
+}
+
+func parseWAFVariable(rawVariable string) (wafVariable, error) {
+	variable := wafVariable{}
+	rawVariable = strings.TrimSpace(rawVariable)
+	if strings.HasPrefix(rawVariable, "&") {
+		return wafVariable{}, errors.New("counting variables with & isn't supported")
+	}
+	if strings.HasPrefix(rawVariable, "!") {
+		variable.excluded = true
+		rawVariable = rawVariable[1:]
+	}
+	collection, key, hasKey := strings.Cut(rawVariable, ":")
+	variable.collection = strings.ToUpper(collection)
+	if !slices.Contains(wafCollections, variable.collection) {
+		return wafVariable{}, errors.New("unsupported variable \"" + collection + "\"")
+	}
+	if hasKey {
+		key = strings.Trim(key, "'")
+		if len(key) > 1 && strings.HasPrefix(key, "/") && strings.HasSuffix(key, "/") {
+			pattern, err := regexp.Compile("(?i)" + key[1:len(key)-1])
+			if err != nil {
+				return wafVariable{}, errors.New("invalid variable key pattern: " + err.Error())
+			}
+			variable.keyPattern = pattern
+		} else {
+			variable.key = strings.ToLower(key)
+		}
+	}
+	if variable.excluded && variable.key == "" && variable.keyPattern == nil {
+		return wafVariable{}, errors.New("exclusions need a key")
+	}
+	return variable, nil
+}
+
+func parseWAFOperator(rawOperator string) (wafOperator, error) {
+	operator := wafOperator{}
+	if strings.HasPrefix(rawOperator, "!") {
+		operator.negated = true
+		rawOperator = rawOperator[1:]
+	}
+	if !strings.HasPrefix(rawOperator, "@") { // A bare operator is a regular expression
+		rawOperator = "@rx " + rawOperator
+	}
+	name, argument, _ := strings.Cut(rawOperator[1:], " ")
+	operator.name = name
+	operator.argument = argument
+	switch name {
+	case "rx":
+		pattern, err := regexp.Compile(argument)
+		if err != nil {
+			return wafOperator{}, errors.New("invalid regular expression: " + err.Error())
+		}
+		operator.pattern = pattern
+	case "pm":
+		operator.phrases = strings.Fields(strings.ToLower(argument))
+	case "contains", "streq", "beginsWith", "endsWith", "within":
+	case "eq", "gt", "ge", "lt", "le":
+		number, err := strconv.Atoi(strings.TrimSpace(argument))
+		if err != nil {
+			return wafOperator{}, errors.New("@" + name + " needs a number")
+		}
+		operator.number = number
+	default:
+		return wafOperator{}, errors.New("unsupported operator \"@" + name + "\"")
+	}
+	return operator, nil
+}
+
+// Splits actions on commas outside of single quotes
+func splitSecLangActions(rawActions string) []string {
+	var actions []string
+	inQuotes := false
+	start := 0
+	for i, character := range rawActions {
+		switch {
+		case character == '\'':
+			inQuotes = !inQuotes
+		case character == ',' && !inQuotes:
+			actions = append(actions, rawActions[start:i])
+			start = i + 1
+		}
+	}
+	return append(actions, rawActions[start:])
+}
+
+func (operator wafOperator) matches(value string) bool {
+	var matched bool
+	switch operator.name {
+	case "rx":
+		matched = operator.pattern.MatchString(value)
+	case "pm":
+		lowerValue := strings.ToLower(value)
+		matched = slices.ContainsFunc(operator.phrases, func(phrase string) bool { return strings.Contains(lowerValue, phrase) })
+	case "contains":
+		matched = strings.Contains(value, operator.argument)
+	case "streq":
+		matched = value == operator.argument
+	case "beginsWith":
+		matched = strings.HasPrefix(value, operator.argument)
+	case "endsWith":
+		matched = strings.HasSuffix(value, operator.argument)
+	case "within":
+		matched = value != "" && strings.Contains(operator.argument, value)
+	default:
+		number, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+		switch operator.name {
+		case "eq":
+			matched = number == operator.number
+		case "gt":
+			matched = number > operator.number
+		case "ge":
+			matched = number >= operator.number
+		case "lt":
+			matched = number < operator.number
+		case "le":
+			matched = number <= operator.number
+		}
+	}
+	return matched != operator.negated
+}
+
+// Decodes percent-encoding and plus signs, leaving malformed sequences as they are
+func wafURLDecode(value string) string {
+	decoded, err := url.QueryUnescape(value)
+	if err != nil {
+		var builder strings.Builder
+		for i := 0; i < len(value); i++ {
+			if value[i] == '%' && i+2 < len(value) {
+				if decodedByte, err := strconv.ParseUint(value[i+1:i+3], 16, 8); err == nil {
+					builder.WriteByte(byte(decodedByte))
+					i += 2
+					continue
+				}
+			}
+			if value[i] == '+' {
+				builder.WriteByte(' ')
+				continue
+			}
+			builder.WriteByte(value[i])
+		}
+		return builder.String()
+	}
+	return decoded
+}
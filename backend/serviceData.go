@@ -17,32 +17,49 @@ type ServiceData struct {
 }
 
 type Analytic struct {
-	Quantity      int            `json:"quantity"`
-	Country       map[string]int `json:"country"`
-	IP            map[string]int `json:"ip"`
-	Resource      map[string]int `json:"resource"`
-	ResponseCode  map[int]int    `json:"response_code"`
-	SentBytes     int            `json:"sent_bytes"`
-	ReceivedBytes int            `json:"received_bytes"`
+	Quantity          int            `json:"quantity"`
+	Country           map[string]int `json:"country"`
+	IP                map[string]int `json:"ip"`
+	Resource          map[string]int `json:"resource"`
+	ResponseCode      map[int]int    `json:"response_code"`
+	SentBytes         int            `json:"sent_bytes"`
+	ReceivedBytes     int            `json:"received_bytes"`
+	Browser           map[string]int `json:"browser"`
+	OS                map[string]int `json:"os"`
+	Device            map[string]int `json:"device"`
+	Bot               map[string]int `json:"bot"`
+	Referrer          map[string]int `json:"referrer"`   // Only the top referrers of the bucket
+	Host              map[string]int `json:"host"`       // Only for unmatched requests
+	UserAgent         map[string]int `json:"user_agent"` // Only for unmatched requests
+	ScannerRule       map[string]int `json:"scanner_rule"`
+	Blocked           map[string]int `json:"blocked"`             // Requests CheckBag refused to forward, by reason
+	BlockedCountry    map[string]int `json:"blocked_country"`     // Requests CheckBag refused to forward, by country
+	Challenge         map[string]int `json:"challenge"`           // Browser challenges issued, passed, and failed
+	WAFRule           map[string]int `json:"waf_rule"`            // Matched WAF rule IDs
+	BlockList         map[string]int `json:"block_list"`          // Block lists containing the client's IP
+	BlockedCrawler    map[string]int `json:"blocked_crawler"`     // Requests refused by crawler policies, by crawler
+	CrawlerBytesSaved map[string]int `json:"crawler_bytes_saved"` // Estimated response bytes not sent to refused crawlers
+	VisitSummary
+	PageViewSummary
+	Events map[string]EventSummary `json:"events"`
 }
 
 func getServiceData(serviceLinks *ServiceLinks, db AdvancedDB, jwt JWTService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ctx := r.Context()
 		queryParams := r.URL.Query()
-		err := jwt.ReadAndValidateJWT(r)
+		scope, err := requestServiceScope(r, jwt, db)
 		if err != nil {
-			if !(len(queryParams["api-key"]) > 0 && db.apiKeyExists(ctx, queryParams["api-key"][0])) { // Check if API key is invalid
-				Printing.PrintErrStr("Could not verify user or API key for analytic data: " + err.Error())
-				requestRespondCode(w, http.StatusForbidden)
-				return
-			}
+			Printing.PrintErrStr("Could not verify user or API key for analytic data: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
 		}
+		visibleServices := scope.filter(*serviceLinks)
 
-		serviceData := make([]ServiceData, len(*serviceLinks))
+		serviceData := make([]ServiceData, len(visibleServices))
 
-		// Create a list of all services
-		for i, service := range *serviceLinks {
+		// Create a list of all services the caller can see
+		for i, service := range visibleServices {
 			serviceData[i] = ServiceData{ServiceLink: service, Hour: map[time.Time]Analytic{}, Day: map[time.Time]Analytic{}, Month: map[time.Time]Analytic{}, Year: map[time.Time]Analytic{}}
 		}
 
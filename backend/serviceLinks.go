@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"slices"
+	"strings"
 
 	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
 )
@@ -13,10 +14,18 @@ import (
 type ServiceLinks []ServiceLink
 
 type ServiceLink struct {
-	OutgoingAddress   ServiceAddress `json:"outgoing_address"`
-	IncomingAddresses []string       `json:"incoming_addresses"`
-	Title             string         `json:"title"`
-	ID                string         `json:"id"`
+	OutgoingAddress   ServiceAddress    `json:"outgoing_address"`
+	IncomingAddresses []string          `json:"incoming_addresses"`
+	Title             string            `json:"title"`
+	ID                string            `json:"id"`
+	PageTracking      bool              `json:"page_tracking"` // Serve the page view tracking script and add it to proxied HTML
+	AccessList        AccessList        `json:"access_list"`
+	GeoFence          GeoFence          `json:"geo_fence"`
+	RateLimits        []RateLimit       `json:"rate_limits"`
+	Challenge         ChallengeSettings `json:"challenge"`
+	WAF               WAFSettings       `json:"waf"`
+	BlockLists        BlockListSettings `json:"block_lists"`
+	CrawlerPolicy     CrawlerPolicy     `json:"crawler_policy"`
 }
 
 type ServiceAddress struct {
@@ -70,19 +79,85 @@ func (serviceLinks *ServiceLinks) String() string {
 	return retVal
 }
 
+// Checks each of the service's settings, returning the first problem found
+func (service ServiceLink) validate() error {
+	if err := service.AccessList.validate(); err != nil {
+		return err
+	}
+	if err := service.GeoFence.validate(); err != nil {
+		return err
+	}
+	if err := service.Challenge.validate(); err != nil {
+		return err
+	}
+	if err := service.BlockLists.validate(); err != nil {
+		return err
+	}
+	if err := service.CrawlerPolicy.validate(); err != nil {
+		return err
+	}
+	if err := service.WAF.validate(); err != nil {
+		return err
+	}
+	for _, rateLimit := range service.RateLimits {
+		if err := rateLimit.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func servicesSet(serviceLinks *ServiceLinks, db AdvancedDB, jwt JWTService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Check JWT
-		newServiceLinks, err := formatUserRequest[ServiceLinks](r, jwt)
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleAdmin)
 		if err != nil {
 			Printing.PrintErrStr("Could not add service: " + err.Error())
 			requestRespondCode(w, http.StatusForbidden)
 			return
 		}
+		newServiceLinks, err := requestReceived[ServiceLinks](r)
+		if err != nil {
+			Printing.PrintErrStr("Could not read services: " + err.Error())
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+
+		for i, newService := range *newServiceLinks {
+			// Users limited to some services can only change those, and can't add new ones
+			if !claims.Services.Includes(newService.ID) || (!claims.Services.unscoped() && !slices.ContainsFunc(*serviceLinks, func(existingService ServiceLink) bool {
+				return existingService.ID == newService.ID
+			})) {
+				Printing.PrintErrStr(claims.Username + " can't change service \"" + newService.Title + "\"")
+				requestRespondCode(w, http.StatusForbidden)
+				return
+			}
+			if err := newService.validate(); err != nil {
+				Printing.PrintErrStr("Invalid settings for service \"" + newService.Title + "\": " + err.Error())
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, err.Error())
+				return
+			}
+			for j, incomingAddress := range newService.IncomingAddresses { // Hosts are matched ignoring case
+				(*newServiceLinks)[i].IncomingAddresses[j] = strings.ToLower(incomingAddress)
+			}
+		}
+
+		// Services the user can't see are kept as they are, so the new services can't take their addresses
+		keptServiceLinks := slices.DeleteFunc(slices.Clone(*serviceLinks), func(existingService ServiceLink) bool {
+			return claims.Services.Includes(existingService.ID)
+		})
+		if err := incomingAddressConflict(append(keptServiceLinks, *newServiceLinks...)); err != nil {
+			Printing.PrintErrStr(claims.Username + " can't set services: " + err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, err.Error())
+			return
+		}
 
-		// Delete service links that are not in new service links
+		oldServiceLinks := slices.Clone(*serviceLinks)
+		// Delete service links that are not in new service links, services the user can't see are left alone
 		*serviceLinks = slices.DeleteFunc(*serviceLinks, func(existingService ServiceLink) bool {
-			delVal := !slices.ContainsFunc(*newServiceLinks, func(newService ServiceLink) bool {
+			delVal := claims.Services.Includes(existingService.ID) && !slices.ContainsFunc(*newServiceLinks, func(newService ServiceLink) bool {
 				return existingService.ID == newService.ID
 			})
 			if delVal {
@@ -108,6 +183,14 @@ func servicesSet(serviceLinks *ServiceLinks, db AdvancedDB, jwt JWTService) http
 			(*serviceLinks)[existingServiceI].IncomingAddresses = newService.IncomingAddresses
 			(*serviceLinks)[existingServiceI].Title = newService.Title
 			(*serviceLinks)[existingServiceI].OutgoingAddress = newService.OutgoingAddress
+			(*serviceLinks)[existingServiceI].PageTracking = newService.PageTracking
+			(*serviceLinks)[existingServiceI].AccessList = newService.AccessList
+			(*serviceLinks)[existingServiceI].GeoFence = newService.GeoFence
+			(*serviceLinks)[existingServiceI].RateLimits = newService.RateLimits
+			(*serviceLinks)[existingServiceI].Challenge = newService.Challenge
+			(*serviceLinks)[existingServiceI].WAF = newService.WAF
+			(*serviceLinks)[existingServiceI].BlockLists = newService.BlockLists
+			(*serviceLinks)[existingServiceI].CrawlerPolicy = newService.CrawlerPolicy
 		}
 
 		err = db.setServiceLinks(r.Context(), *serviceLinks)
@@ -116,15 +199,31 @@ func servicesSet(serviceLinks *ServiceLinks, db AdvancedDB, jwt JWTService) http
 			requestRespondCode(w, http.StatusInternalServerError)
 			return
 		}
+		auditServiceChanges(r, db, claims.Username, oldServiceLinks, *serviceLinks)
 		Printing.Println("Updated service links: ", serviceLinks)
-		requestRespond(w, serviceLinks)
+		requestRespond(w, claims.Services.filter(*serviceLinks))
+	}
+}
+
+// Checks that no incoming address is used by more than one service, since requests to it could only reach one
+func incomingAddressConflict(services ServiceLinks) error {
+	usedAddresses := map[string]bool{}
+	for _, service := range services {
+		for _, incomingAddress := range service.IncomingAddresses {
+			address := strings.ToLower(incomingAddress)
+			if usedAddresses[address] {
+				return errors.New("incoming address \"" + incomingAddress + "\" is already used by another service")
+			}
+			usedAddresses[address] = true
+		}
 	}
+	return nil
 }
 
 // Search for a service by incoming URL
 func (services *ServiceLinks) GetServiceFromIncomingURL(service string) (*ServiceLink, error) {
 	for _, serviceLink := range *services { // Check all services
-		if slices.Contains(serviceLink.IncomingAddresses, service) {
+		if slices.ContainsFunc(serviceLink.IncomingAddresses, func(incomingAddress string) bool { return strings.EqualFold(incomingAddress, service) }) {
 			return &serviceLink, nil
 		}
 	}
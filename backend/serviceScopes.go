@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// IDs of the services a user or API key can see, empty means every service
+type ServiceScope []string
+
+func (scope ServiceScope) Includes(serviceID string) bool {
+	return len(scope) == 0 || slices.Contains(scope, serviceID)
+}
+
+// Whether the scope covers every service, including ones that haven't been added yet
+func (scope ServiceScope) unscoped() bool {
+	return len(scope) == 0
+}
+
+func (scope ServiceScope) filter(serviceLinks ServiceLinks) ServiceLinks {
+	if scope.unscoped() {
+		return serviceLinks
+	}
+	return slices.DeleteFunc(slices.Clone(serviceLinks), func(service ServiceLink) bool {
+		return !scope.Includes(service.ID)
+	})
+}
+
+// For storing in a user or API key hash
+func (scope ServiceScope) encode() string {
+	if scope.unscoped() {
+		return ""
+	}
+	encoded, _ := json.Marshal(scope)
+	return string(encoded)
+}
+
+func decodeServiceScope(raw string, owner string) ServiceScope {
+	if raw == "" {
+		return nil
+	}
+	var scope ServiceScope
+	err := json.Unmarshal([]byte(raw), &scope)
+	if err != nil || scope.unscoped() { // Fail closed, no service has an empty ID
+		Printing.PrintErrStr("Invalid service scope for " + owner + ", hiding every service")
+		return ServiceScope{""}
+	}
+	return scope
+}
+
+// The services the request's session or API key can see
+func requestServiceScope(r *http.Request, jwt JWTService, db AdvancedDB) (ServiceScope, error) {
+	claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+	if err == nil {
+		return claims.Services, nil
+	}
+	apiKey, keyErr := db.getAPIKey(r.Context(), requestAPIKey(r))
+	if keyErr != nil || apiKey == nil {
+		return nil, errors.New("Invalid session and API key: " + err.Error())
+	}
+	return apiKey.Services, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"slices"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Last seen times are only saved this often, so every request doesn't write to Valkey
+const sessionTouchInterval = time.Minute
+
+// A signed in browser, tracked so it can be listed and revoked before its JWT expires
+type Session struct {
+	ID       string    `json:"id"`
+	Username string    `json:"username"`
+	Created  time.Time `json:"created"`
+	LastSeen time.Time `json:"last_seen"`
+	IP       string    `json:"ip"`     // Where the session was started from
+	Device   string    `json:"device"` // User agent the session was started with
+	Current  bool      `json:"current"`
+}
+
+func newSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return webAuthnEncoding.EncodeToString(id)
+}
+
+// Lists the signed in user's sessions, marking the one making the request
+func sessionsGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get sessions: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		sessions, err := db.getSessions(r.Context(), claims.Username)
+		if err != nil {
+			Printing.PrintErrStr("Could not get sessions: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		for i := range sessions {
+			sessions[i].Current = sessions[i].ID == claims.ID
+		}
+		slices.SortFunc(sessions, func(a, b Session) int { return b.LastSeen.Compare(a.LastSeen) })
+		requestRespond(w, sessions)
+	}
+}
+
+// Ends the session making the request
+func userSignOut(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		jwt.clearJWT(w)
+		if err != nil { // Already signed out
+			requestRespondCode(w, http.StatusOK)
+			return
+		}
+		err = db.removeSession(r.Context(), Session{ID: claims.ID, Username: claims.Username})
+		if err != nil {
+			Printing.PrintErrStr("Could not sign out: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditSignOut, claims.Username, nil, nil)
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// Revokes one of the signed in user's sessions
+func sessionRemove(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not revoke session: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		session, err := db.getSession(r.Context(), r.PathValue("id"))
+		if err != nil {
+			Printing.PrintErrStr("Could not get session: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if session == nil || session.Username != claims.Username {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		err = db.removeSession(r.Context(), *session)
+		if err != nil {
+			Printing.PrintErrStr("Could not revoke session: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if session.ID == claims.ID {
+			jwt.clearJWT(w)
+		}
+		audit(r, db, claims.Username, AuditSessionRevoke, claims.Username, session, nil)
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// Signs the signed in user out everywhere, including here
+func sessionsRemove(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not revoke sessions: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		err = db.removeSessions(r.Context(), claims.Username)
+		if err != nil {
+			Printing.PrintErrStr("Could not revoke sessions: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		jwt.clearJWT(w)
+		audit(r, db, claims.Username, AuditSessionRevoke, claims.Username, nil, nil)
+		Printing.Println("Signed " + claims.Username + " out everywhere")
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// Signs every user out everywhere
+func removeAllSessions(ctx context.Context, db AdvancedDB) error {
+	users, err := db.getUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		err = db.removeSessions(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Signs the user in the path out everywhere, for when their session leaked
+func userSessionsRemove(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not revoke sessions: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		username := r.PathValue("username")
+		user, err := db.getUser(r.Context(), username)
+		if err != nil {
+			Printing.PrintErrStr("Could not get user: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if user == nil {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		err = db.removeSessions(r.Context(), username)
+		if err != nil {
+			Printing.PrintErrStr("Could not revoke sessions: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditSessionRevoke, username, nil, nil)
+		Printing.Println("Signed " + username + " out everywhere")
+		requestRespondCode(w, http.StatusOK)
+	}
+}
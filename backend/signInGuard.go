@@ -0,0 +1,153 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// How many failed sign ins are kept for the dashboard
+const signInFailureLogLength = 200
+
+// Each IP can start this many passkey sign ins at once, and one more every 3 seconds
+const (
+	signInChallengeBurst      = 20
+	signInChallengesPerSecond = 1.0 / 3
+)
+
+type SignInMethod string
+
+const (
+	SignInMethodPassword  SignInMethod = "password"
+	SignInMethodSignUp    SignInMethod = "sign_up"
+	SignInMethodTwoFactor SignInMethod = "two_factor"
+	SignInMethodPasskey   SignInMethod = "passkey"
+)
+
+type SignInFailure struct {
+	Time     time.Time    `json:"time"`
+	IP       string       `json:"ip"`
+	Username string       `json:"username"`
+	Method   SignInMethod `json:"method"`
+	Lockout  int          `json:"lockout"` // Seconds the IP was locked out for after this failure
+}
+
+// Slows down password, sign up, two-factor, and passkey guessing. Each IP is locked out after SIGN_IN_ATTEMPTS failures,
+// for twice as long after every further failure. Once SIGN_IN_GLOBAL_ATTEMPTS failures come from all IPs together,
+// every IP that has failed recently waits before trying again, for attacks spread over many addresses. IPs without
+// failures of their own are never held back, so an attacker can't lock out the admin.
+type SignInGuard struct {
+	db              AdvancedDB
+	threshold       int
+	globalThreshold int           // 0 to only lock out single IPs
+	window          time.Duration // Failures are forgotten after this long without another
+	baseLockout     time.Duration
+	maximumLockout  time.Duration
+}
+
+func (guard *SignInGuard) Setup(db AdvancedDB) {
+	guard.db = db
+	guard.threshold = 5
+	guard.globalThreshold = 100
+	guard.window = 15 * time.Minute
+	guard.baseLockout = time.Minute
+	guard.maximumLockout = time.Hour
+	if rawThreshold := os.Getenv("SIGN_IN_ATTEMPTS"); rawThreshold != "" {
+		threshold, err := strconv.Atoi(rawThreshold)
+		if err != nil || threshold <= 0 {
+			Printing.PrintErrStr("Invalid SIGN_IN_ATTEMPTS \"" + rawThreshold + "\", using " + strconv.Itoa(guard.threshold))
+		} else {
+			guard.threshold = threshold
+		}
+	}
+	if rawThreshold := os.Getenv("SIGN_IN_GLOBAL_ATTEMPTS"); rawThreshold != "" {
+		threshold, err := strconv.Atoi(rawThreshold)
+		if err != nil || threshold < 0 {
+			Printing.PrintErrStr("Invalid SIGN_IN_GLOBAL_ATTEMPTS \"" + rawThreshold + "\", using " + strconv.Itoa(guard.globalThreshold))
+		} else {
+			guard.globalThreshold = threshold
+		}
+	}
+}
+
+// Refuses the request with 429 if its IP, or everyone, is locked out. Returns whether the request was refused.
+func (guard *SignInGuard) refuse(w http.ResponseWriter, r *http.Request) bool {
+	ip := requestClientIP(r)
+	lockout, err := guard.db.getSignInLockout(r.Context(), ip)
+	if err != nil { // Fail open, since Valkey being down shouldn't lock everyone out
+		Printing.PrintErrStr("Could not check sign in lockout: " + err.Error())
+		return false
+	}
+	if lockout <= 0 {
+		return false
+	}
+	Printing.PrintErrStr("Refused sign in from " + ip + ", locked out for " + lockout.Round(time.Second).String())
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockout.Seconds()))))
+	requestRespondCode(w, http.StatusTooManyRequests)
+	return true
+}
+
+// Refuses the request with 429 if its IP is starting sign ins faster than the challenge rate limit, so challenges
+// can't be used to fill Valkey. Returns whether the request was refused.
+func (guard *SignInGuard) throttleChallenges(w http.ResponseWriter, r *http.Request) bool {
+	ip := requestClientIP(r)
+	result, err := guard.db.takeRateLimitToken(r.Context(), "SignInChallenge:"+ip, signInChallengeBurst, signInChallengesPerSecond)
+	if err != nil { // Fail open, same as the lockout
+		Printing.PrintErrStr("Could not check sign in challenge rate limit: " + err.Error())
+		return false
+	}
+	if result.Allowed {
+		return false
+	}
+	Printing.PrintErrStr("Refused sign in challenge for " + ip + ", too many requested")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(result.RetryAfter.Seconds()))))
+	requestRespondCode(w, http.StatusTooManyRequests)
+	return true
+}
+
+// Records a failed attempt, locking out the IP once it has too many
+func (guard *SignInGuard) fail(r *http.Request, username string, method SignInMethod) {
+	if len(username) > 64 { // Anything can be sent as a username, so keep the log small
+		username = username[:64]
+	}
+	failure := SignInFailure{Time: time.Now(), IP: requestClientIP(r), Username: username, Method: method}
+	lockout, err := guard.db.addSignInFailure(r.Context(), failure, guard.threshold, guard.globalThreshold, guard.window, guard.baseLockout, guard.maximumLockout)
+	if err != nil {
+		Printing.PrintErrStr("Could not record failed sign in: " + err.Error())
+		return
+	}
+	if lockout > 0 {
+		Printing.PrintErrStr("Locked out " + failure.IP + " for " + lockout.String() + " after failed sign ins")
+	}
+}
+
+// Forgets the IP's failures once it signs in
+func (guard *SignInGuard) succeed(r *http.Request) {
+	err := guard.db.removeSignInFailures(r.Context(), requestClientIP(r))
+	if err != nil {
+		Printing.PrintErrStr("Could not reset failed sign ins: " + err.Error())
+	}
+}
+
+// The most recent failed sign ins, newest first
+func signInFailuresGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not get failed sign ins: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		failures, err := db.getSignInFailures(r.Context())
+		if err != nil {
+			Printing.PrintErrStr("Could not get failed sign ins: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		requestRespond(w, failures)
+	}
+}
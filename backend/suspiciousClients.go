@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+const (
+	// How long an IP stays listed after its last scanner rule match
+	suspicionWindow = 24 * time.Hour
+	// Time for a suspicion score to halve without new matches
+	suspicionHalfLife = 6 * time.Hour
+)
+
+// A client that has matched scanner rules recently
+type SuspiciousClient struct {
+	IP        string         `json:"ip"`
+	Score     float64        `json:"score"`    // Decayed to the time of the request
+	Rules     map[string]int `json:"rules"`    // Scanner rule ID → matches
+	Services  map[string]int `json:"services"` // Service ID → matches
+	FirstSeen time.Time      `json:"first_seen"`
+	LastSeen  time.Time      `json:"last_seen"`
+}
+
+// Adds the scanner rules a request matched to its client's suspicion
+func recordSuspiciousActivity(r *http.Request, serviceID string, rules []ScannerRule, db AdvancedDB) {
+	if len(rules) == 0 {
+		return
+	}
+	// Use background context with timeout to avoid cancellation when request completes
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := db.recordSuspiciousActivity(ctx, requestClientIP(r), serviceID, rules)
+	if err != nil {
+		Printing.PrintErrStr("Could not record suspicious activity: " + err.Error())
+	}
+}
+
+// Exponentially decays score from lastUpdate to now
+func decaySuspicionScore(score float64, lastUpdate time.Time, now time.Time) float64 {
+	elapsed := now.Sub(lastUpdate)
+	if elapsed <= 0 {
+		return score
+	}
+	return score * math.Pow(0.5, float64(elapsed)/float64(suspicionHalfLife))
+}
+
+func getSuspiciousClients(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get suspicious clients: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		clients, err := db.getSuspiciousClients(r.Context())
+		if err != nil {
+			Printing.PrintErrStr("Could not get suspicious clients: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if !claims.Services.unscoped() { // Only show activity against services the user can see
+			clients = slices.DeleteFunc(clients, func(client SuspiciousClient) bool {
+				maps.DeleteFunc(client.Services, func(serviceID string, _ int) bool {
+					return !claims.Services.Includes(serviceID)
+				})
+				return len(client.Services) == 0
+			})
+		}
+		slices.SortFunc(clients, func(a SuspiciousClient, b SuspiciousClient) int {
+			if a.Score > b.Score {
+				return -1
+			} else if a.Score < b.Score {
+				return 1
+			}
+			return b.LastSeen.Compare(a.LastSeen)
+		})
+		requestRespond(w, clients)
+	}
+}
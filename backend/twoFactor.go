@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// RFC 6238 defaults, which every authenticator app supports
+const (
+	totpPeriod = 30 * time.Second
+	totpDigits = 6
+	totpSkew   = 1 // Steps before and after now that are still accepted, for clocks that drift
+)
+
+const (
+	totpEnrollmentLifetime = 10 * time.Minute
+	recoveryCodeCount      = 10
+)
+
+const twoFactorCookieName = "checkbag-two-factor"
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type TOTPEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"` // otpauth:// URI to show as a QR code
+}
+
+type TwoFactorCode struct {
+	Code string `json:"code"` // TOTP or recovery code
+}
+
+type SignInResponse struct {
+	TwoFactor bool `json:"two_factor"` // A code is needed before the session is issued
+}
+
+func newTOTPSecret() string {
+	secret := make([]byte, 20) // 160 bits, as recommended by RFC 4226
+	rand.Read(secret)
+	return totpEncoding.EncodeToString(secret)
+}
+
+func totpURI(username string, secret string) string {
+	label := url.PathEscape("CheckBag:" + username)
+	parameters := url.Values{}
+	parameters.Set("secret", secret)
+	parameters.Set("issuer", "CheckBag")
+	parameters.Set("algorithm", "SHA1")
+	parameters.Set("digits", strconv.Itoa(totpDigits))
+	parameters.Set("period", strconv.Itoa(int(totpPeriod.Seconds())))
+	return "otpauth://totp/" + label + "?" + parameters.Encode()
+}
+
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%uint32(math.Pow10(totpDigits)))
+}
+
+// Returns the time step the code belongs to. Steps at or before lastStep were already used and are refused.
+func verifyTOTP(secret string, code string, lastStep int64, now time.Time) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	currentStep := now.Unix() / int64(totpPeriod.Seconds())
+	for step := currentStep - totpSkew; step <= currentStep+totpSkew; step++ {
+		if step > lastStep && hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Formatted like "abcde-fghij" so they're easy to write down
+func newRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		random := make([]byte, 8)
+		rand.Read(random)
+		code := strings.ToLower(totpEncoding.EncodeToString(random))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes
+}
+
+// Recovery codes are random enough that a fast hash is safe
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// Checks a TOTP or recovery code, marking it used in Valkey in the same step it's checked there, so two requests with
+// the same code can't both get in. Returns false if the code is wrong or was already used.
+func useTwoFactorCode(ctx context.Context, db AdvancedDB, user User, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(user.TOTPSecret, code, user.TOTPLastStep, time.Now()); ok {
+		return db.useTOTPStep(ctx, user.Username, step)
+	}
+	hash := hashRecoveryCode(code)
+	if !slices.ContainsFunc(user.RecoveryCodes, func(recoveryCode string) bool {
+		return hmac.Equal([]byte(recoveryCode), []byte(hash))
+	}) {
+		return false, nil
+	}
+	return db.useRecoveryCode(ctx, user.Username, hash)
+}
+
+func (user *User) disableTwoFactor() {
+	user.TOTPSecret = ""
+	user.TOTPLastStep = 0
+	user.RecoveryCodes = nil
+}
+
+// Loads the signed in user, for the two-factor settings of their own account
+func sessionUser(r *http.Request, db AdvancedDB, jwt JWTService) (*User, error) {
+	claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+	if err != nil {
+		return nil, err
+	}
+	user, err := db.getUser(r.Context(), claims.Username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errors.New(claims.Username + " no longer exists")
+	}
+	return user, nil
+}
+
+// Starts enrollment with a new secret, which only takes effect once a code from it is confirmed
+func twoFactorEnroll(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := sessionUser(r, db, jwt)
+		if err != nil {
+			Printing.PrintErrStr("Could not start two-factor enrollment: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		if user.TOTPSecret != "" {
+			w.WriteHeader(http.StatusConflict)
+			requestRespond(w, "two-factor authentication is already enabled")
+			return
+		}
+		secret := newTOTPSecret()
+		err = db.setTOTPEnrollment(r.Context(), user.Username, secret, totpEnrollmentLifetime)
+		if err != nil {
+			Printing.PrintErrStr("Could not save two-factor enrollment: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		requestRespond(w, TOTPEnrollment{Secret: secret, URI: totpURI(user.Username, secret)})
+	}
+}
+
+// Enables two-factor authentication once the authenticator proves it has the secret, responding with recovery codes
+func twoFactorConfirm(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := sessionUser(r, db, jwt)
+		if err != nil {
+			Printing.PrintErrStr("Could not confirm two-factor enrollment: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		code, err := requestReceived[TwoFactorCode](r)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		secret, err := db.getTOTPEnrollment(r.Context(), user.Username)
+		if err != nil || secret == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, "no two-factor enrollment in progress")
+			return
+		}
+		step, ok := verifyTOTP(secret, strings.TrimSpace(code.Code), 0, time.Now())
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, "incorrect code")
+			return
+		}
+		recoveryCodes := newRecoveryCodes()
+		user.TOTPSecret = secret
+		user.TOTPLastStep = step
+		user.RecoveryCodes = make([]string, len(recoveryCodes))
+		for i, recoveryCode := range recoveryCodes {
+			user.RecoveryCodes[i] = hashRecoveryCode(recoveryCode)
+		}
+		err = db.setUser(r.Context(), *user)
+		if err != nil {
+			Printing.PrintErrStr("Could not enable two-factor authentication: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		db.removeTOTPEnrollment(r.Context(), user.Username)
+		audit(r, db, user.Username, AuditTwoFactorEnable, user.Username, nil, nil)
+		Printing.Println("Enabled two-factor authentication for " + user.Username)
+		requestRespond(w, recoveryCodes)
+	}
+}
+
+// Turns off two-factor authentication for the signed in user, which needs a current code
+func twoFactorDisable(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := sessionUser(r, db, jwt)
+		if err != nil {
+			Printing.PrintErrStr("Could not disable two-factor authentication: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		code, err := requestReceived[TwoFactorCode](r)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		if user.TOTPSecret == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, "incorrect code")
+			return
+		}
+		accepted, err := useTwoFactorCode(r.Context(), db, *user, code.Code)
+		if err != nil {
+			Printing.PrintErrStr("Could not check two-factor code: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if !accepted {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, "incorrect code")
+			return
+		}
+		user.disableTwoFactor()
+		err = db.setUser(r.Context(), *user)
+		if err != nil {
+			Printing.PrintErrStr("Could not disable two-factor authentication: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, user.Username, AuditTwoFactorDisable, user.Username, nil, nil)
+		Printing.Println("Disabled two-factor authentication for " + user.Username)
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// The second sign-in step, trading the pending sign-in from userSignIn and a code for a session
+func userSignInTwoFactor(db AdvancedDB, jwt JWTService, guard *SignInGuard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if guard.refuse(w, r) {
+			return
+		}
+		cookie, err := r.Cookie(twoFactorCookieName)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		username, ok := jwt.ValidateTwoFactorJWT(cookie.Value)
+		if !ok {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		code, err := requestReceived[TwoFactorCode](r)
+		if err != nil {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		user, err := db.getUser(r.Context(), username)
+		if err != nil || user == nil || user.TOTPSecret == "" {
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		accepted, err := useTwoFactorCode(r.Context(), db, *user, code.Code)
+		if err != nil {
+			Printing.PrintErrStr("Could not check two-factor code: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if !accepted {
+			Printing.PrintErrStr("Could not sign in " + username + ": incorrect two-factor code")
+			guard.fail(r, username, SignInMethodTwoFactor)
+			requestRespondCode(w, http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(w, expiredCookie(twoFactorCookieName))
+		err = jwt.setJWT(w, r, *user)
+		if err != nil {
+			Printing.PrintErrStr("Could not start session: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		guard.succeed(r)
+		requestRespondCode(w, http.StatusOK)
+	}
+}
+
+// For when a user loses their authenticator and recovery codes, run as "./main disable-two-factor <username>"
+func disableTwoFactorCommand(db AdvancedDB, username string) {
+	ctx := context.Background()
+	user, err := db.getUser(ctx, username)
+	if err != nil {
+		Printing.PrintErrStr("Could not get user " + username + ": " + err.Error())
+		return
+	}
+	if user == nil {
+		Printing.PrintErrStr("User " + username + " does not exist")
+		return
+	}
+	user.disableTwoFactor()
+	err = db.setUser(ctx, *user)
+	if err != nil {
+		Printing.PrintErrStr("Could not disable two-factor authentication: " + err.Error())
+		return
+	}
+	Printing.Println("Disabled two-factor authentication for " + username)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Most common hosts, paths, and clients probing CheckBag for services that don't exist
+type UnmatchedRequestSummary struct {
+	Quantity  int            `json:"quantity"`
+	Host      map[string]int `json:"host"`
+	Resource  map[string]int `json:"resource"`
+	IP        map[string]int `json:"ip"`
+	Country   map[string]int `json:"country"`
+	UserAgent map[string]int `json:"user_agent"`
+}
+
+// How many of each dimension to return
+const unmatchedRequestTopCount = 50
+
+func getUnmatchedRequests(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get unmatched requests: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+
+		timeStep := cacheAnalyticsHour
+		switch strings.ToLower(r.URL.Query().Get("time-step")) {
+		case "hour":
+			timeStep = cacheAnalyticsMinute
+		case "month":
+			timeStep = cacheAnalyticsDay
+		case "year":
+			timeStep = cacheAnalyticsMonth
+		}
+
+		summary := UnmatchedRequestSummary{
+			Host:      map[string]int{},
+			Resource:  map[string]int{},
+			IP:        map[string]int{},
+			Country:   map[string]int{},
+			UserAgent: map[string]int{},
+		}
+		pseudoService := ServiceData{ServiceLink: ServiceLink{ID: unmatchedServiceID}}
+		for _, analytic := range db.getAnalyticsService(r.Context(), pseudoService, timeStep) {
+			summary.Quantity += analytic.Quantity
+			addCounts(summary.Host, analytic.Host)
+			addCounts(summary.Resource, analytic.Resource)
+			addCounts(summary.IP, analytic.IP)
+			addCounts(summary.Country, analytic.Country)
+			addCounts(summary.UserAgent, analytic.UserAgent)
+		}
+		summary.Host = topCounts(summary.Host, unmatchedRequestTopCount)
+		summary.Resource = topCounts(summary.Resource, unmatchedRequestTopCount)
+		summary.IP = topCounts(summary.IP, unmatchedRequestTopCount)
+		summary.Country = topCounts(summary.Country, unmatchedRequestTopCount)
+		summary.UserAgent = topCounts(summary.UserAgent, unmatchedRequestTopCount)
+		requestRespond(w, summary)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"strings"
+)
+
+type UserAgent struct {
+	Browser string
+	OS      string
+	Device  string
+	Bot     *KnownBot // nil when the client doesn't look automated
+}
+
+type BotCategory string
+
+const (
+	BotCategorySearch  BotCategory = "search"
+	BotCategoryAI      BotCategory = "ai"
+	BotCategoryMonitor BotCategory = "monitor"
+	BotCategoryOther   BotCategory = "other"
+)
+
+type KnownBot struct {
+	Name     string
+	Category BotCategory
+	token    string // Case-insensitive substring identifying the bot in a User-Agent
+}
+
+type userAgentRule struct {
+	name  string
+	match func(ua string) bool
+}
+
+// Ordered from most to least specific, first match wins
+var knownBots = []KnownBot{
+	// AI crawlers and assistants
+	{Name: "GPTBot", Category: BotCategoryAI, token: "gptbot"},
+	{Name: "ChatGPT-User", Category: BotCategoryAI, token: "chatgpt-user"},
+	{Name: "OAI-SearchBot", Category: BotCategoryAI, token: "oai-searchbot"},
+	{Name: "ClaudeBot", Category: BotCategoryAI, token: "claudebot"},
+	{Name: "Claude-Web", Category: BotCategoryAI, token: "claude-web"},
+	{Name: "Claude-User", Category: BotCategoryAI, token: "claude-user"},
+	{Name: "anthropic-ai", Category: BotCategoryAI, token: "anthropic-ai"},
+	{Name: "CCBot", Category: BotCategoryAI, token: "ccbot"},
+	{Name: "PerplexityBot", Category: BotCategoryAI, token: "perplexitybot"},
+	{Name: "Perplexity-User", Category: BotCategoryAI, token: "perplexity-user"},
+	{Name: "Bytespider", Category: BotCategoryAI, token: "bytespider"},
+	{Name: "Google-Extended", Category: BotCategoryAI, token: "google-extended"},
+	{Name: "Amazonbot", Category: BotCategoryAI, token: "amazonbot"},
+	{Name: "Applebot-Extended", Category: BotCategoryAI, token: "applebot-extended"},
+	{Name: "Meta-ExternalAgent", Category: BotCategoryAI, token: "meta-externalagent"},
+	{Name: "cohere-ai", Category: BotCategoryAI, token: "cohere-ai"},
+	{Name: "Diffbot", Category: BotCategoryAI, token: "diffbot"},
+	{Name: "ImagesiftBot", Category: BotCategoryAI, token: "imagesiftbot"},
+	{Name: "Omgilibot", Category: BotCategoryAI, token: "omgili"},
+	{Name: "YouBot", Category: BotCategoryAI, token: "youbot"},
+	{Name: "AI2Bot", Category: BotCategoryAI, token: "ai2bot"},
+	{Name: "Timpibot", Category: BotCategoryAI, token: "timpibot"},
+	// Search engine crawlers
+	{Name: "Googlebot", Category: BotCategorySearch, token: "googlebot"},
+	{Name: "Google-InspectionTool", Category: BotCategorySearch, token: "google-inspectiontool"},
+	{Name: "Bingbot", Category: BotCategorySearch, token: "bingbot"},
+	{Name: "DuckDuckBot", Category: BotCategorySearch, token: "duckduckbot"},
+	{Name: "YandexBot", Category: BotCategorySearch, token: "yandex"},
+	{Name: "Baiduspider", Category: BotCategorySearch, token: "baiduspider"},
+	{Name: "Applebot", Category: BotCategorySearch, token: "applebot"},
+	{Name: "Qwantbot", Category: BotCategorySearch, token: "qwantbot"},
+	{Name: "SeznamBot", Category: BotCategorySearch, token: "seznambot"},
+	{Name: "Slurp", Category: BotCategorySearch, token: "slurp"},
+	// Uptime monitors
+	{Name: "UptimeRobot", Category: BotCategoryMonitor, token: "uptimerobot"},
+	{Name: "Uptime Kuma", Category: BotCategoryMonitor, token: "uptime-kuma"},
+	{Name: "Pingdom", Category: BotCategoryMonitor, token: "pingdom"},
+	{Name: "StatusCake", Category: BotCategoryMonitor, token: "statuscake"},
+	{Name: "Better Stack", Category: BotCategoryMonitor, token: "better uptime"},
+	{Name: "Site24x7", Category: BotCategoryMonitor, token: "site24x7"},
+	{Name: "HetrixTools", Category: BotCategoryMonitor, token: "hetrixtools"},
+	{Name: "Gatus", Category: BotCategoryMonitor, token: "gatus"},
+	{Name: "Healthchecks", Category: BotCategoryMonitor, token: "healthchecks"},
+	{Name: "Datadog", Category: BotCategoryMonitor, token: "datadog"},
+	// Link preview fetchers
+	{Name: "Facebook", Category: BotCategoryOther, token: "facebookexternalhit"},
+}
+
+// Generic markers for crawlers that aren't listed above. Words only match on their own, so phones like the Cubot
+// aren't taken for bots.
+var genericBotTokens = []string{"crawler", "spider", "scraper"}
+var genericBotWords = []string{"bot"}
+
+var browserRules = []userAgentRule{
+	{"Home Assistant", containsAny("home assistant/", "homeassistant/")},
+	{"Jellyfin", containsAny("jellyfin")},
+	{"Plex", containsAny("plex")},
+	{"Edge", containsAny("edg/", "edge/", "edga/", "edgios/")},
+	{"Opera", containsAny("opr/", "opera")},
+	{"Samsung Internet", containsAny("samsungbrowser")},
+	{"Vivaldi", containsAny("vivaldi")},
+	{"Firefox", containsAny("firefox/", "fxios/")},
+	{"Chrome", containsAny("chrome/", "crios/", "chromium/")},
+	{"Safari", containsAny("safari/")},
+	{"curl", containsAny("curl/")},
+	{"Wget", containsAny("wget/")},
+	{"Python", containsAny("python-requests", "python-urllib", "aiohttp", "httpx")},
+	{"Go", containsAny("go-http-client")},
+	{"OkHttp", containsAny("okhttp")},
+	{"Node.js", containsAny("node-fetch", "axios/", "undici")},
+}
+
+var osRules = []userAgentRule{
+	{"Windows", containsAny("windows")},
+	{"iOS", containsAny("iphone", "ipad", "ipod", "ios ")},
+	{"tvOS", containsAny("appletv", "tvos")},
+	{"macOS", containsAny("mac os x", "macintosh")},
+	{"Android", containsAny("android")},
+	{"ChromeOS", containsAny("cros ")},
+	{"Tizen", containsAny("tizen")},
+	{"webOS", containsAny("web0s", "webos")},
+	{"Linux", containsAny("linux", "x11")},
+}
+
+var deviceRules = []userAgentRule{
+	{"TV", containsAny("smart-tv", "smarttv", "googletv", "android tv", "appletv", "tizen", "web0s", "bravia", "roku", "crkey", "aftb", "aftm", "afts", "hbbtv")},
+	{"Tablet", func(ua string) bool {
+		return strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet") || (strings.Contains(ua, "android") && !strings.Contains(ua, "mobile"))
+	}},
+	{"Mobile", containsAny("mobi", "iphone", "ipod", "android")},
+	{"Desktop", containsAny("windows", "macintosh", "x11", "cros ", "linux")},
+}
+
+func containsAny(tokens ...string) func(ua string) bool {
+	return func(ua string) bool {
+		for _, token := range tokens {
+			if strings.Contains(ua, token) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func matchUserAgentRules(rules []userAgentRule, ua string) string {
+	for _, rule := range rules {
+		if rule.match(ua) {
+			return rule.name
+		}
+	}
+	return "Other"
+}
+
+// Breaks a User-Agent header into its browser family, OS family, device class, and any known bot
+func parseUserAgent(rawUserAgent string) UserAgent {
+	ua := strings.ToLower(strings.TrimSpace(rawUserAgent))
+	if ua == "" {
+		return UserAgent{Browser: "Unknown", OS: "Unknown", Device: "Unknown"}
+	}
+
+	userAgent := UserAgent{
+		Browser: matchUserAgentRules(browserRules, ua),
+		OS:      matchUserAgentRules(osRules, ua),
+		Device:  matchUserAgentRules(deviceRules, ua),
+		Bot:     findKnownBot(ua),
+	}
+	if userAgent.Device == "Other" {
+		userAgent.Device = "Unknown"
+	}
+	if userAgent.Bot != nil { // Crawlers often pretend to be desktop browsers, don't count them as such
+		userAgent.Browser = userAgent.Bot.Name
+		userAgent.Device = "Unknown"
+	}
+	return userAgent
+}
+
+// ua is expected to be lowercase
+func findKnownBot(ua string) *KnownBot {
+	for _, bot := range knownBots {
+		if strings.Contains(ua, bot.token) {
+			return &bot
+		}
+	}
+	for _, token := range genericBotTokens {
+		if strings.Contains(ua, token) {
+			return &KnownBot{Name: "Other", Category: BotCategoryOther}
+		}
+	}
+	for _, word := range genericBotWords {
+		if containsWord(ua, word) {
+			return &KnownBot{Name: "Other", Category: BotCategoryOther}
+		}
+	}
+	return nil
+}
+
+// Checks if the word appears without letters or digits right before or after it
+func containsWord(ua string, word string) bool {
+	for offset := 0; ; {
+		index := strings.Index(ua[offset:], word)
+		if index == -1 {
+			return false
+		}
+		start, end := offset+index, offset+index+len(word)
+		if (start == 0 || !isWordCharacter(ua[start-1])) && (end == len(ua) || !isWordCharacter(ua[end])) {
+			return true
+		}
+		offset = start + 1
+	}
+}
+
+func isWordCharacter(character byte) bool {
+	return ('a' <= character && character <= 'z') || ('0' <= character && character <= '9')
+}
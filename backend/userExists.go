@@ -6,10 +6,14 @@ import (
 	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
 )
 
-func userExists(db AdvancedDB) http.HandlerFunc {
+func userExists(db AdvancedDB, provider *OIDCProvider) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		data, err := db.GetUserPasswordHash(r.Context())
-		if err != nil || data == "" {
+		if !provider.PasswordSignIn() { // Nobody signs up when everyone signs in through the OIDC provider
+			requestRespondCode(w, http.StatusOK)
+			return
+		}
+		users, err := db.getUsers(r.Context())
+		if err != nil || len(users) == 0 {
 			Printing.Println("User does not exist")
 			requestRespondCode(w, http.StatusGone)
 			return
@@ -7,27 +7,58 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
-func userSignIn(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+// Compared against when the user doesn't exist, so unknown usernames take as long as wrong passwords
+var missingUserPasswordHash, _ = createPasswordHash(generateRandomString(32))
+
+func userSignIn(db AdvancedDB, jwt JWTService, provider *OIDCProvider, guard *SignInGuard) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		rawPassword, err := requestReceived[string](r)
+		if !provider.PasswordSignIn() {
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		if guard.refuse(w, r) {
+			return
+		}
+		signIn, err := requestReceived[SignInRequest](r)
 		if err != nil {
-			Printing.PrintErrStr("Could not get password from request: ", err.Error())
+			Printing.PrintErrStr("Could not get credentials from request: ", err.Error())
 			requestRespondCode(w, http.StatusBadRequest)
 			return
 		}
-		passwordHash, err := db.GetUserPasswordHash(r.Context())
+		user, err := db.getUser(r.Context(), signIn.Username)
 		if err != nil {
-			Printing.PrintErrStr("Could not get user data from file system: ", err.Error())
+			Printing.PrintErrStr("Could not get user data from the database: ", err.Error())
 			requestRespondCode(w, http.StatusBadRequest)
 			return
 		}
+		passwordHash := missingUserPasswordHash
+		if user != nil && user.PasswordHash != "" { // Users from the OIDC provider have no password
+			passwordHash = []byte(user.PasswordHash)
+		}
 		// Compare the password with the hash
-		if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(*rawPassword)); err != nil {
-			Printing.PrintErrStr("Passwords do not match: ", err.Error())
+		if err := bcrypt.CompareHashAndPassword(passwordHash, []byte(signIn.Password)); err != nil || user == nil {
+			Printing.PrintErrStr("Could not sign in " + signIn.Username + ": passwords do not match")
+			guard.fail(r, signIn.Username, SignInMethodPassword)
 			requestRespondCode(w, http.StatusBadRequest) // Intentionally obscure the error to prevent username guessing
 			return
 		}
-		jwt.setJWT(w)
-		requestRespondCode(w, http.StatusOK)
+		if user.TOTPSecret != "" {
+			err = jwt.setTwoFactorJWT(w, r, user.Username)
+			if err != nil {
+				Printing.PrintErrStr("Could not start two-factor sign in: " + err.Error())
+				requestRespondCode(w, http.StatusInternalServerError)
+				return
+			}
+			requestRespond(w, SignInResponse{TwoFactor: true})
+			return
+		}
+		err = jwt.setJWT(w, r, *user)
+		if err != nil {
+			Printing.PrintErrStr("Could not start session: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		guard.succeed(r)
+		requestRespond(w, SignInResponse{})
 	}
 }
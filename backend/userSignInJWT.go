@@ -4,13 +4,14 @@ import (
 	"net/http"
 )
 
+// Responds with the signed in user so the frontend knows what they can change
 func userJWTSignIn(jwt JWTService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := jwt.ReadAndValidateJWT(r)
+		claims, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
 		if err != nil {
 			requestRespondCode(w, http.StatusBadRequest)
 			return
 		}
-		requestRespondCode(w, http.StatusOK)
+		requestRespond(w, User{Username: claims.Username, Role: claims.Role})
 	}
 }
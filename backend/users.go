@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+type UserRole string
+
+const (
+	UserRoleAdmin  UserRole = "admin"
+	UserRoleViewer UserRole = "viewer" // Can see analytics and settings, but can't change anything
+)
+
+// Name given to the single account from before CheckBag had usernames
+const legacyUsername = "admin"
+
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+type User struct {
+	Username      string       `json:"username"`
+	Role          UserRole     `json:"role"`
+	Services      ServiceScope `json:"services"`   // Empty for every service
+	Provider      string       `json:"provider"`   // Empty for local users, "oidc" for users from the OIDC provider
+	Subject       string       `json:"-"`          // The OIDC issuer and sub claim, which identify OIDC users
+	TwoFactor     bool         `json:"two_factor"` // Set when loaded, from TOTPSecret
+	PasswordHash  string       `json:"-"`
+	TOTPSecret    string       `json:"-"`
+	TOTPLastStep  int64        `json:"-"` // Codes from this step or earlier were already used
+	RecoveryCodes []string     `json:"-"` // SHA-256 hashes of unused codes
+}
+
+// Creates or updates a user, an empty password keeps an existing user's password
+type UserRequest struct {
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	Role     UserRole     `json:"role"`
+	Services ServiceScope `json:"services"`
+}
+
+type SignInRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// Accepts the bare password older frontends send, which signs in as the legacy account
+func (request *SignInRequest) UnmarshalJSON(data []byte) error {
+	var password string
+	if err := json.Unmarshal(data, &password); err == nil {
+		*request = SignInRequest{Username: legacyUsername, Password: password}
+		return nil
+	}
+	type rawSignInRequest SignInRequest
+	err := json.Unmarshal(data, (*rawSignInRequest)(request))
+	if err == nil && request.Username == "" {
+		request.Username = legacyUsername
+	}
+	return err
+}
+
+// Checks if the role can do everything the required role can
+func (role UserRole) allows(required UserRole) bool {
+	switch role {
+	case UserRoleAdmin:
+		return true
+	case UserRoleViewer:
+		return required == UserRoleViewer
+	}
+	return false
+}
+
+func (request UserRequest) validate() error {
+	if !usernamePattern.MatchString(request.Username) {
+		return errors.New("usernames must be 1 to 64 letters, numbers, or . _ @ -")
+	}
+	if request.Role != UserRoleAdmin && request.Role != UserRoleViewer {
+		return errors.New("unknown role \"" + string(request.Role) + "\"")
+	}
+	return nil
+}
+
+// Checks if removing, demoting, or scoping the user would leave nobody able to manage CheckBag
+func lastAdmin(users []User, username string) bool {
+	return !slices.ContainsFunc(users, func(user User) bool {
+		return user.Role == UserRoleAdmin && user.Services.unscoped() && user.Username != username
+	})
+}
+
+func usersGet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not get users: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		users, err := db.getUsers(r.Context())
+		if err != nil {
+			Printing.PrintErrStr("Could not get users: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		requestRespond(w, users)
+	}
+}
+
+// Creates a user, or changes an existing user's role and password
+func userSet(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userRequest, claims, err := formatUserRequest[UserRequest](r, jwt, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not set user: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		if err := userRequest.validate(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, err.Error())
+			return
+		}
+		users, err := db.getUsers(r.Context())
+		if err != nil {
+			Printing.PrintErrStr("Could not get users: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		user := User{Username: userRequest.Username}
+		var oldUser any // Nil for new users
+		existingIndex := slices.IndexFunc(users, func(existing User) bool { return existing.Username == user.Username })
+		if existingIndex != -1 {
+			oldUser = users[existingIndex]
+			if (userRequest.Role != UserRoleAdmin || !userRequest.Services.unscoped()) && lastAdmin(users, user.Username) {
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, "the last admin can't be demoted or limited to some services")
+				return
+			}
+			user = users[existingIndex] // Keep the password and two-factor settings
+			if user.Provider != "" && userRequest.Password != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, "users from the OIDC provider sign in there, not with a password")
+				return
+			}
+		} else if userRequest.Password == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, "new users need a password")
+			return
+		}
+		// Sessions carry the role and services they were started with, and a new password should sign everyone else out
+		revokeSessions := existingIndex != -1 && (user.Role != userRequest.Role || !slices.Equal(user.Services, userRequest.Services) || userRequest.Password != "")
+		user.Role = userRequest.Role
+		user.Services = userRequest.Services
+		if userRequest.Password != "" {
+			passwordHash, err := createPasswordHash(userRequest.Password)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				requestRespond(w, err.Error())
+				return
+			}
+			user.PasswordHash = string(passwordHash)
+		}
+		err = db.setUser(r.Context(), user)
+		if err != nil {
+			Printing.PrintErrStr("Could not save user: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		if revokeSessions {
+			err = db.removeSessions(r.Context(), user.Username)
+			if err != nil {
+				Printing.PrintErrStr("Could not sign out " + user.Username + ": " + err.Error())
+			}
+		}
+		audit(r, db, claims.Username, AuditUserSet, user.Username, oldUser, struct {
+			User
+			PasswordChanged bool `json:"password_changed,omitempty"`
+		}{user, existingIndex != -1 && userRequest.Password != ""})
+		Printing.Println("Updated user " + user.Username)
+		requestRespond(w, user)
+	}
+}
+
+// Deletes the user in the path
+func userRemove(db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := jwt.ReadAndValidateUnscopedJWT(r, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not remove user: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		username := r.PathValue("username")
+		users, err := db.getUsers(r.Context())
+		if err != nil {
+			Printing.PrintErrStr("Could not get users: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		existingIndex := slices.IndexFunc(users, func(user User) bool { return user.Username == username })
+		if existingIndex == -1 {
+			requestRespondCode(w, http.StatusNotFound)
+			return
+		}
+		if lastAdmin(users, username) {
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, "the last admin can't be removed")
+			return
+		}
+		err = db.removeUser(r.Context(), username)
+		if err != nil {
+			Printing.PrintErrStr("Could not remove user: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditUserRemove, username, users[existingIndex], nil)
+		Printing.Println("Removed user " + username)
+		requestRespondCode(w, http.StatusOK)
+	}
+}
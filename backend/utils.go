@@ -1,23 +1,40 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"io"
-	"math/rand"
+	"math/big"
 	"net/http"
+	"slices"
+	"strings"
 )
 
 func generateRandomString(length int) string {
 	// Charset is URL safe and easy to read
 	const charset = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ123456789"
 
+	// Used for API keys and signing key IDs, so it has to be unpredictable
 	stringBase := make([]byte, length)
 	for i := range stringBase {
-		stringBase[i] = charset[rand.Intn(len(charset))]
+		index, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			panic("Unable to read random bytes: " + err.Error())
+		}
+		stringBase[i] = charset[index.Int64()]
 	}
 	return string(stringBase)
 }
 
+// The address the dashboard was opened at, as seen by the browser
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if requestSecure(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + requestHost(r)
+}
+
 func requestRespond(w http.ResponseWriter, data any) error {
 	jsonData, err := json.Marshal(data)
 	if err != nil {
@@ -42,3 +59,32 @@ func requestReceived[ReturnType any](r *http.Request) (*ReturnType, error) {
 	err = json.Unmarshal(body, &request)
 	return &request, err
 }
+
+// Keeps the entries with the highest counts, ties are broken alphabetically for stable output
+func topCounts(counts map[string]int, limit int) map[string]int {
+	if len(counts) <= limit {
+		return counts
+	}
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a string, b string) int {
+		if counts[a] != counts[b] {
+			return counts[b] - counts[a]
+		}
+		return strings.Compare(a, b)
+	})
+	top := make(map[string]int, limit)
+	for _, name := range names[:limit] {
+		top[name] = counts[name]
+	}
+	return top
+}
+
+// Adds every count in source to destination
+func addCounts(destination map[string]int, source map[string]int) {
+	for name, count := range source {
+		destination[name] += count
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Visits reconstructed from proxied page requests, totals are for visits that started in the bucket
+type VisitSummary struct {
+	Visits               int            `json:"visits"`
+	VisitPages           int            `json:"visit_pages"`
+	VisitDuration        int            `json:"visit_duration"` // Seconds, summed across all visits
+	Bounces              int            `json:"bounces"`
+	PagesPerVisit        float64        `json:"pages_per_visit"`
+	AverageVisitDuration float64        `json:"average_visit_duration"` // Seconds
+	BounceRate           float64        `json:"bounce_rate"`            // 0 to 1
+	EntryResource        map[string]int `json:"entry_resource"`
+	ExitResource         map[string]int `json:"exit_resource"`
+}
+
+// How long a visitor may go without requesting a page before their next page starts a new visit
+var visitTimeout = 30 * time.Minute
+
+// Resources with these extensions are never counted as pages
+var staticAssetExtensions = []string{
+	".js", ".mjs", ".css", ".map", ".json", ".xml", ".txt", ".webmanifest",
+	".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico", ".bmp",
+	".woff", ".woff2", ".ttf", ".otf", ".eot",
+	".mp3", ".mp4", ".webm", ".m4a", ".m3u8", ".ts", ".wasm",
+}
+
+func newVisitSummary(visits int, pages int, duration int, bounces int) VisitSummary {
+	summary := VisitSummary{
+		Visits:        visits,
+		VisitPages:    pages,
+		VisitDuration: duration,
+		Bounces:       bounces,
+	}
+	if visits > 0 {
+		summary.PagesPerVisit = float64(pages) / float64(visits)
+		summary.AverageVisitDuration = float64(duration) / float64(visits)
+		summary.BounceRate = float64(bounces) / float64(visits)
+	}
+	return summary
+}
+
+// Reads VISIT_TIMEOUT in minutes, keeping the default if it's missing or invalid
+func loadVisitTimeout() {
+	rawTimeout := os.Getenv("VISIT_TIMEOUT")
+	if rawTimeout == "" {
+		return
+	}
+	timeout, err := time.ParseDuration(rawTimeout + "m")
+	if err != nil || timeout <= 0 {
+		Printing.PrintErrStr("Invalid VISIT_TIMEOUT \"" + rawTimeout + "\", using " + visitTimeout.String())
+		return
+	}
+	visitTimeout = timeout
+	Printing.Println("Visit timeout set to " + visitTimeout.String())
+}
+
+// Anonymous, stable identifier for a visitor based on their IP and User-Agent
+func visitorID(ip string, userAgent string) string {
+	hash := sha256.Sum256([]byte(ip + "|" + userAgent))
+	return hex.EncodeToString(hash[:16])
+}
+
+// Checks if a request is for a page, rather than an asset or a background request from a page
+func isPageRequest(r *http.Request, responseCode int) bool {
+	if r.Method != http.MethodGet || responseCode >= 400 {
+		return false
+	}
+	if fetchDestination := r.Header.Get("Sec-Fetch-Dest"); fetchDestination != "" && fetchDestination != "document" {
+		return false
+	}
+	extension := strings.ToLower(path.Ext(r.PathValue("path")))
+	return !slices.Contains(staticAssetExtensions, extension)
+}
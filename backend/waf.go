@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	Printing "github.com/benjaminRoberts01375/CheckBag/backend/logging"
+)
+
+// Analytics reason for requests refused by a service's web application firewall
+const blockedWAF = "waf"
+
+// Request bodies are only inspected up to this size, the rest is forwarded unchecked
+const maximumWAFBodyBytes = 128 << 10
+
+type WAFMode string
+
+const (
+	WAFModeOff    WAFMode = ""
+	WAFModeDetect WAFMode = "detect" // Only record matched rules
+	WAFModeBlock  WAFMode = "block"  // Also refuse requests matching a deny or block rule
+)
+
+type WAFSettings struct {
+	Mode   WAFMode        `json:"mode"`
+	Denial DenialResponse `json:"denial"`
+}
+
+type WAFRules struct {
+	BuiltIn string `json:"built_in"` // Read only
+	Custom  string `json:"custom"`   // Added after the built-in rules, and may remove them with SecRuleRemoveById
+}
+
+type WAFEngine struct {
+	mutex  sync.RWMutex
+	rules  []wafRule
+	custom string
+}
+
+// A small set of rules in the style of the OWASP Core Rule Set, IDs follow its numbering
+const builtInWAFRules = `# Protocol enforcement
+SecRule REQUEST_HEADERS:Content-Length "!@rx ^\d+$" "id:920160,phase:1,deny,t:none,msg:'Content-Length header is not numeric'"
+SecRule ARGS|ARGS_NAMES|REQUEST_HEADERS "@rx \x00" "id:920270,phase:2,deny,t:none,msg:'Null byte in request'"
+
+# Local file inclusion
+SecRule REQUEST_URI|ARGS|REQUEST_HEADERS:Referer "@rx (?:^|[\\/])\.\.(?:[\\/]|$)" "id:930100,phase:2,deny,t:none,t:urlDecodeUni,msg:'Path traversal attack'"
+SecRule ARGS|REQUEST_FILENAME "@pm /etc/passwd /etc/shadow /proc/self/environ boot.ini win.ini /.ssh/id_rsa" "id:930120,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'OS file access attempt'"
+
+# Remote file inclusion
+SecRule ARGS "@rx ^(?i:file|ftps?|https?)://\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}" "id:931100,phase:2,deny,t:none,msg:'Remote file inclusion with an IP address URL'"
+
+# Remote command execution
+SecRule ARGS "@rx (?:;|\||&&|\$\(|` + "`" + `)\s*(?:cat|curl|wget|nc|bash|sh|python[23]?|perl|php|rm|chmod|id|whoami|uname)\b" "id:932100,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'Unix command injection'"
+SecRule REQUEST_HEADERS "@rx ^\(\s*\)\s*\{" "id:932170,phase:2,deny,t:none,t:urlDecodeUni,msg:'Shellshock'"
+
+# PHP injection
+SecRule ARGS "@rx <\?(?:php|=)" "id:933100,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'PHP open tag'"
+SecRule ARGS "@pm php://input php://filter data://text/plain expect:// zip:// phar://" "id:933110,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'PHP wrapper'"
+
+# Cross site scripting
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES|REQUEST_HEADERS:Referer "@rx <script[^>]*>" "id:941110,phase:2,deny,t:none,t:urlDecodeUni,t:htmlEntityDecode,t:lowercase,msg:'XSS script tag'"
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES "@rx \bon(?:error|load|click|mouseover|focus|blur|animationstart)\s*=" "id:941120,phase:2,deny,t:none,t:urlDecodeUni,t:htmlEntityDecode,t:lowercase,msg:'XSS event handler'"
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES "@rx (?:javascript|vbscript)\s*:" "id:941170,phase:2,deny,t:none,t:urlDecodeUni,t:htmlEntityDecode,t:lowercase,t:removeWhitespace,msg:'XSS script URI'"
+
+# SQL injection
+SecRule ARGS|ARGS_NAMES|REQUEST_COOKIES "@rx \bunion\b.{1,100}?\bselect\b" "id:942100,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,t:compressWhitespace,msg:'SQL injection: UNION SELECT'"
+SecRule ARGS|REQUEST_COOKIES "@rx (?:'|\")\s*(?:or|and)\s+(?:'|\")?\w+(?:'|\")?\s*=\s*(?:'|\")?\w+" "id:942130,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'SQL injection: tautology'"
+SecRule ARGS|REQUEST_COOKIES "@rx \b(?:sleep|benchmark|pg_sleep|waitfor\s+delay)\s*\(" "id:942160,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'SQL injection: time based'"
+SecRule ARGS|REQUEST_COOKIES "@rx (?:;|')\s*(?:drop|truncate|alter|insert|delete|update)\s+(?:table|from|into|database)\b" "id:942350,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'SQL injection: stacked query'"
+
+# Java attacks
+SecRule REQUEST_URI|ARGS|REQUEST_HEADERS|REQUEST_BODY "@rx \$\{(?:jndi|env|sys|lower|upper|::-)" "id:944150,phase:2,deny,t:none,t:urlDecodeUni,t:lowercase,msg:'Log4Shell'"
+`
+
+func (engine *WAFEngine) Setup(db AdvancedDB) {
+	custom, err := db.getWAFRules(context.Background())
+	if err != nil {
+		Printing.PrintErrStr("Could not get WAF rules from database, using built-in rules only: " + err.Error())
+	}
+	err = engine.SetRules(custom)
+	if err != nil { // Custom rules that parsed when saved should still parse, but don't leave the engine empty
+		Printing.PrintErrStr(err.Error())
+		engine.SetRules("")
+	}
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	Printing.Println("Loaded " + strconv.Itoa(len(engine.rules)) + " WAF rules")
+}
+
+// Replaces the custom rules, built-in rules are always parsed first
+func (engine *WAFEngine) SetRules(custom string) error {
+	rules, err := parseSecLang(builtInWAFRules + "\n" + custom)
+	if err != nil {
+		return errors.New("WAF rules are invalid: " + err.Error())
+	}
+	engine.mutex.Lock()
+	defer engine.mutex.Unlock()
+	engine.rules = rules
+	engine.custom = custom
+	return nil
+}
+
+func (engine *WAFEngine) Rules() WAFRules {
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	return WAFRules{BuiltIn: builtInWAFRules, Custom: engine.custom}
+}
+
+// All rules matching the request, and whether any of them blocks it
+func (engine *WAFEngine) Evaluate(r *http.Request) ([]wafRule, bool) {
+	transaction := newWAFTransaction(r)
+	engine.mutex.RLock()
+	defer engine.mutex.RUnlock()
+	var matches []wafRule
+	disruptive := false
+	for _, rule := range engine.rules {
+		if rule.matches(transaction) {
+			matches = append(matches, rule)
+			disruptive = disruptive || rule.Disruptive
+		}
+	}
+	return matches, disruptive
+}
+
+// Inspects the request with the service's WAF, returning true if it was blocked and answered
+func inspectRequest(w http.ResponseWriter, r *http.Request, annotations *RequestAnnotations, service *ServiceLink, engine *WAFEngine, serviceLinks ServiceLinks, db AdvancedDB) bool {
+	if service.WAF.Mode == WAFModeOff {
+		return false
+	}
+	matches, disruptive := engine.Evaluate(r)
+	for _, rule := range matches {
+		annotations.WAFRules = append(annotations.WAFRules, strconv.Itoa(rule.ID))
+	}
+	if !disruptive || service.WAF.Mode != WAFModeBlock {
+		return false
+	}
+	Printing.Println("WAF blocked request to " + service.Title + " matching rule " + annotations.WAFRules[0])
+	blockRequest(w, r, annotations, blockedWAF, service.WAF.Denial, serviceLinks, db)
+	return true
+}
+
+func (settings WAFSettings) validate() error {
+	switch settings.Mode {
+	case WAFModeOff, WAFModeDetect, WAFModeBlock:
+	default:
+		return errors.New("unknown WAF mode \"" + string(settings.Mode) + "\"")
+	}
+	return settings.Denial.validate()
+}
+
+// The parts of a request rules can inspect, collected once per request
+type wafTransaction struct {
+	collections map[string][]wafValue
+}
+
+type wafValue struct {
+	key   string // Lowercase
+	value string
+}
+
+func newWAFTransaction(r *http.Request) wafTransaction {
+	transaction := wafTransaction{collections: map[string][]wafValue{}}
+	add := func(collection string, key string, value string) {
+		transaction.collections[collection] = append(transaction.collections[collection], wafValue{key: strings.ToLower(key), value: value})
+	}
+
+	for _, key := range sortedKeys(r.URL.Query()) {
+		for _, value := range r.URL.Query()[key] {
+			add("ARGS_GET", key, value)
+		}
+	}
+	body := readWAFBody(r)
+	add("REQUEST_BODY", "", string(body))
+	for key, values := range parseWAFBodyArguments(r, body) {
+		for _, value := range values {
+			add("ARGS_POST", key, value)
+		}
+	}
+	for _, collection := range []string{"ARGS_GET", "ARGS_POST"} {
+		for _, argument := range transaction.collections[collection] {
+			transaction.collections["ARGS"] = append(transaction.collections["ARGS"], argument)
+			add("ARGS_NAMES", argument.key, argument.key)
+		}
+	}
+	for _, name := range sortedKeys(r.Header) {
+		for _, value := range r.Header[name] {
+			add("REQUEST_HEADERS", name, value)
+		}
+		add("REQUEST_HEADERS_NAMES", name, name)
+	}
+	for _, cookie := range r.Cookies() {
+		add("REQUEST_COOKIES", cookie.Name, cookie.Value)
+		add("REQUEST_COOKIES_NAMES", cookie.Name, cookie.Name)
+	}
+	requestPath := "/" + strings.TrimPrefix(r.PathValue("path"), "/")
+	add("REQUEST_URI", "", requestPath+queryString(r))
+	add("REQUEST_FILENAME", "", requestPath)
+	add("REQUEST_BASENAME", "", path.Base(requestPath))
+	add("QUERY_STRING", "", r.URL.RawQuery)
+	add("REQUEST_METHOD", "", r.Method)
+	add("REQUEST_PROTOCOL", "", r.Proto)
+	add("REMOTE_ADDR", "", requestClientIP(r))
+	return transaction
+}
+
+func queryString(r *http.Request) string {
+	if r.URL.RawQuery == "" {
+		return ""
+	}
+	return "?" + r.URL.RawQuery
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Reads the start of the body for inspection, and puts it back so it can still be forwarded
+func readWAFBody(r *http.Request) []byte {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maximumWAFBodyBytes))
+	if err != nil {
+		Printing.PrintErrStr("Could not read request body for WAF: " + err.Error())
+	}
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+	return body
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Form and JSON bodies become arguments, JSON keys are flattened like "json.user.name"
+func parseWAFBodyArguments(r *http.Request, body []byte) url.Values {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case mediaType == "application/x-www-form-urlencoded":
+		arguments, _ := url.ParseQuery(string(body))
+		return arguments
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var document any
+		if json.Unmarshal(body, &document) != nil {
+			return nil
+		}
+		arguments := url.Values{}
+		flattenJSONArguments("json", document, arguments)
+		return arguments
+	}
+	return nil
+}
+
+func flattenJSONArguments(key string, document any, arguments url.Values) {
+	switch value := document.(type) {
+	case map[string]any:
+		for childKey, child := range value {
+			flattenJSONArguments(key+"."+childKey, child, arguments)
+		}
+	case []any:
+		for i, child := range value {
+			flattenJSONArguments(key+"."+strconv.Itoa(i), child, arguments)
+		}
+	case string:
+		arguments.Add(key, value)
+	case nil:
+		arguments.Add(key, "")
+	default:
+		encoded, _ := json.Marshal(value)
+		arguments.Add(key, string(encoded))
+	}
+}
+
+func (rule wafRule) matches(transaction wafTransaction) bool {
+	matched := false
+	for _, value := range rule.values(transaction) {
+		for _, transformation := range rule.transformations {
+			value = transformation(value)
+		}
+		if rule.operator.matches(value) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return false
+	}
+	return rule.chained == nil || rule.chained.matches(transaction)
+}
+
+// The values selected by the rule's variables, minus its exclusions
+func (rule wafRule) values(transaction wafTransaction) []string {
+	var values []string
+	for _, variable := range rule.variables {
+		if variable.excluded {
+			continue
+		}
+		for _, candidate := range transaction.collections[variable.collection] {
+			if !variable.selects(candidate.key) || rule.excludes(variable.collection, candidate.key) {
+				continue
+			}
+			values = append(values, candidate.value)
+		}
+	}
+	return values
+}
+
+func (variable wafVariable) selects(key string) bool {
+	switch {
+	case variable.keyPattern != nil:
+		return variable.keyPattern.MatchString(key)
+	case variable.key != "":
+		return variable.key == key
+	}
+	return true
+}
+
+func (rule wafRule) excludes(collection string, key string) bool {
+	for _, variable := range rule.variables {
+		if !variable.excluded || !variable.selects(key) {
+			continue
+		}
+		// Excluding from ARGS also excludes from its subsets, and the other way around
+		if variable.collection == collection || (strings.HasPrefix(collection, "ARGS") && strings.HasPrefix(variable.collection, "ARGS")) {
+			return true
+		}
+	}
+	return false
+}
+
+func wafRulesGet(engine *WAFEngine, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := jwt.ReadAndValidateJWT(r, UserRoleViewer)
+		if err != nil {
+			Printing.PrintErrStr("Could not get WAF rules: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		requestRespond(w, engine.Rules())
+	}
+}
+
+// Replaces the custom WAF rules
+func wafRulesSet(engine *WAFEngine, db AdvancedDB, jwt JWTService) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		newRules, claims, err := formatUserRequest[WAFRules](r, jwt, UserRoleAdmin)
+		if err != nil {
+			Printing.PrintErrStr("Could not set WAF rules: " + err.Error())
+			requestRespondCode(w, http.StatusForbidden)
+			return
+		}
+		oldRules := engine.Rules().Custom
+		err = engine.SetRules(newRules.Custom)
+		if err != nil {
+			Printing.PrintErrStr(err.Error())
+			w.WriteHeader(http.StatusBadRequest)
+			requestRespond(w, err.Error())
+			return
+		}
+		err = db.setWAFRules(r.Context(), newRules.Custom)
+		if err != nil {
+			Printing.PrintErrStr("Could not save WAF rules: " + err.Error())
+			requestRespondCode(w, http.StatusInternalServerError)
+			return
+		}
+		audit(r, db, claims.Username, AuditWAFRulesSet, "", oldRules, newRules.Custom)
+		Printing.Println("Updated WAF rules")
+		requestRespond(w, engine.Rules())
+	}
+}
@@ -99,20 +99,37 @@ const AnimatedIPAddress = ({ duration, waitTime }: IPAddressProps) => {
 
 interface PasswordScreenProps {
 	buttonText: string;
-	passwordSubmit: (password: string) => void;
+	passwordSubmit: (username: string, password: string) => void;
+	codeSubmit?: (code: string) => void; // Asks for a two-factor code instead of credentials when set
+	passkeySubmit?: () => void; // Offers signing in with a passkey when set
+	ssoSubmit?: () => void; // Offers signing in through the OIDC provider when set
+	passwordHidden?: boolean; // Hides the username and password when only the OIDC provider can be used
 	error: string;
 }
 
-const PasswordScreen = ({ buttonText, passwordSubmit, error }: PasswordScreenProps) => {
+const PasswordScreen = ({
+	buttonText,
+	passwordSubmit,
+	codeSubmit,
+	passkeySubmit,
+	ssoSubmit,
+	passwordHidden,
+	error,
+}: PasswordScreenProps) => {
 	function onSubmit(event: FormEvent<HTMLFormElement>) {
 		event.preventDefault();
 		const formData = new FormData(event.currentTarget);
+		if (codeSubmit !== undefined) {
+			codeSubmit((formData.get("code") as string) ?? "");
+			return;
+		}
+		const username = formData.get("username") as string;
 		const password = formData.get("password") as string;
 		if (password === undefined || password === "" || password === null) {
 			error = "Password cannot be empty";
 			return;
 		}
-		passwordSubmit(password);
+		passwordSubmit(username ?? "", password);
 	}
 
 	return (
@@ -128,15 +145,47 @@ const PasswordScreen = ({ buttonText, passwordSubmit, error }: PasswordScreenPro
 						<p>Know your network inside and out</p>
 					</div>
 					<form onSubmit={onSubmit}>
-						<input
-							placeholder="Enter your password"
-							type="password"
-							id={PasswordStyles["field"]}
-							name="password"
-						/>
-						<button type="submit" id={PasswordStyles["submit"]} className="primary">
-							<p id={PasswordStyles["submit-text"]}>{buttonText}</p>
-						</button>
+						{codeSubmit !== undefined ? (
+							<input
+								placeholder="Enter your authenticator or recovery code"
+								type="text"
+								className={PasswordStyles["field"]}
+								name="code"
+								autoComplete="one-time-code"
+								autoFocus
+							/>
+						) : passwordHidden ? null : (
+							<>
+								<input
+									placeholder="Enter your username"
+									type="text"
+									className={PasswordStyles["field"]}
+									name="username"
+									autoComplete="username"
+								/>
+								<input
+									placeholder="Enter your password"
+									type="password"
+									className={PasswordStyles["field"]}
+									name="password"
+								/>
+							</>
+						)}
+						{passwordHidden && codeSubmit === undefined ? null : (
+							<button type="submit" id={PasswordStyles["submit"]} className="primary">
+								<p id={PasswordStyles["submit-text"]}>{buttonText}</p>
+							</button>
+						)}
+						{ssoSubmit !== undefined && codeSubmit === undefined ? (
+							<button type="button" id={PasswordStyles["sso"]} onClick={ssoSubmit}>
+								Sign in with SSO
+							</button>
+						) : null}
+						{passkeySubmit !== undefined && codeSubmit === undefined ? (
+							<button type="button" id={PasswordStyles["passkey"]} onClick={passkeySubmit}>
+								Sign in with a passkey
+							</button>
+						) : null}
 						{error !== "" ? <p id={PasswordStyles["error"]}>{error}</p> : null}
 					</form>
 					<Version />
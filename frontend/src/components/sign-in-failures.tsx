@@ -0,0 +1,101 @@
+import "../styles.css";
+import DashboardStyles from "../screens/dashboard.module.css";
+import GraphStyles from "./graphs.module.css";
+import ResourceTableStyles from "./resource-table.module.css";
+import SignInFailure from "../types/sign-in-failure";
+import { useEffect, useState } from "react";
+
+const methodNames: Record<SignInFailure["method"], string> = {
+	password: "Password",
+	sign_up: "Sign up",
+	two_factor: "Two-factor code",
+	passkey: "Passkey",
+};
+
+// Recent failed sign ins, only shown to admins who can see every service
+const SignInFailures = () => {
+	const [failures, setFailures] = useState<SignInFailure[] | null>(null);
+
+	useEffect(() => {
+		async function requestFailures() {
+			try {
+				const response = await fetch("/api/sign-in-failures", {
+					method: "GET",
+					credentials: "include",
+				});
+				if (!response.ok) {
+					throw new Error("Failed to get failed sign ins: " + response.status);
+				}
+				setFailures(await response.json());
+			} catch (error) {
+				console.error("Error getting failed sign ins:", error);
+				setFailures(null);
+			}
+		}
+		requestFailures();
+		const interval = setInterval(requestFailures, 30000);
+		return () => clearInterval(interval);
+	}, []);
+
+	if (failures === null) {
+		return null;
+	}
+
+	return (
+		<div className={DashboardStyles["graph-group"]}>
+			<div id={GraphStyles["container"]}>
+				<div id={GraphStyles["header"]}>
+					<h2>Failed Sign Ins</h2>
+				</div>
+				{failures.length === 0 ? (
+					<p className={ResourceTableStyles["no-data"]}>No data to display</p>
+				) : (
+					<table className={ResourceTableStyles["styled-table"]}>
+						<thead>
+							<tr>
+								<th>
+									<p>Time</p>
+								</th>
+								<th>
+									<p>IP Address</p>
+								</th>
+								<th>
+									<p>Username</p>
+								</th>
+								<th>
+									<p>Method</p>
+								</th>
+								<th>
+									<p>Lockout</p>
+								</th>
+							</tr>
+						</thead>
+						<tbody>
+							{failures.map(failure => (
+								<tr key={failure.time + failure.ip + failure.method}>
+									<td>
+										<p>{new Date(failure.time).toLocaleString()}</p>
+									</td>
+									<td>
+										<p>{failure.ip}</p>
+									</td>
+									<td>
+										<p className={ResourceTableStyles["resource"]}>{failure.username}</p>
+									</td>
+									<td>
+										<p>{methodNames[failure.method] ?? failure.method}</p>
+									</td>
+									<td>
+										<p>{failure.lockout > 0 ? failure.lockout + "s" : ""}</p>
+									</td>
+								</tr>
+							))}
+						</tbody>
+					</table>
+				)}
+			</div>
+		</div>
+	);
+};
+
+export default SignInFailures;
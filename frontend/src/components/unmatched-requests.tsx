@@ -0,0 +1,102 @@
+import "../styles.css";
+import DashboardStyles from "../screens/dashboard.module.css";
+import GraphStyles from "./graphs.module.css";
+import ResourceTableStyles from "./resource-table.module.css";
+import UnmatchedRequestSummary from "../types/unmatched-request-summary";
+import { useList } from "../context-hook";
+import { useEffect, useState } from "react";
+
+// How many of each to show, the backend sends more
+const topCount = 10;
+
+interface CountTableProps {
+	label: string;
+	counts: Record<string, number>;
+}
+
+const CountTable = ({ label, counts }: CountTableProps) => {
+	const rows = Object.entries(counts)
+		.sort(([, a], [, b]) => b - a)
+		.slice(0, topCount);
+
+	return (
+		<table className={ResourceTableStyles["styled-table"]}>
+			<thead>
+				<tr>
+					<th>
+						<p>{label}</p>
+					</th>
+					<th>
+						<p>Quantity</p>
+					</th>
+				</tr>
+			</thead>
+			<tbody>
+				{rows.map(([value, quantity]) => (
+					<tr key={value}>
+						<td>
+							<p className={ResourceTableStyles["resource"]}>{value}</p>
+						</td>
+						<td>
+							<p>{quantity.toLocaleString("en")}</p>
+						</td>
+					</tr>
+				))}
+			</tbody>
+		</table>
+	);
+};
+
+// Requests for hosts that aren't a service, usually scanners probing for something to attack
+const UnmatchedRequests = () => {
+	const { timescale } = useList();
+	const [summary, setSummary] = useState<UnmatchedRequestSummary | null>(null);
+
+	useEffect(() => {
+		async function requestSummary() {
+			try {
+				const url = new URL("/api/unmatched-requests", window.location.origin);
+				url.searchParams.set("time-step", timescale);
+				const response = await fetch(url, {
+					method: "GET",
+					credentials: "include",
+				});
+				if (!response.ok) {
+					throw new Error("Failed to get unmatched requests: " + response.status);
+				}
+				setSummary(await response.json());
+			} catch (error) {
+				console.error("Error getting unmatched requests:", error);
+				setSummary(null);
+			}
+		}
+		requestSummary();
+		const interval = setInterval(requestSummary, 30000);
+		return () => clearInterval(interval);
+	}, [timescale]);
+
+	if (summary === null) {
+		return null;
+	}
+
+	return (
+		<div className={DashboardStyles["graph-group"]}>
+			<div id={GraphStyles["container"]}>
+				<div id={GraphStyles["header"]}>
+					<h2>Unmatched Requests ({summary.quantity.toLocaleString("en")})</h2>
+				</div>
+				{summary.quantity === 0 ? (
+					<p className={ResourceTableStyles["no-data"]}>No data to display</p>
+				) : (
+					<>
+						<CountTable label="Host" counts={summary.host} />
+						<CountTable label="Path" counts={summary.resource} />
+						<CountTable label="IP Address" counts={summary.ip} />
+					</>
+				)}
+			</div>
+		</div>
+	);
+};
+
+export default UnmatchedRequests;
@@ -50,6 +50,11 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 		return undefined;
 	}
 
+	// The session cookie can't be read by scripts, so requests that change something prove they came from here with this
+	function csrfHeader(): Record<string, string> {
+		return { "X-CSRF-Token": cookieGet("checkbag-csrf-token") ?? "" };
+	}
+
 	// Combines pre-processed service data for a specific timescale
 	function combinePreProcessedData(targetTimescale: Timescale): ProcessedChartData {
 		const enabledServices = services.filter(service => service.enabled);
@@ -217,6 +222,7 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 					method: "POST",
 					headers: {
 						"Content-Type": "application/json",
+						...csrfHeader(),
 					},
 					body: JSON.stringify(keys),
 					credentials: "include",
@@ -342,6 +348,7 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 				method: "POST",
 				headers: {
 					"Content-Type": "application/json",
+					...csrfHeader(),
 				},
 				body: JSON.stringify(servicesToSend),
 				credentials: "include",
@@ -375,6 +382,7 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 					method: "POST",
 					headers: {
 						"Content-Type": "application/json",
+						...csrfHeader(),
 					},
 					body: JSON.stringify(newPassword),
 					credentials: "include",
@@ -406,6 +414,7 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 					updated_service.dayProcessed = existingService.dayProcessed;
 					updated_service.monthProcessed = existingService.monthProcessed;
 					updated_service.yearProcessed = existingService.yearProcessed;
+					updated_service.settings = existingService.settings;
 					return updated_service;
 				}
 				return existingService;
@@ -442,6 +451,7 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 			try {
 				const response = await fetch("/api/user-sign-in-jwt", {
 					method: "POST",
+					headers: csrfHeader(),
 					credentials: "include",
 				});
 
@@ -459,7 +469,8 @@ export const ContextProvider: React.FC<Props> = ({ children }) => {
 
 	useEffect(() => {
 		console.log("CheckBag Version:", __CHECKBAG_VERSION__);
-		if (cookieGet("checkbag-session-token")) {
+		// Set alongside the session cookie, which scripts can't see
+		if (cookieGet("checkbag-csrf-token")) {
 			jwtSignIn();
 		}
 		userExists();
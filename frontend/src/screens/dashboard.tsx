@@ -4,6 +4,8 @@ import { useList } from "../context-hook";
 import StackedBarChart from "../components/stacked-bar-chart";
 import PieChartComponent from "../components/pie-chart";
 import ResourceTable from "../components/resource-table";
+import SignInFailures from "../components/sign-in-failures";
+import UnmatchedRequests from "../components/unmatched-requests";
 import { createTheme } from "@mui/material/styles";
 import { ThemeProvider } from "@mui/material/styles";
 import { formatBytes } from "../utils";
@@ -62,6 +64,8 @@ const DashboardScreen = () => {
 				<div className={DashboardStyles["graph-group"]}>
 					<ResourceTable data={chartData.resourceUsage} title="Resource Usage" />
 				</div>
+				<UnmatchedRequests />
+				<SignInFailures />
 			</ThemeProvider>
 		</div>
 	);
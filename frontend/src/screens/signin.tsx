@@ -1,15 +1,46 @@
 import "../styles.css";
 import PasswordScreen from "../components/password";
-import { useState } from "react";
-import { useNavigate } from "react-router-dom";
+import { useEffect, useState } from "react";
+import { useNavigate, useSearchParams } from "react-router-dom";
 import { useList } from "../context-hook";
 
 const SignInScreen = () => {
 	const [error, setError] = useState<string>("");
+	const [twoFactor, setTwoFactor] = useState<boolean>(false);
+	const [passwordSignIn, setPasswordSignIn] = useState<boolean>(true);
+	const [oidcSignIn, setOIDCSignIn] = useState<boolean>(false);
 	const navigate = useNavigate();
+	const [searchParams] = useSearchParams();
 	const { signIn } = useList();
 
-	function onSubmit(password: string) {
+	useEffect(() => {
+		if (searchParams.get("error") === "oidc") {
+			setError("Unable to sign in with SSO");
+		}
+		(async () => {
+			try {
+				const response = await fetch("/api/sign-in-methods", {
+					method: "GET",
+					credentials: "include",
+				});
+				if (!response.ok) {
+					throw new Error("Failed to get sign in methods: " + response.status);
+				}
+				const methods = await response.json();
+				setPasswordSignIn(methods.password);
+				setOIDCSignIn(methods.oidc);
+			} catch (error) {
+				console.error("Error getting sign in methods:", error);
+			}
+		})();
+	}, []);
+
+	// The provider sends the browser back to the dashboard once signed in
+	function onSSOSubmit() {
+		window.location.href = "/api/oidc/sign-in";
+	}
+
+	function onSubmit(username: string, password: string) {
 		console.log("Submitted");
 		(async () => {
 			try {
@@ -18,19 +49,114 @@ const SignInScreen = () => {
 					headers: {
 						"Content-Type": "application/json",
 					},
-					body: JSON.stringify(password),
+					body: JSON.stringify({ username, password }),
 					credentials: "include",
 				});
 
+				if (response.status === 429) {
+					setError("Too many failed sign ins, try again later");
+					return;
+				}
 				if (!response.ok) {
 					throw new Error("Failed to log in user: " + response.status);
 				}
+				const result = await response.json();
+				if (result?.two_factor) {
+					setError("");
+					setTwoFactor(true);
+					return;
+				}
 				console.log("Successfully logged in user");
 				signIn();
 				navigate("/dashboard");
 			} catch (error) {
 				console.error("Error logging in user:", error);
-				setError("Invalid password");
+				setError("Invalid username or password");
+			}
+		})();
+	}
+
+	function onPasskeySubmit() {
+		(async () => {
+			try {
+				const beginResponse = await fetch("/api/user-sign-in-passkey/begin", {
+					method: "POST",
+					headers: {
+						"Content-Type": "application/json",
+					},
+					body: JSON.stringify({}),
+					credentials: "include",
+				});
+				if (!beginResponse.ok) {
+					throw new Error("Failed to start passkey sign in: " + beginResponse.status);
+				}
+				// WebAuthn's JSON helpers aren't in every TypeScript DOM library yet
+				const publicKeyCredential = PublicKeyCredential as unknown as {
+					parseRequestOptionsFromJSON(options: unknown): PublicKeyCredentialRequestOptions;
+				};
+				const credential = await navigator.credentials.get({
+					publicKey: publicKeyCredential.parseRequestOptionsFromJSON(await beginResponse.json()),
+				});
+				if (credential === null) {
+					throw new Error("No passkey was chosen");
+				}
+
+				const response = await fetch("/api/user-sign-in-passkey/finish", {
+					method: "POST",
+					headers: {
+						"Content-Type": "application/json",
+					},
+					body: JSON.stringify(credential),
+					credentials: "include",
+				});
+				if (response.status === 429) {
+					setError("Too many failed sign ins, try again later");
+					return;
+				}
+				if (!response.ok) {
+					throw new Error("Failed to sign in with passkey: " + response.status);
+				}
+				const result = await response.json();
+				if (result?.two_factor) {
+					setError("");
+					setTwoFactor(true);
+					return;
+				}
+				console.log("Successfully logged in user");
+				signIn();
+				navigate("/dashboard");
+			} catch (error) {
+				console.error("Error signing in with passkey:", error);
+				setError("Unable to sign in with a passkey");
+			}
+		})();
+	}
+
+	function onCodeSubmit(code: string) {
+		(async () => {
+			try {
+				const response = await fetch("/api/user-sign-in-two-factor", {
+					method: "POST",
+					headers: {
+						"Content-Type": "application/json",
+					},
+					body: JSON.stringify({ code }),
+					credentials: "include",
+				});
+
+				if (response.status === 429) {
+					setError("Too many failed sign ins, try again later");
+					return;
+				}
+				if (!response.ok) {
+					throw new Error("Failed to verify two-factor code: " + response.status);
+				}
+				console.log("Successfully logged in user");
+				signIn();
+				navigate("/dashboard");
+			} catch (error) {
+				console.error("Error verifying two-factor code:", error);
+				setError("Invalid code");
 			}
 		})();
 	}
@@ -38,7 +164,15 @@ const SignInScreen = () => {
 	return (
 		<>
 			<title>CheckBag - Sign Up</title>
-			<PasswordScreen buttonText="Sign in (uses cookies)" passwordSubmit={onSubmit} error={error} />
+			<PasswordScreen
+				buttonText={twoFactor ? "Verify code" : "Sign in (uses cookies)"}
+				passwordSubmit={onSubmit}
+				codeSubmit={twoFactor ? onCodeSubmit : undefined}
+				passkeySubmit={window.PublicKeyCredential ? onPasskeySubmit : undefined}
+				ssoSubmit={oidcSignIn ? onSSOSubmit : undefined}
+				passwordHidden={!passwordSignIn}
+				error={error}
+			/>
 		</>
 	);
 };
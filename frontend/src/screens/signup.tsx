@@ -39,13 +39,13 @@ const SignUpScreen = () => {
 		userExists();
 	}, []);
 
-	function onSubmit(password: string) {
+	function onSubmit(username: string, password: string) {
 		console.log("Submitting user");
 		(async () => {
 			try {
 				const response = await fetch("/api/user-sign-up", {
 					method: "POST",
-					body: JSON.stringify(password),
+					body: JSON.stringify({ username, password }),
 					credentials: "include",
 				});
 
@@ -2,6 +2,7 @@ class APIKey {
 	name: string;
 	id: string;
 	key?: string;
+	services?: string[]; // Service IDs the key can see, empty for every service
 
 	constructor(name: string, key_id: string, key?: string) {
 		this.name = name;
@@ -23,6 +23,8 @@ class Service {
 	id: string;
 	clientID: string;
 	enabled: boolean;
+	// Backend-only service options (ex. page tracking), kept so saving services doesn't reset them
+	settings: Record<string, unknown> = {};
 
 	// Pre-processed chart data for each timescale - this is all we need!
 	hourProcessed: ServiceProcessedData;
@@ -208,6 +210,7 @@ class Service {
 	// Convert to JSON for server communication (only service config, no analytics)
 	toJSON() {
 		return {
+			...this.settings,
 			outgoing_address: this.outgoing_address,
 			incoming_addresses: this.incoming_addresses,
 			title: this.title,
@@ -215,7 +218,11 @@ class Service {
 		};
 	}
 	static fromJSON(data: any): Service {
-		return new Service(
+		const settings = { ...data };
+		for (const key of ["outgoing_address", "incoming_addresses", "title", "id", "hour", "day", "month", "year"]) {
+			delete settings[key];
+		}
+		const service = new Service(
 			new ServiceURL(
 				data.outgoing_address.protocol,
 				data.outgoing_address.domain,
@@ -230,6 +237,8 @@ class Service {
 			parseAnalyticMap(data.month),
 			parseAnalyticMap(data.year),
 		);
+		service.settings = settings;
+		return service;
 	}
 }
 
@@ -0,0 +1,9 @@
+interface SignInFailure {
+	time: string;
+	ip: string;
+	username: string;
+	method: "password" | "sign_up" | "two_factor" | "passkey";
+	lockout: number; // Seconds the IP was locked out for, 0 if it wasn't
+}
+
+export default SignInFailure;
@@ -0,0 +1,10 @@
+interface UnmatchedRequestSummary {
+	quantity: number;
+	host: Record<string, number>;
+	resource: Record<string, number>;
+	ip: Record<string, number>;
+	country: Record<string, number>;
+	user_agent: Record<string, number>;
+}
+
+export default UnmatchedRequestSummary;